@@ -8,12 +8,11 @@ import (
 	"reflect"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/Q42/gcp-sema/pkg/secretmanager"
 	"github.com/go-errors/errors"
 	"golang.org/x/crypto/ssh/terminal"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 func init() {
@@ -30,6 +29,8 @@ type addCommand struct {
 	Labels     map[string]string    `short:"l" long:"label" description:"set labels using --label=foo:bar"`
 	Force      []bool               `short:"f" long:"force" description:"force overwrite value/labels"`
 	Verbose    []bool               `short:"v" long:"verbose" description:"Show verbose debug information"`
+	Timeout    time.Duration        `long:"timeout" description:"Abort when Secret Manager has not responded within this duration (example: 30s)"`
+	Proxy      string               `long:"proxy" description:"Write through a proxy started with --allow-writes, like http://127.0.0.1:8080. SEMA_PROXY is not used for writes"`
 	Data       string               `hidden:"yes"`
 	// private
 	client secretmanager.KVClient
@@ -47,23 +48,39 @@ func (opts *addCommand) FormatCmd() string {
 }
 
 func (opts *addCommand) Execute(args []string) (err error) {
+	if opts.client == nil && opts.Proxy != "" {
+		if opts.client, err = NewProxyClient(opts.Proxy, opts.Positional.Project); err != nil {
+			return err
+		}
+	}
 	if opts.client == nil {
-		opts.client = prepareSemaClient(opts.Positional.Project)
+		if opts.client, err = prepareSemaClient(opts.Positional.Project); err != nil {
+			return err
+		}
 	}
 
 	if opts.Data == "" {
-		opts.Data = readStringSilently("Enter secret value: ")
+		if opts.Data, err = readStringSilently("Enter secret value: "); err != nil {
+			return err
+		}
 	}
 
+	ctx, cancel := commandContext(opts.Timeout)
+	defer cancel()
+
 	// Upsert "Secret" (the container)
 	var secret secretmanager.KVValue
-	secret, err = opts.client.Get(opts.Positional.Name)
+	secret, err = opts.client.Get(ctx, opts.Positional.Name)
 	var isExistingSecret = secret != nil
+	if ctx.Err() != nil {
+		// also when Get succeeded just before the timeout: nothing was written
+		return abortedError(ctx, ctx.Err())
+	}
 
-	if secret == nil || status.Convert(err).Code() == codes.NotFound {
-		secret, err = opts.client.New(opts.Positional.Name, opts.Labels)
+	if secret == nil || secretmanager.IsNotFound(err) {
+		secret, err = opts.client.New(ctx, opts.Positional.Name, opts.Labels)
 		if err != nil {
-			return err
+			return abortedError(ctx, err)
 		}
 	} else if existingLabels := secret.GetLabels(); !equalLabels(existingLabels, opts.Labels) {
 		if len(opts.Force) == 0 {
@@ -71,9 +88,9 @@ func (opts *addCommand) Execute(args []string) (err error) {
   Existing labels: %s
   New labels:      %s`, formatLabels(existingLabels), formatLabels(opts.Labels))
 		}
-		err = secret.SetLabels(opts.Labels)
+		err = secret.SetLabels(ctx, opts.Labels)
 		if err != nil {
-			return err
+			return abortedError(ctx, err)
 		}
 	}
 
@@ -82,9 +99,9 @@ func (opts *addCommand) Execute(args []string) (err error) {
 		return errors.New("Please use --force to update value of existing secret")
 	}
 
-	version, err := secret.SetValue([]byte(opts.Data))
+	version, err := secret.SetValue(ctx, []byte(opts.Data))
 	if err != nil {
-		return err
+		return abortedError(ctx, err)
 	}
 
 	log.Println("Written", version)
@@ -93,22 +110,14 @@ func (opts *addCommand) Execute(args []string) (err error) {
 
 // readStringSilently will ensure that if you type the password on the commandline,
 // the value is not copied to the output framebuffer, by using `terminal.ReadPassword`.
-func readStringSilently(prompt string) (secret string) {
+func readStringSilently(prompt string) (string, error) {
 	if terminal.IsTerminal(int(syscall.Stdin)) {
 		log.Printf(prompt)
 		bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
-		if err != nil {
-			log.Fatal(err)
-		}
-		secret = string(bytePassword)
-	} else {
-		password, err := ioutil.ReadAll(os.Stdin)
-		if err != nil {
-			log.Fatal(err)
-		}
-		secret = string(password)
+		return string(bytePassword), err
 	}
-	return
+	password, err := ioutil.ReadAll(os.Stdin)
+	return string(password), err
 }
 
 func formatLabels(mp map[string]string) string {
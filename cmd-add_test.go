@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	secretmanager "github.com/Q42/gcp-sema/pkg/secretmanager"
 	"github.com/stretchr/testify/assert"
@@ -11,30 +13,30 @@ func TestAddForceOverwrite(t *testing.T) {
 	kv := secretmanager.NewInMemoryClient("cl-test", "withlabels", "bar", "withoutlabels", "zulu")
 
 	// Update secret with labels
-	secret, _ := kv.Get("withlabels")
-	secret.SetLabels(map[string]string{"a": "b"})
+	secret, _ := kv.Get(context.Background(), "withlabels")
+	secret.SetLabels(context.Background(), map[string]string{"a": "b"})
 	cmdOpts := addCommand{Positional: addCommandPositional{"cl-test", "withlabels"}, Data: "baz1", Labels: map[string]string{"a": "b"}, client: kv, Force: []bool{true}}
 	err := cmdOpts.Execute([]string{})
 	assert.NoError(t, err)
-	secretData, _ := secret.GetValue()
+	secretData, _ := secret.GetValue(context.Background())
 	assert.Equal(t, "baz1", string(secretData))
 
 	// Update secret with changed labels
-	secret, _ = kv.Get("withlabels")
-	secret.SetLabels(map[string]string{"a": "b"})
+	secret, _ = kv.Get(context.Background(), "withlabels")
+	secret.SetLabels(context.Background(), map[string]string{"a": "b"})
 	cmdOpts = addCommand{Positional: addCommandPositional{"cl-test", "withlabels"}, Data: "baz1", Labels: map[string]string{"a": "different"}, client: kv, Force: []bool{true}}
 	err = cmdOpts.Execute([]string{})
 	assert.NoError(t, err)
-	secretData, _ = secret.GetValue()
+	secretData, _ = secret.GetValue(context.Background())
 	assert.Equal(t, "baz1", string(secretData))
 	assert.Equal(t, map[string]string{"a": "different"}, secret.GetLabels())
 
 	// Update secret without labels
-	secret, _ = kv.Get("withoutlabels")
+	secret, _ = kv.Get(context.Background(), "withoutlabels")
 	cmdOpts = addCommand{Positional: addCommandPositional{"cl-test", "withoutlabels"}, Data: "baz2", client: kv, Force: []bool{true}}
 	err = cmdOpts.Execute([]string{})
 	assert.NoError(t, err)
-	secretData, _ = secret.GetValue()
+	secretData, _ = secret.GetValue(context.Background())
 	assert.Equal(t, "baz2", string(secretData))
 }
 
@@ -42,8 +44,8 @@ func TestAddOverwriteFail(t *testing.T) {
 	kv := secretmanager.NewInMemoryClient("cl-test", "withlabels", "bar")
 
 	// Update secret without specifying the same labels
-	secret, _ := kv.Get("withlabels")
-	secret.SetLabels(map[string]string{"a": "b"})
+	secret, _ := kv.Get(context.Background(), "withlabels")
+	secret.SetLabels(context.Background(), map[string]string{"a": "b"})
 	cmdOpts := addCommand{Positional: addCommandPositional{"cl-test", "withlabels"}, Data: "baz1", client: kv}
 	err := cmdOpts.Execute([]string{})
 	assert.Error(t, err, "should throw an error about that labels must be the same")
@@ -64,8 +66,8 @@ func TestAddNotExisting(t *testing.T) {
 	cmdOpts := addCommand{Positional: addCommandPositional{"cl-test", "foo"}, Data: "baz", Labels: map[string]string{"a": "b"}, client: kv}
 	err := cmdOpts.Execute([]string{})
 	assert.NoError(t, err)
-	secret, _ := kv.Get("foo")
-	secretData, _ := secret.GetValue()
+	secret, _ := kv.Get(context.Background(), "foo")
+	secretData, _ := secret.GetValue(context.Background())
 	assert.Equal(t, "baz", string(secretData))
 }
 
@@ -75,3 +77,24 @@ func TestEqualLabels(t *testing.T) {
 	assert.Equal(t, true, equalLabels(map[string]string{"foo": "bar"}, map[string]string{"foo": "bar"}))
 	assert.Equal(t, false, equalLabels(map[string]string{"foo": "bar"}, map[string]string{"john": "doe"}))
 }
+
+// slowClient succeeds, but only after the --timeout
+type slowClient struct {
+	secretmanager.KVClient
+}
+
+func (c slowClient) Get(ctx context.Context, name string) (secretmanager.KVValue, error) {
+	v, err := c.KVClient.Get(context.Background(), name)
+	<-ctx.Done()
+	return v, err
+}
+
+func TestAddAbortedAfterGet(t *testing.T) {
+	kv := secretmanager.NewInMemoryClient("cl-test", "existing", "bar")
+	cmdOpts := addCommand{Positional: addCommandPositional{"cl-test", "existing"}, Data: "baz", client: slowClient{kv}, Force: []bool{true}, Timeout: time.Millisecond}
+	err := cmdOpts.Execute([]string{})
+	assert.EqualError(t, err, "aborted: context deadline exceeded")
+	secret, _ := kv.Get(context.Background(), "existing")
+	secretData, _ := secret.GetValue(context.Background())
+	assert.Equal(t, "bar", string(secretData), "nothing is written")
+}
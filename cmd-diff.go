@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Q42/gcp-sema/pkg/handlers"
+	"github.com/fatih/color"
+	flags "github.com/jessevdk/go-flags"
+	"github.com/joho/godotenv"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+var diffCommandOpts = &diffCommand{}
+var diffCommandInst *flags.Command
+var diffDescription = `Diff compares what render would output against a previous render or a live Kubernetes secret, without printing secret values.`
+var diffDescriptionLong = diffDescription + `
+
+Values are compared by their length and sha256 prefix. The exit code is 6 when there are differences, other errors have the usual exit codes.
+Examples:
+
+  # compare against a live Kubernetes secret
+  kubectl get secret my-app -o yaml | sema diff my-project --against=-
+
+  # compare against the secrets folder written by 'sema pull'
+  sema diff my-project --against=secrets
+
+See 'render' help for more information on specifying secret sources.`
+
+// diffCommand reuses the render pipeline, but compares the result instead of writing it
+type diffCommand struct {
+	RenderCommand
+	Against       string `long:"against" required:"yes" description:"What to compare with: a Kubernetes secret YAML file ('-' for stdin), a directory written by --format=files or a dotenv file"`
+	AgainstFormat string `long:"against-format" default:"auto" choice:"auto" choice:"yaml" choice:"files" choice:"env" description:"Format of --against, by default derived from the path"`
+}
+
+func init() {
+	var err error
+	diffCommandInst, err = parser.AddCommand("diff", diffDescription, diffDescriptionLong, diffCommandOpts)
+	panicIfErr(err)
+}
+
+func (opts *diffCommand) Execute(args []string) (err error) {
+	ctx, cancel := commandContext(opts.Timeout)
+	defer cancel()
+	defer recoverAborted(ctx, &err)
+
+	previous, err := readSecretData(opts.Against, opts.AgainstFormat)
+	if err != nil {
+		return err
+	}
+
+	// Comparing should not create secrets, like the generated handler does
+	opts.readOnly = "'sema diff'"
+	if _, _, err = opts.prepare(ctx, diffCommandInst); err != nil {
+		return err
+	}
+	current, err := opts.populate(ctx)
+	if err != nil {
+		return err
+	}
+
+	differences := diffSecretData(current, previous)
+	for _, d := range differences {
+		fmt.Println(d.String())
+	}
+	if len(differences) > 0 {
+		return differencesError{count: len(differences), against: opts.Against}
+	}
+	log.Printf("No differences with %q", opts.Against)
+	return nil
+}
+
+type secretDifference struct {
+	Key      string
+	Current  []byte // nil if removed
+	Previous []byte // nil if added
+}
+
+func (d secretDifference) String() string {
+	switch {
+	case d.Previous == nil:
+		return color.GreenString("+ %s (%s)", d.Key, describeValue(d.Current))
+	case d.Current == nil:
+		return color.RedString("- %s (%s)", d.Key, describeValue(d.Previous))
+	default:
+		return color.YellowString("~ %s (%s -> %s)", d.Key, describeValue(d.Previous), describeValue(d.Current))
+	}
+}
+
+// describeValue identifies a value without revealing it
+func describeValue(value []byte) string {
+	sum := sha256.Sum256(value)
+	return fmt.Sprintf("sha256:%s, %d bytes", hex.EncodeToString(sum[:])[0:8], len(value))
+}
+
+// diffSecretData lists the differences sorted by key
+func diffSecretData(current, previous map[string][]byte) (differences []secretDifference) {
+	keys := sortedKeys(current)
+	for key := range previous {
+		if _, isCurrent := current[key]; !isCurrent {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		cur, isCurrent := current[key]
+		prev, isPrevious := previous[key]
+		switch {
+		case !isPrevious:
+			differences = append(differences, secretDifference{Key: key, Current: nonNil(cur)})
+		case !isCurrent:
+			differences = append(differences, secretDifference{Key: key, Previous: nonNil(prev)})
+		case string(cur) != string(prev):
+			differences = append(differences, secretDifference{Key: key, Current: nonNil(cur), Previous: nonNil(prev)})
+		}
+	}
+	return differences
+}
+
+func nonNil(data []byte) []byte {
+	if data == nil {
+		return []byte{}
+	}
+	return data
+}
+
+// readSecretData reads the output of one of the render formats
+func readSecretData(location, format string) (map[string][]byte, error) {
+	if format == "" || format == "auto" {
+		format = detectSecretDataFormat(location)
+	}
+	switch format {
+	case "yaml":
+		var data []byte
+		var err error
+		if location == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(location)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return parseSecretYAMLData(data)
+	case "files":
+		return readSecretDir(location)
+	case "env":
+		env, err := godotenv.Read(location)
+		if err != nil {
+			return nil, err
+		}
+		result := make(map[string][]byte, len(env))
+		for k, v := range env {
+			result[k] = []byte(v)
+		}
+		return result, nil
+	default:
+		return nil, handlers.ConfigErrorf("Unknown format %q (use [yaml,files,env])", format)
+	}
+}
+
+func detectSecretDataFormat(location string) string {
+	if location == "-" {
+		return "yaml"
+	}
+	if stat, err := os.Stat(location); err == nil && stat.IsDir() {
+		return "files"
+	}
+	switch strings.ToLower(filepath.Ext(location)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "env"
+}
+
+// parseSecretYAMLData reads both the base64 'data' and the plaintext 'stringData' of a Kubernetes secret
+func parseSecretYAMLData(input []byte) (map[string][]byte, error) {
+	var secret struct {
+		Data       map[string]string `yaml:"data"`
+		StringData map[string]string `yaml:"stringData"`
+	}
+	if err := yaml.Unmarshal(input, &secret); err != nil {
+		return nil, errors.Wrap(err, "cannot parse Kubernetes secret")
+	}
+	result := make(map[string][]byte, len(secret.Data)+len(secret.StringData))
+	for k, v := range secret.Data {
+		decoded, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot decode key %q", k)
+		}
+		result[k] = decoded
+	}
+	for k, v := range secret.StringData {
+		result[k] = []byte(v)
+	}
+	return result, nil
+}
+
+func readSecretDir(directory string) (map[string][]byte, error) {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]byte, len(files))
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(directory, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		result[f.Name()] = data
+	}
+	return result, nil
+}
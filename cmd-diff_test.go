@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Q42/gcp-sema/pkg/handlers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffSecretData(t *testing.T) {
+	current := map[string][]byte{"same": []byte("a"), "changed": []byte("new"), "added": []byte("b")}
+	previous := map[string][]byte{"same": []byte("a"), "changed": []byte("old"), "removed": []byte("c")}
+
+	differences := diffSecretData(current, previous)
+	assert.Equal(t, []secretDifference{
+		{Key: "added", Current: []byte("b")},
+		{Key: "changed", Current: []byte("new"), Previous: []byte("old")},
+		{Key: "removed", Previous: []byte("c")},
+	}, differences)
+	assert.Empty(t, diffSecretData(current, current))
+}
+
+func TestDiffDoesNotPrintValues(t *testing.T) {
+	d := secretDifference{Key: "password", Current: []byte("hunter2"), Previous: []byte("hunter3")}
+	assert.NotContains(t, d.String(), "hunter")
+	assert.Contains(t, d.String(), "7 bytes")
+}
+
+func TestParseSecretYAMLData(t *testing.T) {
+	data, err := parseSecretYAMLData([]byte(`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: foo
+data:
+  foo.txt: YmFy
+stringData:
+  plain.txt: baz
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"foo.txt": []byte("bar"), "plain.txt": []byte("baz")}, data)
+
+	_, err = parseSecretYAMLData([]byte("data:\n  foo: '!!'\n"))
+	assert.Error(t, err)
+}
+
+func TestDiffExitCodes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "previous")
+	diff := func(format, against string) error {
+		assert.NoError(t, ioutil.WriteFile(file, []byte(against), 0600))
+		opts := &diffCommand{Against: file, AgainstFormat: format}
+		opts.MockSema = true
+		opts.Handlers = []handlers.ConcreteSecretHandler{{SecretHandler: makeSecretWrapper("literal", "foo", "bar")}}
+		return opts.Execute(nil)
+	}
+
+	assert.NoError(t, diff("env", "foo=bar\n"))
+	err := diff("env", "foo=baz\n")
+	assert.EqualError(t, err, fmt.Sprintf("1 difference(s) with %q", file))
+	assert.Equal(t, exitDifferences, exitCode(err))
+	err = diff("yaml", "data:\n  foo: '!!'\n")
+	assert.Error(t, err)
+	assert.NotEqual(t, exitDifferences, exitCode(err), "a failed diff is not a difference: %v", err)
+}
@@ -1,5 +1,7 @@
 package main
 
+import "context"
+
 func init() {
 	parser.AddCommand("dummy", "Testing only", "", &dummyCommand{})
 }
@@ -8,15 +10,23 @@ type dummyCommand struct{}
 
 // Execute runs the dummy command
 func (*dummyCommand) Execute(args []string) error {
-	client := prepareSemaClient("my-project")
+	client, err := prepareSemaClient("my-project")
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
 
 	// Dummy:
-	secrets, err := client.ListKeys()
-	panicIfErr(err)
+	secrets, err := client.ListKeys(ctx)
+	if err != nil {
+		return err
+	}
 	for _, secret := range secrets {
 		log.Println("Secret", secret)
-		value, err := secret.GetValue()
-		panicIfErr(err)
+		value, err := secret.GetValue(ctx)
+		if err != nil {
+			return err
+		}
 		log.Println("secret data length =", len(value))
 	}
 	return nil
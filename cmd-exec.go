@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/Q42/gcp-sema/pkg/handlers"
+	flags "github.com/jessevdk/go-flags"
+)
+
+var execCommandOpts = &execCommand{}
+var execCommandInst *flags.Command
+var execDescription = `Exec runs a process with the rendered secrets as environment variables, without writing them to disk.`
+var execDescriptionLong = execDescription + `
+
+Usage: sema exec [project] [render options] -- [command] [args...]
+
+Rendered keys take precedence over variables that are already set in the environment. Keys that are not valid variable
+names, like config-env.json, are skipped with a warning.
+SIGTERM and SIGHUP are forwarded to the process, Ctrl-C already reaches it through the terminal.
+sema exits with the exit code of the process.
+See 'render' help for more information on specifying secret sources.`
+
+// execCommand reuses the render pipeline, but passes the result to a child process
+type execCommand struct{ RenderCommand }
+
+func init() {
+	var err error
+	execCommandInst, err = parser.AddCommand("exec", execDescription, execDescriptionLong, execCommandOpts)
+	panicIfErr(err)
+}
+
+func (opts *execCommand) Execute(args []string) (err error) {
+	if len(args) == 0 {
+		return handlers.ConfigErrorf("Specify a command to run, like: sema exec my-project -- npm start")
+	}
+
+	data, err := opts.render()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = mergeEnvironment(os.Environ(), data)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	code, err := runProcess(cmd)
+	if err != nil {
+		return err
+	}
+	if code != exitOK {
+		os.Exit(code)
+	}
+	return nil
+}
+
+// runProcess runs cmd, forwarding signals to it, and returns its exit code like a shell: 128 + the signal if it was killed
+func runProcess(cmd *exec.Cmd) (int, error) {
+	// Forward signals: the child decides how to handle them.
+	// Ctrl-C and Ctrl-\ are sent to the whole process group by the terminal, so the child already has those.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+
+	if err := cmd.Start(); err != nil {
+		signal.Stop(signals)
+		return exitFailure, err
+	}
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGTERM || sig == syscall.SIGHUP {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	signal.Stop(signals)
+	close(signals)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	return exitOK, err
+}
+
+// render retrieves the secret data; --timeout and Ctrl-C only apply to this part, not to the child process
+func (opts *execCommand) render() (data map[string][]byte, err error) {
+	ctx, cancel := commandContext(opts.Timeout)
+	defer cancel()
+	defer recoverAborted(ctx, &err)
+
+	if _, _, err = opts.prepare(ctx, execCommandInst); err != nil {
+		return nil, err
+	}
+	return opts.populate(ctx)
+}
+
+// mergeEnvironment overrides the variables in environ (format: "KEY=value") with the secret data.
+// Keys that are not valid variable names, like "config-env.json" from a config file, are skipped with a warning.
+func mergeEnvironment(environ []string, data map[string][]byte) []string {
+	result := make([]string, 0, len(environ)+len(data))
+	for _, kv := range environ {
+		key := strings.SplitN(kv, "=", 2)[0]
+		if _, isOverridden := data[key]; !isOverridden {
+			result = append(result, kv)
+		}
+	}
+	for _, key := range sortedKeys(data) {
+		if !shellIdentifier.MatchString(key) {
+			log.Printf("Warning: skipping %q, it is not a valid environment variable name", key)
+			continue
+		}
+		result = append(result, fmt.Sprintf("%s=%s", key, data[key]))
+	}
+	return result
+}
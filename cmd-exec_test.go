@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeEnvironment(t *testing.T) {
+	env := mergeEnvironment([]string{"PATH=/bin", "SECRET=old", "EMPTY="}, map[string][]byte{
+		"SECRET":   []byte("new"),
+		"DB_PASS":  []byte("a=b"),
+		"MULTLINE": []byte("a\nb"),
+	})
+	assert.Equal(t, []string{"PATH=/bin", "EMPTY=", "DB_PASS=a=b", "MULTLINE=a\nb", "SECRET=new"}, env)
+}
+
+func TestMergeEnvironmentSkipsInvalidKeys(t *testing.T) {
+	for _, key := range []string{"config-env.json", "A=B", "1PASSWORD", ""} {
+		env := mergeEnvironment([]string{"PATH=/bin"}, map[string][]byte{"VALID": nil, key: []byte("value")})
+		assert.Equal(t, []string{"PATH=/bin", "VALID="}, env, key)
+	}
+}
+
+func TestRunProcessExitCode(t *testing.T) {
+	code, err := runProcess(exec.Command("sh", "-c", "exit 3"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, code)
+	code, err = runProcess(exec.Command("sh", "-c", "kill -KILL $$"))
+	assert.NoError(t, err)
+	assert.Equal(t, 128+int(syscall.SIGKILL), code, "like a shell")
+	_, err = runProcess(exec.Command("sema-test-missing-command"))
+	assert.Error(t, err)
+}
+
+func TestRunProcessForwardsSIGTERM(t *testing.T) {
+	cmd := exec.Command("sh", "-c", `trap "exit 42" TERM; echo ready; while true; do sleep 0.1; done`)
+	stdout, err := cmd.StdoutPipe()
+	assert.NoError(t, err)
+	done := make(chan int)
+	go func() {
+		code, err := runProcess(cmd)
+		assert.NoError(t, err)
+		done <- code
+	}()
+
+	// The child has its trap, and runProcess listens for signals before it starts the child
+	ready, _ := bufio.NewReader(stdout).ReadString('\n')
+	assert.Equal(t, "ready\n", ready)
+	self, err := os.FindProcess(os.Getpid())
+	assert.NoError(t, err)
+	assert.NoError(t, self.Signal(syscall.SIGTERM))
+	assert.Equal(t, 42, <-done, "the child handled the SIGTERM sent to sema")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager/fake"
+	"github.com/joho/godotenv"
+)
+
+var fakeServerDescription = `fake-server starts an in-memory Secret Manager API, use it with SEMA_ENDPOINT or --endpoint for the regular commands.`
+
+type fakeServerCommand struct {
+	Positional struct {
+		Project string `required:"yes" description:"Google Cloud project of the seeded secrets" positional-arg-name:"project"`
+	} `positional-args:"yes"`
+	Address string `long:"address" default:"127.0.0.1:8085" description:"Listen address, use port 0 for a free port"`
+	Seed    string `long:"seed" description:"Dot-env file with the initial secrets, like --offline"`
+}
+
+func init() {
+	_, err := parser.AddCommand("fake-server", fakeServerDescription, fakeServerDescription, &fakeServerCommand{})
+	panicIfErr(err)
+}
+
+func (opts *fakeServerCommand) Execute(args []string) error {
+	server := fake.New()
+	if opts.Seed != "" {
+		env, err := godotenv.Read(opts.Seed)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(env))
+		for name := range env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			server.Seed(opts.Positional.Project, name, nil, env[name])
+		}
+	}
+
+	endpoint, err := server.Listen(opts.Address)
+	if err != nil {
+		return err
+	}
+	defer server.Stop()
+	log.Printf("Fake Secret Manager listening, use: SEMA_ENDPOINT=%s sema render %s ...", endpoint, opts.Positional.Project)
+	// The address on stdout, so scripts can start it on port 0 and read the actual port
+	fmt.Println(endpoint)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	<-signals
+	return nil
+}
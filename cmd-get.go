@@ -2,7 +2,9 @@ package main
 
 import (
 	"os"
+	"time"
 
+	"github.com/Q42/gcp-sema/pkg/handlers"
 	"github.com/Q42/gcp-sema/pkg/secretmanager"
 )
 
@@ -12,28 +14,40 @@ func init() {
 
 type getCommandPositional struct {
 	Project string `required:"yes" description:"Google Cloud project" positional-arg-name:"project"`
-	Name    string `required:"yes" long:"name" description:"Name of secret key" positional-arg-name:"name"`
+	Name    string `required:"yes" long:"name" description:"Name of secret key, optionally with a version (example: mysecretkey@7)" positional-arg-name:"name"`
 }
 
 type getCommand struct {
 	Positional getCommandPositional `positional-args:"yes"`
+	Timeout    time.Duration        `long:"timeout" description:"Abort when Secret Manager has not responded within this duration (example: 30s)"`
 	// private
 	client secretmanager.KVClient
 }
 
 func (opts *getCommand) Execute(args []string) (err error) {
 	if opts.client == nil {
-		opts.client = prepareSemaClient(opts.Positional.Project)
+		if opts.client, err = prepareSemaClient(opts.Positional.Project); err != nil {
+			return err
+		}
 	}
 
-	secret, err := opts.client.Get(opts.Positional.Name)
+	ctx, cancel := commandContext(opts.Timeout)
+	defer cancel()
+
+	name, version := handlers.ParseSemaKey(opts.Positional.Name)
+	secret, err := opts.client.Get(ctx, name)
 	if err != nil {
-		return err
+		return abortedError(ctx, err)
 	}
 
-	value, err := secret.GetValue()
+	var value []byte
+	if version != "" {
+		value, err = secret.GetVersionValue(ctx, version)
+	} else {
+		value, err = secret.GetValue(ctx)
+	}
 	if err != nil {
-		return err
+		return abortedError(ctx, err)
 	}
 
 	os.Stdout.Write(value)
@@ -16,6 +16,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/Q42/gcp-sema/pkg/handlers"
 	"github.com/Q42/gcp-sema/pkg/schema"
 	"github.com/Q42/gcp-sema/pkg/secretmanager"
 	"github.com/fatih/color"
@@ -63,7 +64,10 @@ type migrateCommand struct {
 
 // Execute runs the migration command
 func (opts *migrateCommand) Execute(args []string) error {
-	client := prepareSemaClient(opts.getProject())
+	client, err := prepareSemaClient(opts.getProject())
+	if err != nil {
+		return err
+	}
 
 	var heading = color.New(color.Bold, color.Underline)
 	heading.Println("Migration")
@@ -76,7 +80,9 @@ func (opts *migrateCommand) Execute(args []string) error {
 	fmt.Println()
 
 	workingDir, err := os.Getwd()
-	panicIfErr(err)
+	if err != nil {
+		return err
+	}
 	path := workingDir
 	if opts.Dir != "" {
 		path = filepath.Join(path, opts.Dir)
@@ -92,13 +98,14 @@ func (opts *migrateCommand) Execute(args []string) error {
 		}
 	}
 	if len(schemas) < 1 {
-		color.Red("No config-schema.json in this directory")
-		os.Exit(1)
+		return handlers.ConfigErrorf("No config-schema.json in this directory")
 	}
 	schemaPath, _ := filepath.Rel(workingDir, schemas[0])
 
 	legacy, err := getLegacySecretConfiguration()
-	panicIfErr(err)
+	if err != nil {
+		return err
+	}
 	if opts.KubernetesSecretName == "" && legacy.Name != "" {
 		opts.KubernetesSecretName = legacy.Name
 	}
@@ -111,7 +118,9 @@ func (opts *migrateCommand) Execute(args []string) error {
 	if opts.KubernetesSecretCmd == "" {
 		if opts.KubernetesContext == "" {
 			opts.KubernetesContext, err = getCommandOutput("kubectl", "config", "current-context")
-			panicIfErr(err)
+			if err != nil {
+				return err
+			}
 		}
 		opts.KubernetesSecretCmd = fmt.Sprintf(`kubectl get secret "%s" -o="json" --context="%s"`, opts.KubernetesSecretName, opts.KubernetesContext)
 	}
@@ -129,13 +138,15 @@ func (opts *migrateCommand) Execute(args []string) error {
 `, opts.Positional.Project, opts.KubernetesContext, opts.KubernetesSecretName, opts.KubernetesSecretCmd, schemaPath, opts.Prefix, opts.Mode)
 
 	if !strings.HasPrefix(opts.KubernetesContext, "gke_"+opts.Positional.Project) {
-		color.Red("Cowardly refusing to migrate secret from cluster %q to GCP project %q.\nAre you sure this is the desired kubectl cluster context and project?\nYou can override the command (-c) if you really need to.", opts.KubernetesContext, opts.Positional.Project)
-		os.Exit(3)
+		return handlers.ConfigErrorf("Cowardly refusing to migrate secret from cluster %q to GCP project %q.\nAre you sure this is the desired kubectl cluster context and project?\nYou can override the command (-c) if you really need to.", opts.KubernetesContext, opts.Positional.Project)
 	}
 
 	// Get secret from Kubernetes
 	log.Println("$", opts.KubernetesSecretCmd)
-	k8sSecret := opts.getKubernetesSecret()
+	k8sSecret, err := opts.getKubernetesSecret()
+	if err != nil {
+		return err
+	}
 	log.Printf(`Found secret %q
   deployer: %q
   updated:  %q
@@ -179,13 +190,23 @@ func (opts *migrateCommand) Execute(args []string) error {
 			})
 			manualCommand.Secrets = append(manualCommand.Secrets, map[string]string{"path": secret.Name, "name": secret.Name, "type": "sema-literal", "semaKey": fmt.Sprintf("%s # This is the key in SeMa", semaName)})
 		}
-		actions = append(actions, manualCommand.actions()...)
+		manualActions, err := manualCommand.actions()
+		if err != nil {
+			return err
+		}
+		actions = append(actions, manualActions...)
 
 	case "multi":
 		// Get all secret names that are available
-		availableSecrets, err := client.ListKeys()
+		availableSecrets, err := client.ListKeys(context.Background())
+		if err != nil {
+			return err
+		}
 		availableSecretKeys := secretmanager.SecretShortNames(availableSecrets)
-		panicIfErr(err)
+		configSchema, err := schema.ParseSchemaFile(schemaPath)
+		if err != nil {
+			return err
+		}
 
 		// Legenda
 		log.Println("Legenda:")
@@ -197,7 +218,7 @@ func (opts *migrateCommand) Execute(args []string) error {
 		log.Println("Configuration parameters:")
 		// List all configuration options, including existing values in config-env.json
 		// and the suggested SecretManager keys and which of those are already set.
-		for idx, conf := range schema.ParseSchemaFile(schemaPath).FlatConfigurations {
+		for idx, conf := range configSchema.FlatConfigurations {
 			// print: 1: LOGLEVEL (format: [none,debug,info,warn,error], env: LOGLEVEL)
 			infos := make([]string, 0)
 			if conf.Format != nil {
@@ -265,9 +286,13 @@ func (opts *migrateCommand) Execute(args []string) error {
 				"schema": schemaPath,
 			}},
 		}
-		actions = append(actions, manualCommand.actions()...)
+		manualActions, err := manualCommand.actions()
+		if err != nil {
+			return err
+		}
+		actions = append(actions, manualActions...)
 	default:
-		log.Fatalf("Invalid mode %s", opts.Mode)
+		return handlers.ConfigErrorf("Invalid mode %s", opts.Mode)
 	}
 
 	heading.Println("Plan:")
@@ -280,12 +305,13 @@ func (opts *migrateCommand) Execute(args []string) error {
 		for _, action := range actions {
 			planStr += action.FormatCmd() + "\n"
 		}
-		ioutil.WriteFile(*opts.Plan, []byte(planStr), 0644)
+		if err := ioutil.WriteFile(*opts.Plan, []byte(planStr), 0644); err != nil {
+			return err
+		}
 		color.Blue("Generated plan %q", *opts.Plan)
-		os.Exit(0)
+		return nil
 	} else if prompt("Continue? [y/N] ") != "y" {
-		color.Red("Aborted")
-		os.Exit(127)
+		return errors.New("Aborted, nothing was changed")
 	}
 
 	for _, action := range actions {
@@ -310,14 +336,18 @@ type kubernetesSecret struct {
 	configEnvCache map[string]interface{}
 }
 
-func (opts *migrateCommand) getKubernetesSecret() *kubernetesSecret {
+func (opts *migrateCommand) getKubernetesSecret() (*kubernetesSecret, error) {
 	k8sSecretData, err := getCommandOutput("sh", "-c", opts.KubernetesSecretCmd)
-	panicIfErr(err)
+	if err != nil {
+		return nil, err
+	}
 
 	var k8sSecret kubernetesSecret
 	err = json.Unmarshal([]byte(k8sSecretData), &k8sSecret)
-	panicIfErr(err)
-	return &k8sSecret
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "cannot parse Kubernetes secret", 0)
+	}
+	return &k8sSecret, nil
 }
 
 func (s *kubernetesSecret) Lookup(conf schema.ConvictConfiguration) (interface{}, error) {
@@ -489,19 +519,25 @@ func secretsPullDirectoryFromPrefix(dir string) string {
 }
 
 // EditSuggestion outputs a sample how to update the .secrets-config.yml file
-func (conf *RenderConfigYAML) editSuggestion() string {
+func (conf *RenderConfigYAML) editSuggestion() (string, error) {
 	secretConfigYaml, err := yaml.Marshal(*conf)
-	panicIfErr(err)
-	return string(secretConfigYaml)
+	if err != nil {
+		return "", err
+	}
+	return string(secretConfigYaml), nil
 }
 
-func (conf *RenderConfigYAML) actions() []ProposedAction {
+func (conf *RenderConfigYAML) actions() ([]ProposedAction, error) {
+	suggestion, err := conf.editSuggestion()
+	if err != nil {
+		return nil, err
+	}
 	generatorCmd := "generators:\n- command: \"sema render $PROJECT\""
 	return []ProposedAction{manualAction{
-		Action: fmt.Sprintf("Manually update %s to include:\n%s", DefaultFileSecretsConfig, color.BlueString(conf.editSuggestion())),
-		Cmd:    fmt.Sprintf("echo 'update %s to include: '; cat <<EOF\n%s\nEOF", DefaultFileSecretsConfig, conf.editSuggestion()),
+		Action: fmt.Sprintf("Manually update %s to include:\n%s", DefaultFileSecretsConfig, color.BlueString(suggestion)),
+		Cmd:    fmt.Sprintf("echo 'update %s to include: '; cat <<EOF\n%s\nEOF", DefaultFileSecretsConfig, suggestion),
 	}, manualAction{
 		Action: fmt.Sprintf("Manually update deploy configuration to include:\n%s", color.BlueString(generatorCmd)),
 		Cmd:    fmt.Sprintf("echo 'update deploy configuration to include: '; cat <<EOF\n%s\nEOF", generatorCmd),
-	}}
+	}}, nil
 }
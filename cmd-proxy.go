@@ -1,16 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/Q42/gcp-sema/pkg/handlers"
 	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/Q42/gcp-sema/pkg/secretmanager/diskcache"
 	"github.com/Q42/gcp-sema/pkg/secretmanager/singleflight"
 	"github.com/pkg/errors"
 )
@@ -19,93 +31,227 @@ var proxyDescription = `proxy starts a server which can be used with SEMA_PROXY
 
 // proxyCommand defines the options
 type proxyCommand struct {
-	Address         string `long:"address" default:"127.0.0.1:8080" description:"Listen address. Do not expose this server publicly!"`
-	TLSCertFile     string `long:"cert" default:"" description:"If set, starts the server in secure TLS mode."`
-	TLSKeyFile      string `long:"key" default:"" description:"If set, starts the server in secure TLS mode."`
-	secretListCache map[string][]secretmanager.KVValue
-	secretDataCache map[string]func() chan GetValueResult
-
-	secretClients    map[string]secretmanager.KVClient
-	secretListCacheM sync.Mutex
-	secretDataCacheM sync.Mutex
-	secretClientsM   sync.Mutex
+	Address              string        `long:"address" default:"127.0.0.1:8080" description:"Listen address, or a Unix socket like unix:///run/sema.sock. Use --auth-config or --client-ca before exposing this server"`
+	SocketMode           string        `long:"socket-mode" default:"0600" description:"File mode of the Unix socket, to control which users can use the proxy"`
+	TLSCertFile          string        `long:"cert" default:"" description:"If set, starts the server in secure TLS mode."`
+	TLSKeyFile           string        `long:"key" default:"" description:"If set, starts the server in secure TLS mode."`
+	ListTTL              time.Duration `long:"list-ttl" default:"5m" description:"How long the list of secrets of a project is cached, 0 caches forever"`
+	ValueTTL             time.Duration `long:"value-ttl" default:"5m" description:"How long secret values are cached, 0 caches forever"`
+	StaleWhileRevalidate time.Duration `long:"stale-while-revalidate" default:"1m" description:"After the TTL, keep serving the cached data for this long while it is refreshed in the background"`
+	AdminToken           string        `long:"admin-token" env:"SEMA_PROXY_ADMIN_TOKEN" description:"Bearer token required for POST /invalidate, which is disabled if empty"`
+	AuthConfigFile       string        `long:"auth-config" description:"YAML file with the tokens and client certificate names that may use the proxy, and their allowed projects and secrets. See README"`
+	ClientCAFile         string        `long:"client-ca" description:"Require client certificates signed by this CA (PEM), requires --cert and --key. With --auth-config, clients may use a token instead"`
+	CacheDir             string        `long:"cache-dir" description:"Also keep an encrypted cache in this directory, using --list-ttl and --value-ttl (not 0), so a restarted proxy starts warm. The key is read from SEMA_CACHE_KEY"`
+	CacheKeyFile         string        `long:"cache-key-file" description:"Read the key of --cache-dir from this file instead of SEMA_CACHE_KEY"`
+	AllowWrites          bool          `long:"allow-writes" description:"Allow principals with 'write: true' in --auth-config to create secrets and set values and labels, requires --audit-log"`
+	AuditLogFile         string        `long:"audit-log" description:"Append a JSON line to this file for every write"`
+	ShutdownTimeout      time.Duration `long:"shutdown-timeout" default:"30s" description:"On SIGTERM or Ctrl-C, stop accepting connections and wait this long for the requests in progress"`
+	ReadTimeout          time.Duration `long:"read-timeout" default:"10s" description:"Maximum duration for reading a request"`
+	WriteTimeout         time.Duration `long:"write-timeout" default:"1m" description:"Maximum duration of a request, including retrieving the secrets"`
+	IdleTimeout          time.Duration `long:"idle-timeout" default:"2m" description:"How long idle keep-alive connections are kept open"`
+	BackendsFile         string        `long:"backends" description:"YAML file that routes projects to Secret Manager, a dot-env file or fixed values, for example to serve fixtures without Google Cloud access. See README"`
+	auth                 *proxyAuthConfig
+	backends             *proxyBackendConfig
+	audit                *jsonLines
+	accessLog            *jsonLines
+	cacheKey             []byte
+	metrics              *proxyMetrics
+	secretListCache      *proxyCache // by project
+	secretMetaCache      *proxyCache // by project/shortName
+	secretDataCache      *proxyCache // by proxyValueKey
+
+	secretClients  map[string]secretmanager.KVClient
+	diskCaches     map[string]*diskcache.Client // by project, with --cache-dir
+	secretClientsM sync.Mutex
+	draining       int32 // set on shutdown, atomic
+	ready          bool  // the credentials worked
+	readyM         sync.Mutex
 	// Testing
-	listener      net.Listener
-	prepareClient func(projectID string) secretmanager.KVClient
+	listener         net.Listener
+	prepareClient    func(projectID string) (secretmanager.KVClient, error)
+	checkCredentials func(ctx context.Context) error
+	signals          chan os.Signal
+	now              func() time.Time
 }
 
+const (
+	proxyBatchSize        = 100 // maximum number of values in a POST /batch request
+	proxyBatchConcurrency = 16  // values of a batch retrieved at the same time
+)
+
 func init() {
 	_, err := parser.AddCommand("proxy", proxyDescription, proxyDescription, &proxyCommand{})
 	panicIfErr(err)
 }
 
 func (opts *proxyCommand) Execute(args []string) (err error) {
-	opts.secretListCache = make(map[string][]secretmanager.KVValue)
-	opts.secretDataCache = make(map[string]func() chan GetValueResult)
-	opts.secretClients = make(map[string]secretmanager.KVClient)
-	if opts.prepareClient == nil {
-		opts.prepareClient = prepareSemaClient
+	if (opts.TLSKeyFile != "") != (opts.TLSCertFile != "") {
+		return handlers.ConfigErrorf("If either --cert or --key is set, you must specify both")
 	}
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/list", opts.list)
-	mux.HandleFunc("/get", opts.get)
-	if opts.TLSKeyFile != "" || opts.TLSCertFile != "" {
-		if opts.TLSKeyFile == "" || opts.TLSCertFile == "" {
-			return errors.New("If either --cert or --key is set, you must specify both")
+	if opts.ClientCAFile != "" && opts.TLSKeyFile == "" {
+		return handlers.ConfigErrorf("--client-ca requires --cert and --key")
+	}
+	if opts.AuthConfigFile != "" {
+		if opts.auth, err = loadProxyAuthConfig(opts.AuthConfigFile); err != nil {
+			return err
 		}
-		return http.ListenAndServeTLS(opts.Address, opts.TLSCertFile, opts.TLSKeyFile, mux)
 	}
-	log.Println("Starting insecure gcp-sema proxy server")
-	server := http.Server{
-		Addr:    opts.Address,
-		Handler: mux,
+	if opts.BackendsFile != "" {
+		if opts.backends, err = loadProxyBackendConfig(opts.BackendsFile); err != nil {
+			return err
+		}
+		for _, b := range opts.backends.Projects {
+			log.Printf("Project %s", b)
+		}
+		opts.prepareClient = opts.backends.client
+	}
+	if opts.AllowWrites {
+		if opts.auth == nil || opts.AuditLogFile == "" {
+			return handlers.ConfigErrorf("--allow-writes requires --auth-config and --audit-log, so every write is attributed")
+		}
+		file, err := os.OpenFile(opts.AuditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		opts.audit = &jsonLines{w: file}
+	}
+	if opts.CacheDir != "" {
+		if opts.ListTTL == 0 || opts.ValueTTL == 0 {
+			return handlers.ConfigErrorf("--cache-dir cannot cache forever, set --list-ttl and --value-ttl to a duration")
+		}
+		if opts.cacheKey, err = loadCacheKey(opts.CacheDir, opts.CacheKeyFile); err != nil {
+			return err
+		}
 	}
-	opts.listener, err = net.Listen("tcp", opts.Address)
+	tlsConfig, err := opts.tlsConfig()
 	if err != nil {
 		return err
 	}
-	return server.Serve(opts.listener)
+	server := http.Server{
+		Addr:              opts.Address,
+		Handler:           opts.handler(),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: opts.ReadTimeout,
+		ReadTimeout:       opts.ReadTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+		ErrorLog:          log,
+	}
+	if opts.listener == nil {
+		opts.listener, err = proxyListen(opts.Address, opts.SocketMode)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.auth == nil && opts.ClientCAFile == "" {
+		log.Println("Warning: the proxy has no authentication, use --auth-config or --client-ca. Do not expose this server publicly!")
+	}
+	return opts.serve(&server)
 }
 
-func (opts *proxyCommand) getClient(projectID string) secretmanager.KVClient {
-	opts.secretClientsM.Lock()
-	defer opts.secretClientsM.Unlock()
-
-	if c, exists := opts.secretClients[projectID]; exists {
-		return c
+// proxyListen listens on a TCP address, or on a Unix socket for addresses like "unix:///run/sema.sock".
+// A socket left behind by a previous proxy is replaced. Mode is octal, like "0660" (default: 0600).
+func proxyListen(address string, mode string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix://") {
+		return net.Listen("tcp", address)
+	}
+	fileMode, err := strconv.ParseUint(valueOrDefault(mode, "0600"), 8, 32)
+	if err != nil {
+		return nil, handlers.ConfigErrorf("Invalid --socket-mode %q, use an octal mode like 0660", mode)
 	}
-	client := singleflight.New(opts.prepareClient(projectID))
-	opts.secretClients[projectID] = client
-	return client
+	socket := strings.TrimPrefix(address, "unix://")
+	if info, err := os.Stat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+	return listenUnix(socket, os.FileMode(fileMode))
 }
 
-func (opts *proxyCommand) getListSafe(projectID string) (keys []secretmanager.KVValue, hit bool, err error) {
-	client := opts.getClient(projectID)
+// handler initializes the caches and clients and routes the requests
+func (opts *proxyCommand) handler() http.Handler {
+	if opts.now == nil {
+		opts.now = time.Now
+	}
+	opts.secretListCache = newProxyCache(opts.ListTTL, opts.StaleWhileRevalidate, opts.now)
+	opts.secretMetaCache = newProxyCache(opts.ListTTL, opts.StaleWhileRevalidate, opts.now)
+	opts.secretDataCache = newProxyCache(opts.ValueTTL, opts.StaleWhileRevalidate, opts.now)
+	opts.secretClients = make(map[string]secretmanager.KVClient)
+	opts.diskCaches = make(map[string]*diskcache.Client)
+	opts.metrics = newProxyMetrics()
+	if opts.prepareClient == nil {
+		opts.prepareClient = prepareSemaClient
+	}
+	if opts.checkCredentials == nil {
+		opts.checkCredentials = opts.checkGoogleCredentials
+	}
+	if opts.accessLog == nil {
+		opts.accessLog = &jsonLines{w: os.Stderr}
+	}
 
-	opts.secretListCacheM.Lock()
-	defer opts.secretListCacheM.Unlock()
+	mux := http.NewServeMux()
+	handle := func(endpoint string, handler http.HandlerFunc) {
+		mux.HandleFunc(endpoint, opts.accessLogged(opts.metrics.instrument(endpoint, handler)))
+	}
+	handle("/list", opts.authenticated(opts.list))
+	handle("/secret", opts.authenticated(opts.secret))
+	handle("/get", opts.authenticated(opts.get))
+	handle("/versions", opts.authenticated(opts.versions))
+	handle("/batch", opts.authenticated(opts.batch))
+	handle("/new", opts.authenticated(opts.newSecret))
+	handle("/set-value", opts.authenticated(opts.setValue))
+	handle("/set-labels", opts.authenticated(opts.setLabels))
+	handle("/invalidate", opts.invalidate)
+	// The cached entries per project are only shown to clients that may use the proxy
+	mux.HandleFunc("/metrics", opts.authenticated(opts.metricsHandler))
+	mux.HandleFunc("/healthz", opts.healthz)
+	mux.HandleFunc("/readyz", opts.readyz)
+	return mux
+}
 
-	if listKeys, exists := opts.secretListCache[projectID]; exists {
-		hit = true
-		keys = listKeys
-	} else {
-		hit = false
-		keys, err = client.ListKeys()
+func (opts *proxyCommand) getClient(projectID string) (secretmanager.KVClient, error) {
+	opts.secretClientsM.Lock()
+	defer opts.secretClientsM.Unlock()
+
+	if c, exists := opts.secretClients[projectID]; exists {
+		return c, nil
+	}
+	client, err := opts.prepareClient(projectID)
+	if err != nil {
+		return nil, err
+	}
+	client = metricsClient{KVClient: client, metrics: opts.metrics}
+	if opts.CacheDir != "" {
+		cache, err := prepareDiskCache(client, projectID, diskcache.Options{Dir: opts.CacheDir, Key: opts.cacheKey, ListTTL: opts.ListTTL, ValueTTL: opts.ValueTTL})
 		if err != nil {
-			return nil, false, err
+			return nil, err
 		}
-		opts.secretListCache[projectID] = keys
+		opts.diskCaches[projectID] = cache
+		client = cache
 	}
-	return keys, hit, err
+	opts.secretClients[projectID] = singleflight.New(client)
+	return opts.secretClients[projectID], nil
 }
 
-func (opts *proxyCommand) getCachedSingleSafe(projectID string, shortName string) (k secretmanager.KVValue, hit bool) {
-	opts.secretListCacheM.Lock()
-	defer opts.secretListCacheM.Unlock()
+func (opts *proxyCommand) getListSafe(ctx context.Context, projectID string) (keys []secretmanager.KVValue, age time.Duration, hit bool, err error) {
+	client, err := opts.getClient(projectID)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	value, age, hit, err := opts.secretListCache.get(projectID, func() (interface{}, error) {
+		// Not bound to a request context: the result is shared by all waiting requests
+		return client.ListKeys(context.Background())
+	})
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return value.([]secretmanager.KVValue), age, hit, nil
+}
 
-	if listCache, exists := opts.secretListCache[projectID]; exists {
-		for _, existingSecret := range listCache {
+func (opts *proxyCommand) getCachedSingleSafe(projectID string, shortName string) (k secretmanager.KVValue, hit bool) {
+	if listCache, exists := opts.secretListCache.peek(projectID); exists {
+		for _, existingSecret := range listCache.([]secretmanager.KVValue) {
 			if existingSecret.GetShortName() == shortName {
 				k = existingSecret
 			}
@@ -114,70 +260,51 @@ func (opts *proxyCommand) getCachedSingleSafe(projectID string, shortName string
 	return k, k != nil
 }
 
-type GetValueResult struct {
-	data []byte
-	err  error
-}
-
-func (opts *proxyCommand) getValueSafe(projectID string, k secretmanager.KVValue) (data []byte, hit bool, err error) {
-	opts.secretDataCacheM.Lock()
-	d, exists := opts.secretDataCache[k.GetFullName()]
-	if exists {
-		opts.secretDataCacheM.Unlock()
-		hit = true
-	} else {
-		hit = false
-		var loaded bool
-		var cache []byte
-		var err error
-		start := make(chan struct{}, 1)
-		done := make(chan GetValueResult)
-		go func() {
-			for {
-				<-start
-				if loaded {
-					done <- GetValueResult{cache, err}
-					continue
-				}
-				cache, err = k.GetValue()
-				loaded = err == nil
-				done <- GetValueResult{cache, err}
-			}
-		}()
-		d = func() chan GetValueResult {
-			start <- struct{}{}
-			return done
+// proxyValueKey is the key of the secretDataCache, the project and short name prefixes are used to invalidate
+func proxyValueKey(projectID, shortName, version string) string {
+	return fmt.Sprintf("%s/%s@%s", projectID, shortName, version)
+}
+
+// getValueSafe gets the latest value, or a specific version if version is not empty
+func (opts *proxyCommand) getValueSafe(projectID string, k secretmanager.KVValue, version string) (data []byte, age time.Duration, hit bool, err error) {
+	value, age, hit, err := opts.secretDataCache.get(proxyValueKey(projectID, k.GetShortName(), version), func() (interface{}, error) {
+		// Not bound to a request context: the result is shared by all waiting requests
+		if version != "" {
+			return k.GetVersionValue(context.Background(), version)
 		}
-		opts.secretDataCache[k.GetFullName()] = d
-		opts.secretDataCacheM.Unlock()
+		return k.GetValue(context.Background())
+	})
+	if err != nil {
+		return nil, 0, false, err
 	}
+	return value.([]byte), age, hit, nil
+}
 
-	result := <-d()
-	return result.data, hit, result.err
+// setCacheHeaders reports whether the response is cached and how old it is, in seconds
+func setCacheHeaders(rw http.ResponseWriter, age time.Duration, hit bool) {
+	rw.Header().Add("Cache-Hit", strconv.FormatBool(hit))
+	rw.Header().Add("Cache-Age", strconv.Itoa(int(age.Seconds())))
 }
 
-func (opts *proxyCommand) list(rw http.ResponseWriter, r *http.Request) {
+func (opts *proxyCommand) list(rw http.ResponseWriter, r *http.Request, principal *proxyPrincipal) {
 	projectID := r.URL.Query().Get("project")
-	log.Printf("Retrieving from %s", projectID)
-	var err error
-
-	// Get keys in project
-
-	keys, hit, err := opts.getListSafe(projectID)
-	if err != nil {
-		log.Println(err)
-		http.Error(rw, err.Error(), 500)
+	if !principal.allowsProject(projectID) {
+		http.Error(rw, fmt.Sprintf("%s may not read project %q", principal.Name, projectID), http.StatusForbidden)
 		return
 	}
-	if hit {
-		rw.Header().Add("Cache-Hit", "true")
-	} else {
-		rw.Header().Add("Cache-Hit", "false")
+	keys, age, hit, err := opts.getListSafe(r.Context(), projectID)
+	if err != nil {
+		proxyError(rw, err)
+		return
 	}
+	setCacheHeaders(rw, age, hit)
+	opts.metrics.cacheResult("list", hit)
 
-	log.Printf("Retrieved %d keys from %s", len(keys), projectID)
 	list := proxyListing{}
 	for _, k := range keys {
+		if !principal.allows(projectID, k.GetShortName()) {
+			continue
+		}
 		list.Secrets = append(list.Secrets, proxySecret{
 			FullName:  k.GetFullName(),
 			ShortName: k.GetShortName(),
@@ -187,7 +314,6 @@ func (opts *proxyCommand) list(rw http.ResponseWriter, r *http.Request) {
 
 	data, err := json.Marshal(&list)
 	if err != nil {
-		log.Println(err)
 		http.Error(rw, err.Error(), 500)
 		return
 	}
@@ -196,38 +322,31 @@ func (opts *proxyCommand) list(rw http.ResponseWriter, r *http.Request) {
 	rw.Write(data)
 }
 
-func (opts *proxyCommand) get(rw http.ResponseWriter, r *http.Request) {
+func (opts *proxyCommand) get(rw http.ResponseWriter, r *http.Request, principal *proxyPrincipal) {
 	projectID := r.URL.Query().Get("project")
 	shortName := r.URL.Query().Get("shortName")
-	fullName := r.URL.Query().Get("fullName")
+	version := r.URL.Query().Get("version")
+	if !principal.allows(projectID, shortName) {
+		http.Error(rw, fmt.Sprintf("%s may not read %q of project %q", principal.Name, shortName, projectID), http.StatusForbidden)
+		return
+	}
 
 	// Get secret
-	var err error
-	k, _ := opts.getCachedSingleSafe(projectID, shortName)
-	if k == nil {
-		client := opts.getClient(projectID)
-		k, err = client.Get(shortName)
-		if err != nil {
-			log.Println(err)
-			http.Error(rw, err.Error(), 500)
-			return
-		}
+	k, err := opts.getSecretSafe(projectID, shortName)
+	if err != nil {
+		proxyError(rw, err)
+		return
 	}
 
 	// Get the secret data payload
-	data, hit, err := opts.getValueSafe(projectID, k)
+	data, age, hit, err := opts.getValueSafe(projectID, k, version)
 	if err != nil {
-		log.Println(err)
-		http.Error(rw, err.Error(), 500)
+		proxyError(rw, err)
 		return
 	}
-	if hit {
-		rw.Header().Add("Cache-Hit", "true")
-	} else {
-		rw.Header().Add("Cache-Hit", "false")
-	}
+	setCacheHeaders(rw, age, hit)
+	opts.metrics.cacheResult("value", hit)
 
-	log.Printf("Sending %s", fullName)
 	jsonData, err := json.Marshal(proxySecretDetail{
 		ProxySecret: proxySecret{
 			ShortName: k.GetShortName(),
@@ -245,17 +364,292 @@ func (opts *proxyCommand) get(rw http.ResponseWriter, r *http.Request) {
 	rw.Write(jsonData)
 }
 
-// NewProxyClient can be used instead of a regular Secret Manager client. It uses the proxy server.
-func NewProxyClient(proxyAddr string, project string) secretmanager.KVClient {
-	return proxyClient{proxyAddr: proxyAddr, project: project, secret: nil}
+// secret returns the metadata of a single secret, so a client does not need the whole listing.
+// Name is the short name or the full name of the secret.
+func (opts *proxyCommand) secret(rw http.ResponseWriter, r *http.Request, principal *proxyPrincipal) {
+	projectID := r.URL.Query().Get("project")
+	name := r.URL.Query().Get("name")
+	shortName := name[strings.LastIndex(name, "/")+1:]
+	if !principal.allows(projectID, shortName) {
+		http.Error(rw, fmt.Sprintf("%s may not read %q of project %q", principal.Name, shortName, projectID), http.StatusForbidden)
+		return
+	}
+
+	k, err := opts.getSecretSafe(projectID, shortName)
+	if err != nil {
+		proxyError(rw, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(proxySecret{
+		ShortName: k.GetShortName(),
+		FullName:  k.GetFullName(),
+		Labels:    k.GetLabels(),
+	})
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	rw.WriteHeader(200)
+	rw.Write(jsonData)
+}
+
+// proxyError responds with 404 if the secret or version does not exist, so clients can recognize it
+func proxyError(rw http.ResponseWriter, err error) {
+	http.Error(rw, err.Error(), proxyErrorCode(err))
+}
+
+func proxyErrorCode(err error) int {
+	switch {
+	case secretmanager.IsNotFound(err):
+		return http.StatusNotFound
+	case secretmanager.IsAlreadyExists(err):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// batch returns the values of many secrets of a project in a single response, retrieved concurrently.
+// Every value has its own status code, a missing or forbidden secret does not fail the others.
+func (opts *proxyCommand) batch(rw http.ResponseWriter, r *http.Request, principal *proxyPrincipal) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "Use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	projectID := r.URL.Query().Get("project")
+	request := proxyBatchRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, 1<<20)).Decode(&request); err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid batch: %s", err), http.StatusBadRequest)
+		return
+	}
+	if len(request.Secrets) > proxyBatchSize {
+		http.Error(rw, fmt.Sprintf("Too many secrets in batch, the maximum is %d", proxyBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	response := proxyBatchResponse{Values: make([]proxyBatchValue, len(request.Secrets))}
+	semaphore := make(chan struct{}, proxyBatchConcurrency)
+	wg := sync.WaitGroup{}
+	for i := range request.Secrets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			response.Values[i] = opts.batchValue(projectID, request.Secrets[i], principal)
+		}(i)
+	}
+	wg.Wait()
+	failed := 0
+	for _, value := range response.Values {
+		if value.StatusCode != http.StatusOK {
+			failed++
+		}
+	}
+	if failed > 0 {
+		requestInfo(r).err = fmt.Sprintf("%d of %d values failed", failed, len(response.Values))
+	}
+
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	rw.WriteHeader(200)
+	rw.Write(jsonData)
+}
+
+func (opts *proxyCommand) batchValue(projectID string, item proxyBatchItem, principal *proxyPrincipal) proxyBatchValue {
+	shortName := item.FullName[strings.LastIndex(item.FullName, "/")+1:]
+	if !principal.allows(projectID, shortName) {
+		return proxyBatchValue{StatusCode: http.StatusForbidden, Error: fmt.Sprintf("%s may not read %q of project %q", principal.Name, shortName, projectID)}
+	}
+	k, err := opts.getSecretSafe(projectID, shortName)
+	if err != nil {
+		return proxyBatchValue{StatusCode: proxyErrorCode(err), Error: err.Error()}
+	}
+	data, _, hit, err := opts.getValueSafe(projectID, k, item.Version)
+	if err != nil {
+		return proxyBatchValue{StatusCode: proxyErrorCode(err), Error: err.Error()}
+	}
+	opts.metrics.cacheResult("value", hit)
+	return proxyBatchValue{StatusCode: http.StatusOK, Data: base64.RawStdEncoding.EncodeToString(data)}
+}
+
+// versions is not cached: it is used to pin or inspect versions, which should reflect the current state
+func (opts *proxyCommand) versions(rw http.ResponseWriter, r *http.Request, principal *proxyPrincipal) {
+	projectID := r.URL.Query().Get("project")
+	shortName := r.URL.Query().Get("shortName")
+	if !principal.allows(projectID, shortName) {
+		http.Error(rw, fmt.Sprintf("%s may not read %q of project %q", principal.Name, shortName, projectID), http.StatusForbidden)
+		return
+	}
+
+	k, err := opts.getSecretSafe(projectID, shortName)
+	if err != nil {
+		proxyError(rw, err)
+		return
+	}
+	versions, err := k.ListVersions(r.Context())
+	if err != nil {
+		proxyError(rw, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(proxyVersionListing{Versions: versions})
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	rw.WriteHeader(200)
+	rw.Write(jsonData)
+}
+
+// metricsHandler exposes the metrics in the Prometheus text format
+func (opts *proxyCommand) metricsHandler(rw http.ResponseWriter, r *http.Request, _ *proxyPrincipal) {
+	projectOf := func(key string) string { return strings.SplitN(key, "/", 2)[0] }
+	entries := make(map[[2]string]int)
+	for project, count := range opts.secretListCache.count(projectOf) {
+		entries[[2]string{project, "list"}] = count
+	}
+	for project, count := range opts.secretMetaCache.count(projectOf) {
+		entries[[2]string{project, "secret"}] = count
+	}
+	for project, count := range opts.secretDataCache.count(projectOf) {
+		entries[[2]string{project, "value"}] = count
+	}
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	opts.metrics.write(rw, entries)
+}
+
+// invalidate removes the cached list and values of a project, or of a single secret if shortName is set
+func (opts *proxyCommand) invalidate(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "Use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if opts.AdminToken == "" {
+		http.Error(rw, "Invalidation is disabled, start the proxy with --admin-token", http.StatusForbidden)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(opts.AdminToken)) != 1 {
+		http.Error(rw, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	projectID := r.URL.Query().Get("project")
+	shortName := r.URL.Query().Get("shortName")
+	if projectID == "" {
+		http.Error(rw, "Missing project", http.StatusBadRequest)
+		return
+	}
+
+	count := opts.invalidateSecret(projectID, shortName)
+	jsonData, err := json.Marshal(proxyInvalidation{Invalidated: count})
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	rw.WriteHeader(200)
+	rw.Write(jsonData)
+}
+
+// invalidateSecret removes the cached list and values of a project, or of a single secret if shortName is set,
+// from memory and from --cache-dir. The list is always removed, because the secret might be new.
+func (opts *proxyCommand) invalidateSecret(projectID, shortName string) int {
+	prefix := projectID + "/"
+	if shortName != "" {
+		prefix = proxyValueKey(projectID, shortName, "")
+	}
+	count := opts.secretListCache.invalidate(func(key string) bool { return key == projectID })
+	count += opts.secretMetaCache.invalidate(func(key string) bool {
+		return key == projectID+"/"+shortName || (shortName == "" && strings.HasPrefix(key, prefix))
+	})
+	count += opts.secretDataCache.invalidate(func(key string) bool { return strings.HasPrefix(key, prefix) })
+
+	opts.secretClientsM.Lock()
+	cache := opts.diskCaches[projectID]
+	opts.secretClientsM.Unlock()
+	if cache != nil && shortName != "" {
+		cache.Forget(shortName)
+	} else if cache != nil {
+		cache.ForgetProject()
+	}
+	return count
+}
+
+// getSecretSafe prefers the cached listing over retrieving the secret, which is cached using --list-ttl as well
+func (opts *proxyCommand) getSecretSafe(projectID string, shortName string) (secretmanager.KVValue, error) {
+	if k, hit := opts.getCachedSingleSafe(projectID, shortName); hit {
+		opts.metrics.cacheResult("secret", true)
+		return k, nil
+	}
+	client, err := opts.getClient(projectID)
+	if err != nil {
+		return nil, err
+	}
+	value, _, hit, err := opts.secretMetaCache.get(projectID+"/"+shortName, func() (interface{}, error) {
+		// Not bound to a request context: the result is shared by all waiting requests
+		return client.Get(context.Background(), shortName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	opts.metrics.cacheResult("secret", hit)
+	return value.(secretmanager.KVValue), nil
+}
+
+// NewProxyClient can be used instead of a regular Secret Manager client. It uses the proxy server,
+// proxyAddr is a URL like "http://127.0.0.1:8080" or a Unix socket like "unix:///run/sema.sock".
+// The credentials are read from the environment: SEMA_PROXY_TOKEN is sent as bearer token,
+// SEMA_PROXY_CERT and SEMA_PROXY_KEY are the client certificate and SEMA_PROXY_CA verifies the proxy.
+func NewProxyClient(proxyAddr string, project string) (secretmanager.KVClient, error) {
+	tlsConfig := &tls.Config{}
+	if certFile, keyFile := os.Getenv("SEMA_PROXY_CERT"), os.Getenv("SEMA_PROXY_KEY"); certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, credentialsError{errors.Wrap(err, "SEMA_PROXY_CERT/SEMA_PROXY_KEY")}
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile := os.Getenv("SEMA_PROXY_CA"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, credentialsError{errors.Wrap(err, "SEMA_PROXY_CA")}
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, handlers.ConfigErrorf("No certificates found in SEMA_PROXY_CA %s", caFile)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if strings.HasPrefix(proxyAddr, "unix://") {
+		socket := strings.TrimPrefix(proxyAddr, "unix://")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		}
+		// The host is ignored, all requests are sent over the socket
+		proxyAddr = "http://unix"
+	}
+	return proxyClient{
+		proxyAddr: proxyAddr,
+		project:   project,
+		http:      &http.Client{Transport: transport},
+		token:     os.Getenv("SEMA_PROXY_TOKEN"),
+	}, nil
 }
 
 type proxyClient struct {
 	proxyAddr string
 	project   string
 	secret    *proxySecret
+	http      *http.Client
+	token     string
 }
 
+var _ secretmanager.KVBatchClient = proxyClient{}
+
 type proxyListing struct {
 	Secrets []proxySecret
 }
@@ -266,53 +660,176 @@ type proxySecret struct {
 	Labels    map[string]string
 }
 
+type proxyVersionListing struct {
+	Versions []secretmanager.KVVersion
+}
+
+type proxyInvalidation struct {
+	Invalidated int
+}
+
 type proxySecretDetail struct {
 	ProxySecret proxySecret
 	Data        string
 }
 
-func (c proxyClient) ListKeys() (result []secretmanager.KVValue, err error) {
+type proxyWrite struct {
+	Labels map[string]string `json:",omitempty"`
+	Data   string            `json:",omitempty"` // base64
+}
+
+type proxyWriteResult struct {
+	Version string
+}
+
+type proxyBatchRequest struct {
+	Secrets []proxyBatchItem
+}
+
+type proxyBatchItem struct {
+	FullName string
+	Version  string // empty means latest
+}
+
+type proxyBatchResponse struct {
+	Values []proxyBatchValue // in the order of the request
+}
+
+type proxyBatchValue struct {
+	StatusCode int
+	Data       string `json:",omitempty"`
+	Error      string `json:",omitempty"`
+}
+
+func (c proxyClient) ListKeys(ctx context.Context) (result []secretmanager.KVValue, err error) {
 	list := proxyListing{}
-	err = jsonReq(fmt.Sprintf("%s/list?project=%s", c.proxyAddr, url.QueryEscape(c.project)), &list)
+	err = c.jsonReq(ctx, fmt.Sprintf("%s/list?project=%s", c.proxyAddr, url.QueryEscape(c.project)), &list)
 	if err != nil {
 		return nil, errors.Wrap(err, "proxy/list failed")
 	}
 	for _, s := range list.Secrets {
 		var copied = s // new assignment
-		result = append(result, proxyClient{c.proxyAddr, c.project, &copied})
+		secret := c
+		secret.secret = &copied
+		result = append(result, secret)
 	}
 	return result, nil
 }
 
-func (c proxyClient) Get(name string) (secretmanager.KVValue, error) {
-	keys, err := c.ListKeys()
+// Get only retrieves the metadata of the secret. If it does not exist, secretmanager.IsNotFound reports true.
+func (c proxyClient) Get(ctx context.Context, name string) (secretmanager.KVValue, error) {
+	secret := proxySecret{}
+	err := c.jsonReq(ctx, fmt.Sprintf("%s/secret?project=%s&name=%s", c.proxyAddr,
+		url.QueryEscape(c.project),
+		url.QueryEscape(name),
+	), &secret)
 	if err != nil {
-		return nil, errors.Wrap(err, "proxy/get failed")
+		return nil, errors.Wrap(err, "proxy/secret failed")
 	}
-	for _, k := range keys {
-		if k.GetShortName() == name || k.GetFullName() == name {
-			return k, nil
+	result := c
+	result.secret = &secret
+	return result, nil
+}
+
+// GetValues retrieves the values using POST /batch, which is used when render prefetches the values
+func (c proxyClient) GetValues(ctx context.Context, requests []secretmanager.KVValueRequest) []secretmanager.KVValueResult {
+	results := make([]secretmanager.KVValueResult, 0, len(requests))
+	for start := 0; start < len(requests); start += proxyBatchSize {
+		end := start + proxyBatchSize
+		if end > len(requests) {
+			end = len(requests)
 		}
+		results = append(results, c.getBatch(ctx, requests[start:end])...)
 	}
-	return nil, fmt.Errorf("secret not found %q", name)
+	return results
 }
 
-func (c proxyClient) New(name string, labels map[string]string) (secretmanager.KVValue, error) {
-	return nil, errors.New("Proxy is a read-only implementation. Do not use --proxy to make edits")
+func (c proxyClient) getBatch(ctx context.Context, requests []secretmanager.KVValueRequest) []secretmanager.KVValueResult {
+	results := make([]secretmanager.KVValueResult, len(requests))
+	batch := proxyBatchRequest{Secrets: make([]proxyBatchItem, len(requests))}
+	for i, r := range requests {
+		batch.Secrets[i] = proxyBatchItem{FullName: r.Secret.GetFullName(), Version: r.Version}
+	}
+	body, err := json.Marshal(batch)
+	response := proxyBatchResponse{}
+	if err == nil {
+		err = c.do(ctx, http.MethodPost, fmt.Sprintf("%s/batch?project=%s", c.proxyAddr, url.QueryEscape(c.project)), body, &response)
+	}
+	if err == nil && len(response.Values) != len(requests) {
+		err = fmt.Errorf("expected %d values, got %d", len(requests), len(response.Values))
+	}
+	if err != nil {
+		for i := range results {
+			results[i].Err = errors.Wrap(err, "proxy/batch failed")
+		}
+		return results
+	}
+	for i, value := range response.Values {
+		if value.StatusCode != http.StatusOK {
+			results[i].Err = errors.Wrap(proxyStatusError{StatusCode: value.StatusCode, Message: value.Error}, "proxy/batch failed")
+			continue
+		}
+		results[i].Data, err = base64.RawStdEncoding.DecodeString(value.Data)
+		if err != nil {
+			results[i].Err = errors.Wrap(err, "proxy base64 failed")
+		}
+	}
+	return results
 }
 
-func (c proxyClient) GetFullName() string                      { return c.secret.FullName }
-func (c proxyClient) GetShortName() string                     { return c.secret.ShortName }
-func (c proxyClient) GetLabels() map[string]string             { return c.secret.Labels }
-func (c proxyClient) SetLabels(labels map[string]string) error { return errors.New("Readonly") }
-func (c proxyClient) SetValue([]byte) (string, error)          { return "", errors.New("Readonly") }
+// New creates a secret, if the proxy allows writes
+func (c proxyClient) New(ctx context.Context, name string, labels map[string]string) (secretmanager.KVValue, error) {
+	secret := proxySecret{}
+	if err := c.write(ctx, "new", name, proxyWrite{Labels: labels}, &secret); err != nil {
+		return nil, err
+	}
+	result := c
+	result.secret = &secret
+	return result, nil
+}
 
-func (c proxyClient) GetValue() ([]byte, error) {
+func (c proxyClient) GetFullName() string          { return c.secret.FullName }
+func (c proxyClient) GetShortName() string         { return c.secret.ShortName }
+func (c proxyClient) GetLabels() map[string]string { return c.secret.Labels }
+func (c proxyClient) SetLabels(ctx context.Context, labels map[string]string) error {
+	secret := proxySecret{}
+	if err := c.write(ctx, "set-labels", c.secret.ShortName, proxyWrite{Labels: labels}, &secret); err != nil {
+		return err
+	}
+	c.secret.Labels = secret.Labels
+	return nil
+}
+func (c proxyClient) SetValue(ctx context.Context, data []byte) (string, error) {
+	result := proxyWriteResult{}
+	err := c.write(ctx, "set-value", c.secret.ShortName, proxyWrite{Data: base64.RawStdEncoding.EncodeToString(data)}, &result)
+	return result.Version, err
+}
+
+// write posts to a write endpoint of the proxy, which has to be started with --allow-writes
+func (c proxyClient) write(ctx context.Context, endpoint string, shortName string, body proxyWrite, dst interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	err = c.do(ctx, http.MethodPost, fmt.Sprintf("%s/%s?project=%s&shortName=%s", c.proxyAddr, endpoint,
+		url.QueryEscape(c.project),
+		url.QueryEscape(shortName),
+	), data, dst)
+	return errors.Wrapf(err, "proxy/%s failed", endpoint)
+}
+
+func (c proxyClient) GetValue(ctx context.Context) ([]byte, error) {
+	return c.GetVersionValue(ctx, "")
+}
+
+// GetVersionValue gets the latest value if version is empty
+func (c proxyClient) GetVersionValue(ctx context.Context, version string) ([]byte, error) {
 	detail := proxySecretDetail{}
-	err := jsonReq(fmt.Sprintf("%s/get?project=%s&shortName=%s&fullName=%s", c.proxyAddr,
+	err := c.jsonReq(ctx, fmt.Sprintf("%s/get?project=%s&shortName=%s&fullName=%s&version=%s", c.proxyAddr,
 		url.QueryEscape(c.project),
 		url.QueryEscape(c.secret.ShortName),
 		url.QueryEscape(c.secret.FullName),
+		url.QueryEscape(version),
 	), &detail)
 	if err != nil {
 		return nil, errors.Wrap(err, "proxy/get failed")
@@ -324,21 +841,68 @@ func (c proxyClient) GetValue() ([]byte, error) {
 	return data, nil
 }
 
-func jsonReq(url string, dst interface{}) error {
-	resp, err := http.Get(url)
+func (c proxyClient) ListVersions(ctx context.Context) ([]secretmanager.KVVersion, error) {
+	list := proxyVersionListing{}
+	err := c.jsonReq(ctx, fmt.Sprintf("%s/versions?project=%s&shortName=%s", c.proxyAddr,
+		url.QueryEscape(c.project),
+		url.QueryEscape(c.secret.ShortName),
+	), &list)
+	if err != nil {
+		return nil, errors.Wrap(err, "proxy/versions failed")
+	}
+	return list.Versions, nil
+}
+
+// proxyStatusError is a response of the proxy that is not OK
+type proxyStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e proxyStatusError) Error() string {
+	return fmt.Sprintf("request status not ok: %d %s", e.StatusCode, e.Message)
+}
+
+// Is makes secretmanager.IsNotFound recognize a 404 of the proxy
+func (e proxyStatusError) Is(target error) bool {
+	return target == secretmanager.ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+func (c proxyClient) jsonReq(ctx context.Context, url string, dst interface{}) error {
+	return c.do(ctx, http.MethodGet, url, nil, dst)
+}
+
+// do sends body as JSON if it is not nil, and parses the JSON response into dst
+func (c proxyClient) do(ctx context.Context, method string, url string, body []byte, dst interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
 	if err != nil {
 		return errors.Wrap(err, "request failed")
 	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("request status not ok: %d", resp.StatusCode)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request failed")
 	}
 	defer resp.Body.Close()
-	bytes, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return proxyStatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return errors.Wrap(err, "body parsing failed")
 	}
 
-	err = json.Unmarshal(bytes, dst)
+	err = json.Unmarshal(data, dst)
 	if err != nil {
 		return errors.Wrap(err, "body parsing failed")
 	}
@@ -1,19 +1,37 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/Q42/gcp-sema/pkg/secretmanager/diskcache"
+	"github.com/Q42/gcp-sema/pkg/secretmanager/fake"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -47,7 +65,7 @@ func (instance *proxyInstance) Prepare() {
 	var listCtx, valueCtx context.Context
 	listCtx, instance.emitList = context.WithCancel(context.Background())
 	valueCtx, instance.emitValue = context.WithCancel(context.Background())
-	opts := proxyCommand{Address: ":0", prepareClient: func(projectID string) secretmanager.KVClient {
+	opts := proxyCommand{Address: ":0", prepareClient: func(projectID string) (secretmanager.KVClient, error) {
 		return &ctxClient{
 			listCtx, valueCtx,
 			secretmanager.NewInMemoryClient("test",
@@ -57,7 +75,7 @@ func (instance *proxyInstance) Prepare() {
 				"foo3", "bar"),
 			func() { atomic.AddInt32(&instance.listGetCounter, 1) },
 			func() { atomic.AddInt32(&instance.valueGetCounter, 1) },
-		}
+		}, nil
 	}}
 	go opts.Execute(nil)
 	time.Sleep(10 * time.Millisecond)
@@ -107,20 +125,20 @@ type ctxClient struct {
 
 var _ secretmanager.KVClient = &ctxClient{}
 
-func (c *ctxClient) ListKeys() (keys []secretmanager.KVValue, err error) {
+func (c *ctxClient) ListKeys(ctx context.Context) (keys []secretmanager.KVValue, err error) {
 	c.OnList()
 	<-c.Context.Done()
-	keys, err = c.delegate.ListKeys()
+	keys, err = c.delegate.ListKeys(ctx)
 	for i, key := range keys {
 		keys[i] = &ctxValue{KVValue: key, Context: c.valueCtx, OnValue: c.OnValue}
 	}
 	return
 }
-func (c *ctxClient) Get(name string) (secretmanager.KVValue, error) {
-	kv, err := c.delegate.Get(name)
+func (c *ctxClient) Get(ctx context.Context, name string) (secretmanager.KVValue, error) {
+	kv, err := c.delegate.Get(ctx, name)
 	return &ctxValue{KVValue: kv, Context: c.valueCtx, OnValue: c.OnValue}, err
 }
-func (c *ctxClient) New(name string, labels map[string]string) (secretmanager.KVValue, error) {
+func (c *ctxClient) New(ctx context.Context, name string, labels map[string]string) (secretmanager.KVValue, error) {
 	return nil, errors.New("unimplemented")
 }
 
@@ -132,8 +150,728 @@ type ctxValue struct {
 
 var _ secretmanager.KVValue = &ctxValue{}
 
-func (c *ctxValue) GetValue() ([]byte, error) {
+func (c *ctxValue) GetValue(ctx context.Context) ([]byte, error) {
 	c.OnValue()
 	<-c.Context.Done()
-	return c.KVValue.GetValue()
+	return c.KVValue.GetValue(ctx)
+}
+
+// fakeClock is a settable clock for the proxy caches
+type fakeClock struct {
+	m   sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// proxyGetValue requests the value of a secret, returning the value and the cache headers
+func proxyGetValue(t *testing.T, server *httptest.Server, shortName string) (value string, hit string, age string) {
+	resp, err := http.Get(fmt.Sprintf("%s/get?project=test&shortName=%s", server.URL, shortName))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	detail := proxySecretDetail{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&detail))
+	data, err := base64.RawStdEncoding.DecodeString(detail.Data)
+	assert.NoError(t, err)
+	return string(data), resp.Header.Get("Cache-Hit"), resp.Header.Get("Cache-Age")
+}
+
+func newCachingProxy(t *testing.T, opts *proxyCommand) (*httptest.Server, secretmanager.KVClient, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	client := secretmanager.NewInMemoryClient("test", "foo", "bar")
+	opts.now = clock.Now
+	opts.prepareClient = func(projectID string) (secretmanager.KVClient, error) { return client, nil }
+	server := httptest.NewServer(opts.handler())
+	t.Cleanup(server.Close)
+	return server, client, clock
+}
+
+func TestProxyCacheTTL(t *testing.T) {
+	server, client, clock := newCachingProxy(t, &proxyCommand{ListTTL: time.Minute, ValueTTL: time.Minute, StaleWhileRevalidate: time.Minute})
+	ctx := context.Background()
+	secret, err := client.Get(ctx, "foo")
+	assert.NoError(t, err)
+
+	value, hit, age := proxyGetValue(t, server, "foo")
+	assert.Equal(t, []string{"bar", "false", "0"}, []string{value, hit, age})
+	_, err = secret.SetValue(ctx, []byte("baz"))
+	assert.NoError(t, err)
+	clock.Add(30 * time.Second)
+	value, hit, age = proxyGetValue(t, server, "foo")
+	assert.Equal(t, []string{"bar", "true", "30"}, []string{value, hit, age}, "cached within TTL")
+
+	// Stale, but refreshed in the background
+	clock.Add(40 * time.Second)
+	value, hit, age = proxyGetValue(t, server, "foo")
+	assert.Equal(t, []string{"bar", "true", "70"}, []string{value, hit, age}, "stale while revalidating")
+	assert.Eventually(t, func() bool {
+		value, _, age = proxyGetValue(t, server, "foo")
+		return value == "baz" && age == "0"
+	}, time.Second, 10*time.Millisecond, "refreshed")
+
+	// Too old to serve
+	_, err = secret.SetValue(ctx, []byte("qux"))
+	assert.NoError(t, err)
+	clock.Add(3 * time.Minute)
+	value, hit, age = proxyGetValue(t, server, "foo")
+	assert.Equal(t, []string{"qux", "false", "0"}, []string{value, hit, age}, "expired")
+}
+
+func TestProxyInvalidate(t *testing.T) {
+	server, client, _ := newCachingProxy(t, &proxyCommand{AdminToken: "admin"})
+	ctx := context.Background()
+	invalidate := func(method string, token string) int {
+		req, err := http.NewRequest(method, server.URL+"/invalidate?project=test&shortName=foo", nil)
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	value, _, _ := proxyGetValue(t, server, "foo")
+	assert.Equal(t, "bar", value)
+	secret, err := client.Get(ctx, "foo")
+	assert.NoError(t, err)
+	_, err = secret.SetValue(ctx, []byte("baz"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, invalidate(http.MethodGet, "admin"))
+	assert.Equal(t, http.StatusUnauthorized, invalidate(http.MethodPost, ""))
+	assert.Equal(t, http.StatusUnauthorized, invalidate(http.MethodPost, "wrong"))
+	value, hit, _ := proxyGetValue(t, server, "foo")
+	assert.Equal(t, []string{"bar", "true"}, []string{value, hit}, "cached forever without TTL")
+
+	assert.Equal(t, http.StatusOK, invalidate(http.MethodPost, "admin"))
+	value, hit, _ = proxyGetValue(t, server, "foo")
+	assert.Equal(t, []string{"baz", "false"}, []string{value, hit})
+
+	disabled, _, _ := newCachingProxy(t, &proxyCommand{})
+	resp, err := http.Post(disabled.URL+"/invalidate?project=test", "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "disabled without --admin-token")
+}
+
+func TestProxyInvalidateCacheDir(t *testing.T) {
+	key, err := diskcache.ParseKey("0123456789abcdef0123456789abcdef")
+	assert.NoError(t, err)
+	opts := &proxyCommand{AdminToken: "admin", CacheDir: t.TempDir(), cacheKey: key, ListTTL: time.Hour, ValueTTL: time.Hour}
+	server, client, _ := newCachingProxy(t, opts)
+	ctx := context.Background()
+
+	value, _, _ := proxyGetValue(t, server, "foo")
+	assert.Equal(t, "bar", value)
+	secret, err := client.Get(ctx, "foo")
+	assert.NoError(t, err)
+
+	for _, c := range []struct{ query, value string }{
+		{"project=test&shortName=foo", "baz"},
+		{"project=test", "qux"},
+	} {
+		_, err = secret.SetValue(ctx, []byte(c.value))
+		assert.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/invalidate?"+c.query, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp.Body.Close()
+		value, hit, _ := proxyGetValue(t, server, "foo")
+		assert.Equal(t, []string{c.value, "false"}, []string{value, hit}, c.query)
+	}
+
+	err = (&proxyCommand{CacheDir: opts.CacheDir, ValueTTL: time.Minute}).Execute(nil)
+	assert.Equal(t, exitConfig, exitCode(err), "0 caches forever, which --cache-dir does not")
+}
+
+func setenv(t *testing.T, key, value string) {
+	previous, exists := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if exists {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func newAuthProxy(t *testing.T, opts *proxyCommand) *httptest.Server {
+	opts.prepareClient = func(projectID string) (secretmanager.KVClient, error) {
+		return secretmanager.NewInMemoryClient(projectID, "foo", "1", "foo2", "2", "bar", "3"), nil
+	}
+	return httptest.NewUnstartedServer(opts.handler())
+}
+
+func TestProxyTokenAuth(t *testing.T) {
+	ctx := context.Background()
+	server := newAuthProxy(t, &proxyCommand{auth: &proxyAuthConfig{Principals: []*proxyPrincipal{
+		{Name: "app", Token: "app-token", Projects: []string{"test"}, Secrets: []string{"foo*"}},
+	}}})
+	server.Start()
+	defer server.Close()
+
+	setenv(t, "SEMA_PROXY_TOKEN", "app-token")
+	client, err := NewProxyClient(server.URL, "test")
+	assert.NoError(t, err)
+	keys, err := client.ListKeys(ctx)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"foo", "foo2"}, secretmanager.SecretShortNames(keys), "only allowed secrets are listed")
+	secret, err := client.Get(ctx, "foo")
+	assert.NoError(t, err)
+	value, err := secret.GetValue(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(value))
+
+	for url, status := range map[string]int{
+		"/get?project=test&shortName=bar":      http.StatusForbidden,
+		"/versions?project=test&shortName=bar": http.StatusForbidden,
+		"/list?project=other":                  http.StatusForbidden,
+		"/get?project=test&shortName=foo":      http.StatusOK,
+		"/metrics":                             http.StatusOK,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+url, nil)
+		req.Header.Set("Authorization", "Bearer app-token")
+		resp, err := http.DefaultClient.Do(req)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, status, resp.StatusCode, url)
+		}
+	}
+	resp, err := http.Get(server.URL + "/metrics")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "metrics show the cached projects")
+	}
+
+	setenv(t, "SEMA_PROXY_TOKEN", "wrong")
+	client, err = NewProxyClient(server.URL, "test")
+	assert.NoError(t, err)
+	_, err = client.ListKeys(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, exitPermissionDenied, exitCode(err))
+}
+
+func TestProxyClientCertificateAuth(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	caCert, caKey := newTestCertificate(t, "test-ca", nil, nil)
+	agentCert, agentKey := newTestCertificate(t, "agent", caCert, caKey)
+	otherCert, otherKey := newTestCertificate(t, "other", caCert, caKey)
+	writeTestCertificate(t, filepath.Join(dir, "ca.pem"), caCert, nil)
+	writeTestCertificate(t, filepath.Join(dir, "agent.pem"), agentCert, agentKey)
+	writeTestCertificate(t, filepath.Join(dir, "other.pem"), otherCert, otherKey)
+
+	opts := &proxyCommand{ClientCAFile: filepath.Join(dir, "ca.pem"), auth: &proxyAuthConfig{Principals: []*proxyPrincipal{
+		{Name: "agent", CommonName: "agent", Projects: []string{"test"}},
+	}}}
+	server := newAuthProxy(t, opts)
+	tlsConfig, err := opts.tlsConfig()
+	assert.NoError(t, err)
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+	writeTestCertificate(t, filepath.Join(dir, "server.pem"), server.Certificate(), nil)
+	setenv(t, "SEMA_PROXY_CA", filepath.Join(dir, "server.pem"))
+
+	setenv(t, "SEMA_PROXY_CERT", filepath.Join(dir, "agent.pem"))
+	setenv(t, "SEMA_PROXY_KEY", filepath.Join(dir, "agent.pem"))
+	client, err := NewProxyClient(server.URL, "test")
+	assert.NoError(t, err)
+	keys, err := client.ListKeys(ctx)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"bar", "foo", "foo2"}, secretmanager.SecretShortNames(keys))
+
+	// Valid certificate, but unknown name
+	setenv(t, "SEMA_PROXY_CERT", filepath.Join(dir, "other.pem"))
+	setenv(t, "SEMA_PROXY_KEY", filepath.Join(dir, "other.pem"))
+	client, err = NewProxyClient(server.URL, "test")
+	assert.NoError(t, err)
+	_, err = client.ListKeys(ctx)
+	assert.Equal(t, exitPermissionDenied, exitCode(err), "%v", err)
+}
+
+// newTestCertificate creates a certificate, self-signed if parent is nil
+func newTestCertificate(t *testing.T, commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cert, err := x509.ParseCertificate(der)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return cert, key
+}
+
+// writeTestCertificate writes the certificate and optionally the key as PEM
+func writeTestCertificate(t *testing.T, file string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if key != nil {
+		der, err := x509.MarshalECPrivateKey(key)
+		assert.NoError(t, err)
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})...)
+	}
+	assert.NoError(t, ioutil.WriteFile(file, data, 0600))
+}
+
+func TestProxyAuthConfig(t *testing.T) {
+	dir := t.TempDir()
+	load := func(config string) (*proxyAuthConfig, error) {
+		file := filepath.Join(dir, "auth.yaml")
+		assert.NoError(t, ioutil.WriteFile(file, []byte(config), 0600))
+		return loadProxyAuthConfig(file)
+	}
+
+	config, err := load(`principals:
+- name: ci
+  token: abc
+  projects: ["my-*"]
+  secrets: ["APP_*"]
+- commonName: agent
+  projects: ["*"]
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, "principal 2", config.Principals[1].Name)
+	assert.True(t, config.Principals[0].allows("my-project", "APP_KEY"))
+	assert.False(t, config.Principals[0].allows("my-project", "OTHER_KEY"))
+	assert.False(t, config.Principals[0].allows("other-project", "APP_KEY"))
+	assert.True(t, config.Principals[1].allows("other-project", "OTHER_KEY"))
+
+	for _, invalid := range []string{
+		"principals: [{token: abc}]",
+		"principals: [{projects: ['*']}]",
+		"principals: [{token: abc, commonName: agent, projects: ['*']}]",
+		"principals: [{token: abc, projects: ['[']}]",
+	} {
+		_, err = load(invalid)
+		assert.Equal(t, exitConfig, exitCode(err), invalid)
+	}
+}
+
+func TestProxyUnixSocket(t *testing.T) {
+	ctx := context.Background()
+	socket := filepath.Join(t.TempDir(), "sema.sock")
+
+	// A socket left behind by a crashed proxy is replaced
+	stale, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := proxyListen("unix://"+socket, "0660")
+	if !assert.NoError(t, err) {
+		return
+	}
+	info, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+
+	opts := &proxyCommand{listener: listener, prepareClient: func(projectID string) (secretmanager.KVClient, error) {
+		return secretmanager.NewInMemoryClient(projectID, "foo", "bar"), nil
+	}}
+	go opts.Execute(nil)
+	defer listener.Close()
+
+	client, err := NewProxyClient("unix://"+socket, "test")
+	assert.NoError(t, err)
+	secret, err := client.Get(ctx, "foo")
+	assert.NoError(t, err)
+	value, err := secret.GetValue(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", string(value))
+
+	_, err = proxyListen("unix://"+socket, "rw")
+	assert.Equal(t, exitConfig, exitCode(err))
+}
+
+func TestProxyMetrics(t *testing.T) {
+	server, _, _ := newCachingProxy(t, &proxyCommand{})
+	proxyGetValue(t, server, "foo")
+	proxyGetValue(t, server, "foo")
+	resp, err := http.Get(server.URL + "/get?project=test&shortName=missing")
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/metrics")
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics := readBody(resp.Body)
+	for _, line := range []string{
+		`sema_proxy_requests_total{endpoint="/get",code="200"} 2`,
+		`sema_proxy_requests_total{endpoint="/get",code="404"} 1`,
+		`sema_proxy_cache_requests_total{cache="value",result="hit"} 1`,
+		`sema_proxy_cache_requests_total{cache="value",result="miss"} 1`,
+		`sema_proxy_upstream_duration_seconds_count{operation="value"} 1`,
+		`sema_proxy_upstream_duration_seconds_bucket{operation="get",le="+Inf"} 2`,
+		`sema_proxy_cache_requests_total{cache="secret",result="hit"} 1`,
+		`sema_proxy_upstream_errors_total{operation="get",code="NotFound"} 1`,
+		`sema_proxy_cached_entries{project="test",cache="value"} 1`,
+		`# TYPE sema_proxy_upstream_duration_seconds histogram`,
+	} {
+		assert.Contains(t, metrics, line+"\n")
+	}
+}
+
+func TestProxySecret(t *testing.T) {
+	ctx := context.Background()
+	opts := &proxyCommand{auth: &proxyAuthConfig{Principals: []*proxyPrincipal{
+		{Name: "app", Token: "app-token", Projects: []string{"test"}, Secrets: []string{"foo*"}},
+	}}}
+	server := newAuthProxy(t, opts)
+	server.Start()
+	defer server.Close()
+
+	setenv(t, "SEMA_PROXY_TOKEN", "app-token")
+	client, err := NewProxyClient(server.URL, "test")
+	assert.NoError(t, err)
+	secret, err := client.Get(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "project/test/secrets/foo", secret.GetFullName())
+	value, err := secret.GetValue(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(value))
+	_, err = client.Get(ctx, "project/test/secrets/foo2")
+	assert.NoError(t, err, "full name")
+	assert.Nil(t, opts.metrics.upstreamDuration["list"], "the project is not listed")
+
+	_, err = client.Get(ctx, "foo3")
+	assert.True(t, secretmanager.IsNotFound(err))
+	assert.Equal(t, exitNotFound, exitCode(err))
+	_, err = client.Get(ctx, "bar")
+	assert.False(t, secretmanager.IsNotFound(err))
+	assert.Equal(t, exitPermissionDenied, exitCode(err))
+}
+
+// countRequests counts the requests to the proxy by path, before they are handled
+func countRequests(handler http.Handler) (http.Handler, func(path string) int) {
+	m := sync.Mutex{}
+	counts := make(map[string]int)
+	counting := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		counts[r.URL.Path]++
+		m.Unlock()
+		handler.ServeHTTP(rw, r)
+	})
+	return counting, func(path string) int {
+		m.Lock()
+		defer m.Unlock()
+		return counts[path]
+	}
+}
+
+func TestProxyBatch(t *testing.T) {
+	ctx := context.Background()
+	opts := &proxyCommand{auth: &proxyAuthConfig{Principals: []*proxyPrincipal{
+		{Name: "app", Token: "app-token", Projects: []string{"test"}, Secrets: []string{"foo*"}},
+	}}}
+	server := newAuthProxy(t, opts)
+	handler, count := countRequests(server.Config.Handler)
+	server.Config.Handler = handler
+	server.Start()
+	defer server.Close()
+
+	setenv(t, "SEMA_PROXY_TOKEN", "app-token")
+	client, err := NewProxyClient(server.URL, "test")
+	assert.NoError(t, err)
+	secret := func(shortName string) secretmanager.KVValue {
+		return proxyClient{secret: &proxySecret{ShortName: shortName, FullName: "project/test/secrets/" + shortName}}
+	}
+	results := client.(secretmanager.KVBatchClient).GetValues(ctx, []secretmanager.KVValueRequest{
+		{Secret: secret("foo")},
+		{Secret: secret("foo2")},
+		{Secret: secret("foo3")},
+		{Secret: secret("bar")},
+	})
+	assert.Equal(t, 1, count("/batch"))
+	assert.Len(t, results, 4)
+	assert.Equal(t, "1", string(results[0].Data))
+	assert.Equal(t, "2", string(results[1].Data))
+	assert.True(t, secretmanager.IsNotFound(results[2].Err))
+	assert.Equal(t, exitPermissionDenied, exitCode(results[3].Err))
+
+	var many []secretmanager.KVValueRequest
+	for i := 0; i < proxyBatchSize+1; i++ {
+		many = append(many, secretmanager.KVValueRequest{Secret: secret("foo")})
+	}
+	results = client.(secretmanager.KVBatchClient).GetValues(ctx, many)
+	assert.Equal(t, 3, count("/batch"), "split in batches of proxyBatchSize")
+	assert.Len(t, results, proxyBatchSize+1)
+	assert.NoError(t, results[proxyBatchSize].Err)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/batch?project=test", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer app-token")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func TestProxyBackends(t *testing.T) {
+	ctx := context.Background()
+	upstream := fake.New()
+	endpoint, err := upstream.Listen("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer upstream.Stop()
+	upstream.Seed("gcp", "foo", nil, "from-secret-manager")
+
+	dir := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "fixtures.env"), []byte("foo=from-file\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "backends.yaml"), []byte(`projects:
+  - project: fixtures
+    type: offline
+    file: fixtures.env
+  - project: demo-*
+    type: memory
+    secrets:
+      foo: from-memory
+  - project: "*"
+    endpoint: `+endpoint+`
+`), 0600))
+	backends, err := loadProxyBackendConfig(filepath.Join(dir, "backends.yaml"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	server := httptest.NewServer((&proxyCommand{prepareClient: backends.client}).handler())
+	defer server.Close()
+
+	for project, expected := range map[string]string{
+		"fixtures": "from-file",
+		"demo-app": "from-memory",
+		"gcp":      "from-secret-manager",
+	} {
+		client, err := NewProxyClient(server.URL, project)
+		assert.NoError(t, err)
+		secret, err := client.Get(ctx, "foo")
+		if !assert.NoError(t, err, project) {
+			continue
+		}
+		value, err := secret.GetValue(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(value), project)
+	}
+}
+
+func TestProxyBackendsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, config := range map[string]string{
+		"type":    "projects: [{project: a, type: vault}]",
+		"file":    "projects: [{project: a, type: offline}]",
+		"missing": "projects: [{project: a, type: offline, file: missing.env}]",
+		"project": "projects: [{type: memory}]",
+		"pattern": "projects: [{project: \"[\"}]",
+	} {
+		file := filepath.Join(dir, name+".yaml")
+		assert.NoError(t, ioutil.WriteFile(file, []byte(config), 0600))
+		_, err := loadProxyBackendConfig(file)
+		assert.Equal(t, exitConfig, exitCode(err), name)
+	}
+}
+
+func TestProxyWrites(t *testing.T) {
+	ctx := context.Background()
+	audit := &bytes.Buffer{}
+	opts := &proxyCommand{AllowWrites: true, audit: &jsonLines{w: audit}, auth: &proxyAuthConfig{Principals: []*proxyPrincipal{
+		{Name: "writer", Token: "write-token", Projects: []string{"test"}, Secrets: []string{"foo*"}, Write: true},
+		{Name: "reader", Token: "read-token", Projects: []string{"test"}},
+	}}}
+	server := newAuthProxy(t, opts)
+	server.Start()
+	defer server.Close()
+
+	setenv(t, "SEMA_PROXY_TOKEN", "write-token")
+	client, err := NewProxyClient(server.URL, "test")
+	assert.NoError(t, err)
+	readValue := func(shortName string) string {
+		secret, err := client.Get(ctx, shortName)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		value, err := secret.GetValue(ctx)
+		assert.NoError(t, err)
+		return string(value)
+	}
+	assert.Equal(t, "1", readValue("foo"))
+
+	add := addCommand{Positional: addCommandPositional{"test", "foo"}, Data: "updated", Force: []bool{true}, Proxy: server.URL}
+	assert.NoError(t, add.Execute(nil))
+	assert.Equal(t, "updated", readValue("foo"), "the cached value is invalidated")
+	add = addCommand{Positional: addCommandPositional{"test", "foo3"}, Data: "new", Labels: map[string]string{"a": "b"}, Proxy: server.URL}
+	assert.NoError(t, add.Execute(nil))
+	assert.Equal(t, "new", readValue("foo3"))
+
+	add = addCommand{Positional: addCommandPositional{"test", "bar"}, Data: "denied", Force: []bool{true}, Proxy: server.URL}
+	assert.Equal(t, exitPermissionDenied, exitCode(add.Execute(nil)), "outside of the allowed secrets")
+	setenv(t, "SEMA_PROXY_TOKEN", "read-token")
+	add = addCommand{Positional: addCommandPositional{"test", "foo"}, Data: "denied", Force: []bool{true}, Proxy: server.URL}
+	assert.Equal(t, exitPermissionDenied, exitCode(add.Execute(nil)), "without write permission")
+
+	var entries []proxyAuditEntry
+	decoder := json.NewDecoder(audit)
+	for decoder.More() {
+		entry := proxyAuditEntry{}
+		assert.NoError(t, decoder.Decode(&entry))
+		entries = append(entries, entry)
+	}
+	if !assert.Len(t, entries, 3) {
+		return
+	}
+	sum := sha256.Sum256([]byte("updated"))
+	assert.Equal(t, proxyAuditEntry{Time: entries[0].Time, Principal: "writer", Action: "set_value", Project: "test", ShortName: "foo",
+		FullName: "project/test/secrets/foo", Version: "project/test/secrets/foo/2", SHA256: hex.EncodeToString(sum[:])}, entries[0])
+	assert.Equal(t, []string{"new", "set_value"}, []string{entries[1].Action, entries[2].Action})
+	assert.Equal(t, map[string]string{"a": "b"}, entries[1].Labels)
+
+	readOnly := newAuthProxy(t, &proxyCommand{auth: opts.auth})
+	readOnly.Start()
+	defer readOnly.Close()
+	setenv(t, "SEMA_PROXY_TOKEN", "write-token")
+	add = addCommand{Positional: addCommandPositional{"test", "foo"}, Data: "denied", Force: []bool{true}, Proxy: readOnly.URL}
+	err = add.Execute(nil)
+	assert.Contains(t, err.Error(), "--allow-writes")
+}
+
+func TestProxyShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	valueCtx, emitValue := context.WithCancel(context.Background())
+	requested := make(chan struct{}, 1)
+	opts := &proxyCommand{ShutdownTimeout: time.Minute, listener: listener, signals: make(chan os.Signal, 1),
+		prepareClient: func(projectID string) (secretmanager.KVClient, error) {
+			return &ctxClient{context.Background(), valueCtx, secretmanager.NewInMemoryClient(projectID, "foo", "bar"),
+				func() {}, func() { requested <- struct{}{} }}, nil
+		}}
+	stopped := make(chan error, 1)
+	go func() { stopped <- opts.Execute(nil) }()
+
+	url := "http://" + listener.Addr().String()
+	inProgress := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url + "/get?project=test&shortName=foo")
+		if !assert.NoError(t, err) {
+			inProgress <- 0
+			return
+		}
+		resp.Body.Close()
+		inProgress <- resp.StatusCode
+	}()
+	<-requested
+
+	opts.signals <- syscall.SIGTERM
+	select {
+	case <-stopped:
+		t.Fatal("stopped before the request in progress was done")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = http.Get(url + "/healthz")
+	assert.Error(t, err, "no new connections are accepted")
+
+	emitValue()
+	assert.Equal(t, 200, <-inProgress)
+	assert.NoError(t, <-stopped)
+}
+
+func TestProxyReadiness(t *testing.T) {
+	credentialsErr := errors.New("could not find default credentials")
+	opts := &proxyCommand{checkCredentials: func(ctx context.Context) error { return credentialsErr }}
+	server := httptest.NewServer(opts.handler())
+	defer server.Close()
+	status := func(endpoint string) int {
+		resp, err := http.Get(server.URL + endpoint)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, status("/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, status("/readyz"))
+	credentialsErr = nil
+	assert.Equal(t, http.StatusOK, status("/readyz"))
+	credentialsErr = errors.New("not checked again")
+	assert.Equal(t, http.StatusOK, status("/readyz"))
+	atomic.StoreInt32(&opts.draining, 1)
+	assert.Equal(t, http.StatusServiceUnavailable, status("/readyz"), "shutting down")
+	assert.Equal(t, http.StatusOK, status("/healthz"))
+}
+
+func TestProxyBackendsUseGoogleCloud(t *testing.T) {
+	var none *proxyBackendConfig
+	assert.True(t, none.usesGoogleCloud())
+	assert.False(t, (&proxyBackendConfig{Projects: []*proxyBackend{
+		{Project: "fixtures", Type: proxyBackendOffline},
+		{Project: "*", Type: proxyBackendMemory},
+	}}).usesGoogleCloud())
+	assert.True(t, (&proxyBackendConfig{Projects: []*proxyBackend{
+		{Project: "fixtures", Type: proxyBackendOffline},
+	}}).usesGoogleCloud(), "other projects use Secret Manager")
+	assert.False(t, (&proxyBackendConfig{Projects: []*proxyBackend{
+		{Project: "*", Type: proxyBackendSecretManager, Endpoint: "127.0.0.1:8085"},
+	}}).usesGoogleCloud())
+}
+
+func TestProxyAccessLog(t *testing.T) {
+	accessLog := &bytes.Buffer{}
+	opts := &proxyCommand{accessLog: &jsonLines{w: accessLog}, auth: &proxyAuthConfig{Principals: []*proxyPrincipal{
+		{Name: "app", Token: "app-token", Projects: []string{"test"}},
+	}}}
+	server := newAuthProxy(t, opts)
+	server.Start()
+	defer server.Close()
+
+	setenv(t, "SEMA_PROXY_TOKEN", "app-token")
+	client, err := NewProxyClient(server.URL, "test")
+	assert.NoError(t, err)
+	_, err = client.Get(context.Background(), "missing")
+	assert.Error(t, err)
+
+	entry := proxyAccessEntry{}
+	assert.NoError(t, json.Unmarshal(accessLog.Bytes(), &entry))
+	assert.Equal(t, proxyAccessEntry{Time: entry.Time, Method: "GET", Path: "/secret", Project: "test", Secret: "missing", Principal: "app",
+		Status: 404, Bytes: entry.Bytes, Duration: entry.Duration, Error: `404: "missing": not found`}, entry)
 }
@@ -1,17 +1,25 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/Q42/gcp-sema/pkg/handlers"
+	"github.com/Q42/gcp-sema/pkg/multierror"
 	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/Q42/gcp-sema/pkg/secretmanager/diskcache"
+	"github.com/Q42/gcp-sema/pkg/secretmanager/memoize"
+	"github.com/Q42/gcp-sema/pkg/secretmanager/retry"
+	"github.com/Q42/gcp-sema/pkg/secretmanager/singleflight"
 	flags "github.com/jessevdk/go-flags"
+	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 )
 
@@ -41,6 +49,10 @@ The following options are implemented:
   # extract key value from SeMa into literals
   -s sema-literal=MY_APP_SECRET=MY_APP_SECRET_NEW
 
+  # extract a specific version of a key from SeMa into literals
+  -s sema-literal=MY_APP_SECRET=MY_APP_SECRET_NEW@7
+
+Versions can also be pinned for all handlers (including schemas) using --pin MY_APP_SECRET_NEW@7.
 Configuration can also be done through YAML in file %q.
 `, DefaultFileSecretsConfig)
 
@@ -51,48 +63,113 @@ func init() {
 }
 
 // Execute of RenderCommand is the 'sema render' command
-func (opts *RenderCommand) Execute(args []string) error {
+func (opts *RenderCommand) Execute(args []string) (err error) {
 	if len(args) > 0 && args[0] == "test" {
 		return nil
 	}
+	ctx, cancel := commandContext(opts.Timeout)
+	defer cancel()
+	defer recoverAborted(ctx, &err)
+
+	formatter, hasFormatter := FormatRegistry[opts.Format]
+	if !hasFormatter {
+		return handlers.ConfigErrorf("Unknown format %q (use [%s])", opts.Format, strings.Join(formatNames(), ","))
+	}
 
+	fields, annotations, err := opts.prepare(ctx, renderCommand)
+	if err != nil {
+		return err
+	}
+
+	return formatter.Format(os.Stdout, FormatInput{
+		Name:            opts.Name,
+		Namespace:       opts.Namespace,
+		Dir:             opts.Dir,
+		Verbose:         len(opts.Verbose) > 0,
+		Fields:          fields,
+		Annotations:     annotations,
+		SecretStore:     opts.SecretStore,
+		SecretStoreKind: opts.SecretStoreKind,
+		// Give all handlers a go to write to the secret data
+		Data:       func() (map[string][]byte, error) { return opts.populate(ctx) },
+		References: opts.references,
+	})
+}
+
+// prepare loads the configuration, injects the Secret Manager client and prepares all handlers.
+// It is shared by all commands that use the render pipeline.
+// All handlers are prepared, also when one of them fails, so all errors are reported at once.
+func (opts *RenderCommand) prepare(ctx context.Context, command *flags.Command) (fields map[string]bool, annotations map[string]string, err error) {
 	// Load defaults from config file
-	configRenderCommand := opts.parseConfigFile()
-	opts.mergeCommandOptions(renderCommand, configRenderCommand)
+	configRenderCommand, err := opts.parseConfigFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.mergeCommandOptions(command, configRenderCommand)
 	// Default secret name to folder basename
 	if opts.Name == "" {
 		cwdpath, err := os.Getwd()
-		panicIfErr(err)
+		if err != nil {
+			return nil, nil, err
+		}
 		opts.Name = path.Base(cwdpath)
 	}
 
 	// Inject SeMa client into handlers:
 	var client secretmanager.KVClient
-	var err error
+	readOnly := opts.readOnly
 	if opts.MockSema {
 		client = secretmanager.NewInMemoryClient("mock", "*", "")
+		readOnly = "--mock-sema"
+	} else if opts.OfflineLookupFile != "" {
+		client, err = secretmanager.NewOfflineClient(opts.OfflineLookupFile, opts.Positional.Project)
+		readOnly = "--offline"
+	} else if opts.Proxy != "" {
+		client, err = NewProxyClient(opts.Proxy, opts.Positional.Project)
+		readOnly = "--proxy"
 	} else {
-		if opts.OfflineLookupFile != "" {
-			client, err = secretmanager.NewOfflineClient(opts.OfflineLookupFile, opts.Positional.Project)
-			panicIfErr(err)
-		} else if opts.Proxy != "" {
-			client = NewProxyClient(opts.Proxy, opts.Positional.Project)
-		} else {
-			client = prepareSemaClient(opts.Positional.Project)
+		client, err = prepareSemaClient(opts.Positional.Project)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if retryClient, isRetry := client.(*retry.Client); isRetry {
+		opts.clientStats = retryClient.Stats
+	}
+	if opts.CacheDir != "" && !opts.MockSema && opts.OfflineLookupFile == "" {
+		key, err := loadCacheKey(opts.CacheDir, opts.CacheKeyFile)
+		if err != nil {
+			return nil, nil, err
 		}
+		cache, err := prepareDiskCache(client, opts.Positional.Project, diskcache.Options{Dir: opts.CacheDir, Key: key, ListTTL: opts.CacheTTL, ValueTTL: opts.CacheTTL})
+		if err != nil {
+			return nil, nil, err
+		}
+		// With --proxy, the values that are not cached are still retrieved in a single batch
+		client = cache.Batch()
+	}
+	if !opts.MockSema {
+		// Remember values so they can be prefetched concurrently, see populate
+		client = memoize.New(singleflight.New(client))
+	}
+	pins, err := handlers.ParsePins(opts.Pins)
+	if err != nil {
+		return nil, nil, err
 	}
 	opts.Handlers = handlers.InjectSemaClient(opts.Handlers, client, handlers.SecretHandlerOptions{
-		Prefix:  opts.Prefix,
-		Mock:    opts.MockSema,
-		Verbose: len(opts.Verbose) > 0,
+		Prefix:   opts.Prefix,
+		Mock:     opts.MockSema,
+		Verbose:  len(opts.Verbose) > 0,
+		Pins:     pins,
+		ReadOnly: readOnly,
 	})
 
 	// Give all handlers a go at downloading key-value lists/preparations
 	// Give all handlers a go to write annotation data
-	fields := make(map[string]bool)
-	annotations := make(map[string]string)
+	fields = make(map[string]bool)
+	annotations = make(map[string]string)
 	for _, h := range opts.Handlers {
-		h.Prepare(fields)
+		err = multierror.MultiAppend(err, h.Prepare(ctx, fields))
 		h.Annotate(func(key, value string) {
 			key, value, ok := postProcessAnnotation(key, value)
 			if ok {
@@ -100,75 +177,70 @@ func (opts *RenderCommand) Execute(args []string) error {
 			}
 		})
 	}
+	if err != nil {
+		return nil, nil, abortedError(ctx, err)
+	}
+	return fields, annotations, nil
+}
 
-	if opts.Format == "files" {
-		for _, file := range sortedKeysB(fields) {
-			log.Printf("Preparing to write %q", file)
-		}
-		log.Println("Downloading from key-value sources (use --verbose to preview which)...")
-		if len(opts.Verbose) > 0 {
-			for _, v := range annotations {
-				log.Printf("Source %q", v)
-			}
-		}
+// populate gives all handlers a go to write to the secret data, errors of all handlers are collected.
+// The values are retrieved concurrently first, then the handlers run in order.
+func (opts *RenderCommand) populate(ctx context.Context) (data map[string][]byte, err error) {
+	defer opts.logClientStats()
+	// The prefetch error is not reported: memoize remembers failures too, so the handlers report them once, in order
+	_ = handlers.Prefetch(ctx, opts.Handlers, opts.Concurrency)
+	data = make(map[string][]byte)
+	for _, h := range opts.Handlers {
+		err = multierror.MultiAppend(err, h.Populate(ctx, data))
 	}
+	if err != nil {
+		return nil, abortedError(ctx, err)
+	}
+	return data, nil
+}
 
-	// Preamble, depending on the format
-	if opts.Format == "yaml" {
-		annotations["info/generated-by"] = "github.com/q42/gcp-sema"
-		yml, err := yaml.Marshal(secretYAML{
-			Kind:       "Secret",
-			APIVersion: "v1",
-			Type:       "Opaque",
-			Metadata: secretYAMLMetadata{
-				Name:        opts.Name,
-				Namespace:   opts.Namespace,
-				Annotations: annotations,
-			},
-		})
-		panicIfErr(err)
-		os.Stdout.WriteString(string(yml))
-		// Write 'data' separately to unify writing in the different formats
-		os.Stdout.WriteString("data:\n")
+// logClientStats shows how many Secret Manager requests were made and retried, with --verbose
+func (opts *RenderCommand) logClientStats() {
+	if len(opts.Verbose) == 0 || opts.clientStats == nil {
+		return
 	}
+	stats := opts.clientStats()
+	log.Printf("Secret Manager: %d requests, %d retries, %d failures", stats.Requests, stats.Retries, stats.Failures)
+}
 
-	// Give all handlers a go to write to the secret data
-	data := make(map[string][]byte)
+// references asks all handlers where their values can be found, instead of retrieving them
+func (opts *RenderCommand) references() (refs []handlers.Reference, err error) {
 	for _, h := range opts.Handlers {
-		h.Populate(data)
-	}
-
-	// Print all values in the correct format
-	for _, key := range sortedKeys(data) {
-		value := data[key]
-		switch opts.Format {
-		case "env":
-			os.Stdout.WriteString(fmt.Sprintf("%s=%q\n", key, string(value)))
-		case "files":
-			writeDevSecretFile(opts.Dir, key, value)
-		case "yaml":
-			os.Stdout.WriteString(fmt.Sprintf("  %s: %s\n", key, base64.StdEncoding.EncodeToString([]byte(value))))
-		default:
-			panic(fmt.Errorf("Unknown format %q (use [env,files,yaml])", opts.Format))
+		withReferences, ok := h.SecretHandler.(handlers.SecretHandlerWithReferences)
+		if !ok {
+			return nil, handlers.ConfigErrorf("Handler %T cannot be referenced by a secret operator, only Secret Manager and literal sources can", h.SecretHandler)
+		}
+		handlerRefs, err := withReferences.References()
+		if err != nil {
+			return nil, err
 		}
+		refs = append(refs, handlerRefs...)
 	}
-	return nil
+	return refs, nil
 }
 
 // Allows storing flags in a config file
-func (opts *RenderCommand) parseConfigFile() RenderCommand {
-	var configRenderCommand RenderCommand
+func (opts *RenderCommand) parseConfigFile() (RenderCommand, error) {
 	if opts.ConfigFile == "" {
 		opts.ConfigFile = DefaultFileSecretsConfig
 	}
-	if _, err := os.Stat(opts.ConfigFile); err == nil {
-		data, err := ioutil.ReadFile(opts.ConfigFile)
-		if err != nil {
-			panic(err)
-		}
-		configRenderCommand = parseConfigFileData(data)
+	if _, err := os.Stat(opts.ConfigFile); err != nil {
+		return RenderCommand{}, nil
+	}
+	data, err := ioutil.ReadFile(opts.ConfigFile)
+	if err != nil {
+		return RenderCommand{}, err
 	}
-	return configRenderCommand
+	configRenderCommand, err := parseConfigFileData(data)
+	if err != nil {
+		return RenderCommand{}, errors.Wrapf(err, "config file %q", opts.ConfigFile)
+	}
+	return configRenderCommand, nil
 }
 
 func (opts *RenderCommand) mergeCommandOptions(command *flags.Command, configFileOptions RenderCommand) {
@@ -190,10 +262,11 @@ func (opts *RenderCommand) mergeCommandOptions(command *flags.Command, configFil
 		opts.Namespace = configFileOptions.Namespace
 	}
 	opts.Handlers = append(opts.Handlers, configFileOptions.Handlers...)
+	opts.Pins = append(opts.Pins, configFileOptions.Pins...)
 
 }
 
-func writeDevSecretFile(directory, key string, value []byte) {
+func writeDevSecretFile(directory, key string, value []byte) error {
 	_, err := os.Stat(directory)
 	filepath := filepath.Join(directory, key)
 	if os.IsNotExist(err) {
@@ -206,16 +279,17 @@ func writeDevSecretFile(directory, key string, value []byte) {
 		if confirmed {
 			err = ioutil.WriteFile(filepath, value, 0755)
 			if err != nil {
-				panic(fmt.Sprintf("Error writing to file %s\n err: %s", filepath, err.Error()))
+				return errors.Wrapf(err, "Error writing to file %s", filepath)
 			}
 		}
 	} else {
 		err = ioutil.WriteFile(filepath, value, 0755)
 		if err != nil {
-			panic(fmt.Sprintf("Error writing to file %s\nerr: %s", filepath, err.Error()))
+			return errors.Wrapf(err, "Error writing to file %s", filepath)
 		}
 		fmt.Printf("Rendered %s\n", filepath)
 	}
+	return nil
 }
 
 // RenderCommand describes how to use the render command
@@ -223,20 +297,33 @@ type RenderCommand struct {
 	Positional struct {
 		Project string `required:"yes" description:"Google Cloud project" positional-arg-name:"project"`
 	} `positional-args:"yes"`
-	Verbose []bool `short:"v" long:"verbose" description:"Show verbose debug information"`
-	Format  string `short:"f" long:"format" default:"yaml" description:"How to output: 'yaml' is a fully specified Kubernetes secret, 'env' will generate a *.env file format that can be used for Docker (Compose). 'files' will generate files per secret in the secrets folder"`
-	Prefix  string `long:"prefix" description:"A SecretManager prefix that will override non-prefixed keys"`
+	Verbose     []bool        `short:"v" long:"verbose" description:"Show verbose debug information"`
+	Format      string        `short:"f" long:"format" default:"yaml" description:"How to output: 'yaml' is a fully specified Kubernetes secret, 'yaml-stringdata' is the same with readable values, 'env' will generate a *.env file format that can be used for Docker (Compose). 'files' will generate files per secret in the secrets folder, 'docker-compose' generates the 'secrets:' referring to those files. 'json' is a plain JSON object and 'shell' generates export statements. 'externalsecret' and 'secretproviderclass' generate manifests for External Secrets Operator and the Secrets Store CSI driver that only refer to Secret Manager, without retrieving values"`
+	Prefix      string        `long:"prefix" description:"A SecretManager prefix that will override non-prefixed keys"`
+	Timeout     time.Duration `long:"timeout" description:"Abort when Secret Manager has not responded within this duration (example: 30s)"`
+	Concurrency int           `long:"concurrency" description:"Maximum number of Secret Manager values to retrieve at the same time. Default: 8"`
 
 	Handlers []handlers.ConcreteSecretHandler `short:"s" long:"secrets" description:"The Secret source, this can be specified multiple times"`
+	Pins     []string                         `long:"pin" description:"Pin a Secret Manager key to a version using --pin=KEY@VERSION, this can be specified multiple times"`
 
 	Name       string `long:"name" description:"Name of Kubernetes secret. NB: with Kustomize this will just be the prefix!"`
 	Namespace  string ` env:"NAMESPACE" short:"n" long:"namespace" description:"The namespace you want to deploy the secret in"`
 	Dir        string `short:"d" long:"dir" default:"secrets" description:"Specify output directory when writing out to files, only used in combination with --format=files"`
 	ConfigFile string `short:"c" long:"config" env:"SEMA_CONFIG" description:"We read flags from this file, when present. Default location: .secrets-config.yml."`
+	// Reference-only formats
+	SecretStore     string `long:"secret-store" description:"Name of the SecretStore the ExternalSecret refers to, only used in combination with --format=externalsecret. Default: secret-manager"`
+	SecretStoreKind string `long:"secret-store-kind" description:"Kind of --secret-store, SecretStore or ClusterSecretStore. Default: ClusterSecretStore"`
+	// Persistent cache
+	CacheDir     string        `long:"cache-dir" description:"Keep an encrypted cache of Secret Manager in this directory, so the next run starts warm and works briefly offline. The key is read from SEMA_CACHE_KEY"`
+	CacheKeyFile string        `long:"cache-key-file" description:"Read the key of --cache-dir from this file instead of SEMA_CACHE_KEY"`
+	CacheTTL     time.Duration `long:"cache-ttl" description:"How long --cache-dir entries are used without asking Secret Manager. Default: 5m"`
 	// Debugging/offline usage
-	Proxy             string `env:"SEMA_PROXY" long:"proxy" description:"To use a proxy that caches secrets. See 'gcp-sema proxy'."`
+	Proxy             string `env:"SEMA_PROXY" long:"proxy" description:"To use a proxy that caches secrets, like http://127.0.0.1:8080 or unix:///run/sema.sock. See 'gcp-sema proxy'."`
 	OfflineLookupFile string `env:"OFFLINE" long:"offline" description:"You might want to run sema as an unprivileged user, for testing/validation purposes for example. Use this to provide fake/real/offline secrets."`
 	MockSema          bool   `env:"MOCK_SEMA" long:"mock-sema" description:"If you want to run without having Secret-Manager access"`
+	// private
+	clientStats func() retry.Stats
+	readOnly    string // set by commands that may not write to Secret Manager, like diff
 }
 
 // RenderConfigYAML is the same as RenderCommand but easily parsable
@@ -246,6 +333,7 @@ type RenderConfigYAML struct {
 	Dir       *string             `yaml:"dir"`
 	Secrets   []map[string]string `yaml:"secrets"`
 	Namespace *string             `yaml:"namespace"`
+	Pins      []string            `yaml:"pins,omitempty"`
 }
 
 // For testing, repeatably executable
@@ -262,30 +350,29 @@ func parseRenderArgs(args []string) RenderCommand {
 }
 
 // Parse a yaml bytearray into a RenderCommand for easy testing
-func parseConfigFileData(data []byte) RenderCommand {
+func parseConfigFileData(data []byte) (RenderCommand, error) {
 	opts := RenderCommand{}
 	var parsed RenderConfigYAML
 	err := yaml.Unmarshal([]byte(data), &parsed)
 	if err != nil {
-		panic(err)
+		return opts, handlers.ConfigError{Err: err}
 	}
 	opts.Name = valueOrEmpty(parsed.Name)
 	opts.Prefix = valueOrEmpty(parsed.Prefix)
 	opts.Dir = valueOrEmpty(parsed.Dir)
 	opts.Namespace = valueOrEmpty(parsed.Namespace)
+	opts.Pins = parsed.Pins
 	opts.Handlers = []handlers.ConcreteSecretHandler{}
 	for _, val := range parsed.Secrets {
 		if _, ok := val["type"]; ok {
 			handler, err := handlers.ParseSecretHandler(val)
-			if err == nil {
-				opts.Handlers = append(opts.Handlers, handlers.ConcreteSecretHandler{SecretHandler: handler})
-			} else {
-				panic(err)
+			if err != nil {
+				return opts, err
 			}
-
+			opts.Handlers = append(opts.Handlers, handlers.ConcreteSecretHandler{SecretHandler: handler})
 		}
 	}
-	return opts
+	return opts, nil
 }
 
 func sortedKeys(mp map[string][]byte) (keys []string) {
@@ -316,6 +403,7 @@ type secretYAML struct {
 	APIVersion string             `yaml:"apiVersion"`
 	Metadata   secretYAMLMetadata `yaml:"metadata"`
 	Type       string             `yaml:"type"`
+	StringData map[string]string  `yaml:"stringData,omitempty"`
 }
 
 type secretYAMLMetadata struct {
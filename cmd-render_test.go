@@ -1,9 +1,19 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Q42/gcp-sema/pkg/handlers"
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/Q42/gcp-sema/pkg/secretmanager/diskcache"
+	"github.com/Q42/gcp-sema/pkg/secretmanager/memoize"
+	"github.com/Q42/gcp-sema/pkg/secretmanager/retry"
+	"github.com/Q42/gcp-sema/pkg/secretmanager/singleflight"
 	flags "github.com/jessevdk/go-flags"
 	"github.com/stretchr/testify/assert"
 )
@@ -75,7 +85,8 @@ func TestParseRenderArgs(t *testing.T) {
 func TestRenderLiteral(t *testing.T) {
 	obj := make(map[string][]byte)
 	args := parseRenderArgs([]string{"my-project", "--format=env", "-s literal=text.txt=foobar"})
-	args.Handlers[0].Populate(obj)
+	err := args.Handlers[0].Populate(context.Background(), obj)
+	assert.NoError(t, err)
 	assert.Equal(t, []byte("foobar"), obj["text.txt"], "Literal SecretHandler should work")
 }
 
@@ -100,7 +111,8 @@ secrets:
   schema: "server/config-schema.json"
   type: sema-schema-to-file`
 
-	parsedConfig := parseConfigFileData([]byte(config))
+	parsedConfig, err := parseConfigFileData([]byte(config))
+	assert.NoError(t, err)
 	expected := RenderCommand{
 		Name:   "myapp1-v4",
 		Prefix: "myapp1_v4",
@@ -122,7 +134,8 @@ secrets:
   schema: "server/config-schema.json"
   type: sema-schema-to-file`
 
-	parsedConfig := parseConfigFileData([]byte(config))
+	parsedConfig, err := parseConfigFileData([]byte(config))
+	assert.NoError(t, err)
 	expected := RenderCommand{
 		Name:      "myapp1-v4",
 		Prefix:    "myapp1_v4",
@@ -170,7 +183,8 @@ secrets:
 
 	cmd, err := p.AddCommand("render", renderDescription, renderDescriptionLong, &opts)
 	panicIfErr(err)
-	parsedConfig := parseConfigFileData([]byte(config))
+	parsedConfig, err := parseConfigFileData([]byte(config))
+	assert.NoError(t, err)
 	_, _ = p.ParseArgs(args)
 
 	opts.mergeCommandOptions(cmd, parsedConfig)
@@ -200,3 +214,166 @@ func makeSecretWrapper(handler string, name string, value string) handlers.Secre
 	panicIfErr(err)
 	return secretHandler
 }
+
+// concurrencyClient counts the value retrievals and how many of them run at the same time
+type concurrencyClient struct {
+	secretmanager.KVClient
+	active, maxActive, total int32
+}
+
+func (c *concurrencyClient) Get(ctx context.Context, name string) (secretmanager.KVValue, error) {
+	v, err := c.KVClient.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &concurrencyValue{KVValue: v, client: c}, nil
+}
+
+type concurrencyValue struct {
+	secretmanager.KVValue
+	client *concurrencyClient
+}
+
+func (v *concurrencyValue) GetValue(ctx context.Context) ([]byte, error) {
+	active := atomic.AddInt32(&v.client.active, 1)
+	defer atomic.AddInt32(&v.client.active, -1)
+	atomic.AddInt32(&v.client.total, 1)
+	for {
+		max := atomic.LoadInt32(&v.client.maxActive)
+		if active <= max || atomic.CompareAndSwapInt32(&v.client.maxActive, max, active) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return v.KVValue.GetValue(ctx)
+}
+
+func TestRenderPrefetch(t *testing.T) {
+	ctx := context.Background()
+	keyValues := []string{}
+	opts := RenderCommand{Concurrency: 3}
+	for i := 0; i < 10; i++ {
+		keyValues = append(keyValues, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		h, err := handlers.MakeSecretHandler("sema-literal", fmt.Sprintf("KEY%d", i), fmt.Sprintf("key%d", i))
+		assert.NoError(t, err)
+		opts.Handlers = append(opts.Handlers, handlers.ConcreteSecretHandler{SecretHandler: h})
+	}
+	// The same key twice is retrieved once
+	h, _ := handlers.MakeSecretHandler("sema-literal", "DUPLICATE", "key0")
+	opts.Handlers = append(opts.Handlers, handlers.ConcreteSecretHandler{SecretHandler: h})
+
+	client := &concurrencyClient{KVClient: secretmanager.NewInMemoryClient("my-project", keyValues...)}
+	handlers.InjectSemaClient(opts.Handlers, memoize.New(singleflight.New(client)), handlers.SecretHandlerOptions{})
+	for _, h := range opts.Handlers {
+		assert.NoError(t, h.Prepare(ctx, map[string]bool{}))
+	}
+
+	data, err := opts.populate(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, data, 11)
+	assert.Equal(t, "value7", string(data["KEY7"]))
+	assert.Equal(t, "value0", string(data["DUPLICATE"]))
+	assert.EqualValues(t, 10, client.total, "every value should be retrieved once")
+	assert.LessOrEqual(t, client.maxActive, int32(3), "should respect --concurrency")
+	assert.Greater(t, client.maxActive, int32(1), "should retrieve concurrently")
+}
+
+func TestRenderPrefetchBatch(t *testing.T) {
+	ctx := context.Background()
+	keyValues := []string{}
+	opts := RenderCommand{}
+	for i := 0; i < 10; i++ {
+		keyValues = append(keyValues, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		h, err := handlers.MakeSecretHandler("sema-literal", fmt.Sprintf("KEY%d", i), fmt.Sprintf("key%d", i))
+		assert.NoError(t, err)
+		opts.Handlers = append(opts.Handlers, handlers.ConcreteSecretHandler{SecretHandler: h})
+	}
+	proxy := &proxyCommand{prepareClient: func(projectID string) (secretmanager.KVClient, error) {
+		return secretmanager.NewInMemoryClient(projectID, keyValues...), nil
+	}}
+	handler, count := countRequests(proxy.handler())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client, err := NewProxyClient(server.URL, "my-project")
+	assert.NoError(t, err)
+	handlers.InjectSemaClient(opts.Handlers, memoize.New(singleflight.New(client)), handlers.SecretHandlerOptions{})
+	for _, h := range opts.Handlers {
+		assert.NoError(t, h.Prepare(ctx, map[string]bool{}))
+	}
+
+	data, err := opts.populate(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, data, 10)
+	assert.Equal(t, "value7", string(data["KEY7"]))
+	assert.Equal(t, 1, count("/batch"), "values are retrieved in a single batch")
+	assert.Equal(t, 0, count("/get"))
+}
+
+func TestRenderPrefetchBatchDiskCache(t *testing.T) {
+	ctx := context.Background()
+	keyValues := []string{}
+	for i := 0; i < 10; i++ {
+		keyValues = append(keyValues, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	proxy := &proxyCommand{prepareClient: func(projectID string) (secretmanager.KVClient, error) {
+		return secretmanager.NewInMemoryClient(projectID, keyValues...), nil
+	}}
+	handler, count := countRequests(proxy.handler())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	key, err := diskcache.ParseKey("0123456789abcdef0123456789abcdef")
+	assert.NoError(t, err)
+	dir := t.TempDir()
+
+	// Every run is a new process using the same --cache-dir, the last run has 5 more secrets
+	for _, run := range []struct{ secrets, batches int }{{5, 1}, {5, 1}, {10, 2}} {
+		opts := RenderCommand{}
+		for i := 0; i < run.secrets; i++ {
+			h, err := handlers.MakeSecretHandler("sema-literal", fmt.Sprintf("KEY%d", i), fmt.Sprintf("key%d", i))
+			assert.NoError(t, err)
+			opts.Handlers = append(opts.Handlers, handlers.ConcreteSecretHandler{SecretHandler: h})
+		}
+		client, err := NewProxyClient(server.URL, "my-project")
+		assert.NoError(t, err)
+		cache, err := diskcache.New(client, "my-project", diskcache.Options{Dir: dir, Key: key})
+		assert.NoError(t, err)
+		handlers.InjectSemaClient(opts.Handlers, memoize.New(singleflight.New(cache.Batch())), handlers.SecretHandlerOptions{})
+		for _, h := range opts.Handlers {
+			assert.NoError(t, h.Prepare(ctx, map[string]bool{}))
+		}
+
+		data, err := opts.populate(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, data, run.secrets)
+		assert.Equal(t, "value3", string(data["KEY3"]))
+		assert.Equal(t, run.batches, count("/batch"), "the values that are not cached are retrieved in a single batch")
+		assert.Equal(t, 0, count("/get"))
+	}
+}
+
+func TestRenderPopulateReportsAllErrors(t *testing.T) {
+	ctx := context.Background()
+	opts := RenderCommand{}
+	for _, args := range [][]string{
+		{"sema-literal", "PINNED", "password@9"},
+		{"sema-json-field", "FIELD", "password#/field"},
+		{"literal", "LITERAL", "value"},
+	} {
+		h, err := handlers.MakeSecretHandler(args[0], args[1], args[2])
+		assert.NoError(t, err)
+		opts.Handlers = append(opts.Handlers, handlers.ConcreteSecretHandler{SecretHandler: h})
+	}
+	client := retry.New(secretmanager.NewInMemoryClient("my-project", "password", "not json"), retry.Options{})
+	handlers.InjectSemaClient(opts.Handlers, memoize.New(client), handlers.SecretHandlerOptions{})
+	for _, h := range opts.Handlers {
+		assert.NoError(t, h.Prepare(ctx, map[string]bool{}))
+	}
+
+	_, err := opts.populate(ctx)
+	assert.EqualError(t, err, `Multiple errors:
+- sema-literal "PINNED": Secret "password" version "9": version not found
+- sema-json-field "FIELD": password#/field: value is not JSON: invalid character 'o' in literal null (expecting 'u')`, "each error once, in order")
+	// Two secret lookups and two values: the failed version is not retrieved again by the handler
+	assert.Equal(t, retry.Stats{Requests: 4, Failures: 1}, client.Stats())
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Q42/gcp-sema/pkg/handlers"
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+)
+
+func init() {
+	parser.AddCommand("versions", "List the versions of a secret in Secret Manager", "Use the version numbers to pin a secret, like: sema get [project] [name]@[version]", &versionsCommand{})
+}
+
+type versionsCommandPositional struct {
+	Project string `required:"yes" description:"Google Cloud project" positional-arg-name:"project"`
+	Name    string `required:"yes" description:"Name of secret key, a version like mysecretkey@7 is ignored" positional-arg-name:"name"`
+}
+
+type versionsCommand struct {
+	Positional versionsCommandPositional `positional-args:"yes"`
+	Timeout    time.Duration             `long:"timeout" description:"Abort when Secret Manager has not responded within this duration (example: 30s)"`
+	// private
+	client secretmanager.KVClient
+}
+
+func (opts *versionsCommand) Execute(args []string) (err error) {
+	if opts.client == nil {
+		if opts.client, err = prepareSemaClient(opts.Positional.Project); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := commandContext(opts.Timeout)
+	defer cancel()
+
+	name, _ := handlers.ParseSemaKey(opts.Positional.Name)
+	secret, err := opts.client.Get(ctx, name)
+	if err != nil {
+		return abortedError(ctx, err)
+	}
+	versions, err := secret.ListVersions(ctx)
+	if err != nil {
+		return abortedError(ctx, err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tSTATE\tCREATED")
+	for _, v := range versions {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", v.Version, v.State, v.CreateTime.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
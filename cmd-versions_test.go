@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionsIgnoresVersion(t *testing.T) {
+	kv := secretmanager.NewInMemoryClient("cl-test", "foo", "bar")
+	for _, name := range []string{"foo", "foo@7"} {
+		cmdOpts := versionsCommand{Positional: versionsCommandPositional{"cl-test", name}, client: kv}
+		assert.NoError(t, cmdOpts.Execute(nil), name)
+	}
+	cmdOpts := versionsCommand{Positional: versionsCommandPositional{"cl-test", "missing@7"}, client: kv}
+	assert.Equal(t, exitNotFound, exitCode(cmdOpts.Execute(nil)))
+}
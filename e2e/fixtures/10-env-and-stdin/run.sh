@@ -0,0 +1,7 @@
+export OFFLINE=sema.env
+export CI_DB_PASSWORD=from-ci
+printf 'from-stdin' | gcp-sema render dummy --format=yaml-stringdata \
+  --secrets sema-literal=API_KEY=API_KEY \
+  --secrets env=DB_PASSWORD=CI_DB_PASSWORD \
+  --secrets env=SENTRY_DSN=CI_SENTRY_DSN,optional \
+  --secrets stdin=CERTIFICATE
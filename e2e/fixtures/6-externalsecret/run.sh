@@ -0,0 +1,2 @@
+export OFFLINE=sema.env
+gcp-sema render dummy --format=externalsecret --secrets literal=static.txt=value --secrets sema-literal=MY_SECRET=myapp_secret
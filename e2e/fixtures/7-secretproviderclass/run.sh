@@ -0,0 +1,2 @@
+export OFFLINE=sema.env
+gcp-sema render dummy --format=secretproviderclass --secrets sema-literal=test.txt=key
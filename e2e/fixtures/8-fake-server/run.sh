@@ -0,0 +1,8 @@
+endpoint=$(mktemp)
+# Port 0 picks a free port, the fake server prints its address on stdout
+gcp-sema fake-server my-project --address 127.0.0.1:0 --seed sema.env >"$endpoint" 2>/dev/null &
+trap "kill $!; rm -f $endpoint" EXIT
+for i in $(seq 50); do [ -s "$endpoint" ] && break; sleep 0.1; done
+export SEMA_ENDPOINT=$(cat "$endpoint")
+printf 'new-value' | gcp-sema add my-project key --force
+gcp-sema render my-project --format env --secrets sema-literal=test.txt=key --secrets sema-literal=old.txt=key@1
@@ -0,0 +1,3 @@
+export OFFLINE=sema.env
+export DB_HOST=db.internal
+gcp-sema render dummy --format=yaml-stringdata --secrets template=app.conf=app.conf.tmpl
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/Q42/gcp-sema/pkg/handlers"
+	"github.com/Q42/gcp-sema/pkg/multierror"
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	flags "github.com/jessevdk/go-flags"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Exit codes, see the table in README.md. Scripts rely on these, so do not renumber them.
+const (
+	exitOK               = 0
+	exitFailure          = 1   // any other error
+	exitConfig           = 2   // invalid flags, config file, schema or handler definition
+	exitNotFound         = 3   // a secret, version or file does not exist
+	exitPermissionDenied = 4   // missing or insufficient credentials
+	exitNetwork          = 5   // Secret Manager or the proxy is unreachable, or --timeout expired
+	exitDifferences      = 6   // sema diff found differences
+	exitInterrupted      = 130 // Ctrl-C or SIGTERM
+)
+
+var exitCodeKinds = map[int]string{
+	exitOK:               "ok",
+	exitFailure:          "failure",
+	exitConfig:           "config",
+	exitNotFound:         "not-found",
+	exitPermissionDenied: "permission-denied",
+	exitNetwork:          "network",
+	exitDifferences:      "differences",
+	exitInterrupted:      "interrupted",
+}
+
+// credentialsError is returned when no Secret Manager client can be created, which is nearly always missing credentials
+type credentialsError struct {
+	err error
+}
+
+func (e credentialsError) Error() string {
+	return fmt.Sprintf("%s (run 'gcloud auth application-default login' or set GOOGLE_APPLICATION_CREDENTIALS)", e.err.Error())
+}
+
+func (e credentialsError) Unwrap() error {
+	return e.err
+}
+
+// differencesError is returned by diff when it completed and found differences, so CI can tell it apart from a failed diff
+type differencesError struct {
+	count   int
+	against string
+}
+
+func (e differencesError) Error() string {
+	return fmt.Sprintf("%d difference(s) with %q", e.count, e.against)
+}
+
+// exitCode classifies err. Multiple errors only get a specific exit code if they all agree.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var multi multierror.MultiError
+	if errors.As(err, &multi) {
+		code := exitCode(multi.Errors[0])
+		for _, e := range multi.Errors[1:] {
+			if exitCode(e) != code {
+				return exitFailure
+			}
+		}
+		return code
+	}
+
+	var flagsErr *flags.Error
+	var configErr handlers.ConfigError
+	var credentialsErr credentialsError
+	var netErr net.Error
+	var proxyErr proxyStatusError
+	var differencesErr differencesError
+	switch {
+	case errors.As(err, &differencesErr):
+		return exitDifferences
+	case errors.As(err, &flagsErr), errors.As(err, &configErr):
+		return exitConfig
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, context.DeadlineExceeded):
+		return exitNetwork
+	case secretmanager.IsNotFound(err), errors.Is(err, os.ErrNotExist):
+		return exitNotFound
+	case errors.As(err, &credentialsErr), errors.Is(err, os.ErrPermission):
+		return exitPermissionDenied
+	case errors.As(err, &proxyErr) && (proxyErr.StatusCode == 401 || proxyErr.StatusCode == 403):
+		return exitPermissionDenied
+	}
+
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		switch grpcErr.GRPCStatus().Code() {
+		case codes.PermissionDenied, codes.Unauthenticated:
+			return exitPermissionDenied
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return exitNetwork
+		case codes.Canceled:
+			return exitInterrupted
+		}
+	}
+	if errors.As(err, &netErr) {
+		return exitNetwork
+	}
+	return exitFailure
+}
+
+type jsonError struct {
+	Error    string   `json:"error"`
+	Kind     string   `json:"kind"`
+	ExitCode int      `json:"exitCode"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// printError writes err to w, as plain text or as a single line of JSON (--error-format=json)
+func printError(w io.Writer, err error, format string) {
+	if format != "json" {
+		fmt.Fprintln(w, err)
+		return
+	}
+	code := exitCode(err)
+	output := jsonError{Error: err.Error(), Kind: exitCodeKinds[code], ExitCode: code}
+	var multi multierror.MultiError
+	if errors.As(err, &multi) {
+		for _, e := range multi.Errors {
+			output.Errors = append(output.Errors, e.Error())
+		}
+	}
+	jsonData, _ := json.Marshal(output)
+	fmt.Fprintln(w, string(jsonData))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/Q42/gcp-sema/pkg/handlers"
+	"github.com/Q42/gcp-sema/pkg/multierror"
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestExitCode(t *testing.T) {
+	_, notFound := secretmanager.NewInMemoryClient("my-project").Get(context.Background(), "missing")
+
+	assert.Equal(t, exitOK, exitCode(nil))
+	assert.Equal(t, exitFailure, exitCode(errors.New("something")))
+	assert.Equal(t, exitConfig, exitCode(pkgerrors.Wrap(handlers.ConfigErrorf("invalid"), "config file")))
+	assert.Equal(t, exitNotFound, exitCode(notFound))
+	assert.Equal(t, exitNotFound, exitCode(status.Error(codes.NotFound, "not found")))
+	assert.Equal(t, exitNotFound, exitCode(&os.PathError{Op: "open", Path: "config-schema.json", Err: os.ErrNotExist}))
+	assert.Equal(t, exitPermissionDenied, exitCode(pkgerrors.Wrap(status.Error(codes.PermissionDenied, "denied"), "sema-literal")))
+	assert.Equal(t, exitPermissionDenied, exitCode(credentialsError{errors.New("could not find default credentials")}))
+	assert.Equal(t, exitNetwork, exitCode(status.Error(codes.Unavailable, "unavailable")))
+	assert.Equal(t, exitNetwork, exitCode(pkgerrors.Wrap(context.DeadlineExceeded, "aborted")))
+	assert.Equal(t, exitInterrupted, exitCode(pkgerrors.Wrap(context.Canceled, "aborted")))
+	assert.Equal(t, exitDifferences, exitCode(differencesError{count: 1, against: "-"}))
+
+	// Multiple errors only get a specific code when they agree
+	assert.Equal(t, exitNotFound, exitCode(multierror.MultiAppend(notFound, notFound)))
+	assert.Equal(t, exitFailure, exitCode(multierror.MultiAppend(notFound, handlers.ConfigErrorf("invalid"))))
+}
+
+func TestPrintErrorJSON(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	printError(out, multierror.MultiAppend(status.Error(codes.NotFound, "a"), status.Error(codes.NotFound, "b")), "json")
+
+	var result jsonError
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &result))
+	assert.Equal(t, "not-found", result.Kind)
+	assert.Equal(t, exitNotFound, result.ExitCode)
+	assert.Len(t, result.Errors, 2)
+	assert.Equal(t, 1, bytes.Count(out.Bytes(), []byte("\n")), "should be a single line")
+
+	out.Reset()
+	printError(out, errors.New("plain"), "text")
+	assert.Equal(t, "plain\n", out.String())
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Q42/gcp-sema/pkg/handlers"
+	"gopkg.in/yaml.v3"
+)
+
+// This file defines all output formats `--format=[format]`
+
+// Formatter writes the rendered secret in a specific output format
+type Formatter interface {
+	Format(w io.Writer, input FormatInput) error
+}
+
+// FormatInput is what the handlers produced. Data is only retrieved when calling Data(),
+// so formats that do not need the values never access them. References is the alternative
+// for formats that let a secret operator retrieve the values.
+type FormatInput struct {
+	Name            string
+	Namespace       string
+	Dir             string
+	Verbose         bool
+	Fields          map[string]bool
+	Annotations     map[string]string
+	SecretStore     string
+	SecretStoreKind string
+	Data            func() (map[string][]byte, error)
+	References      func() ([]handlers.Reference, error)
+}
+
+// FormatterFunc allows using a plain function as Formatter
+type FormatterFunc func(w io.Writer, input FormatInput) error
+
+// Format -
+func (f FormatterFunc) Format(w io.Writer, input FormatInput) error {
+	return f(w, input)
+}
+
+// FormatRegistry stores Formatters
+var FormatRegistry map[string]Formatter = map[string]Formatter{
+	"yaml":            FormatterFunc(formatYAML),
+	"yaml-stringdata": FormatterFunc(formatYAMLStringData),
+	"env":             FormatterFunc(formatEnv),
+	"files":           FormatterFunc(formatFiles),
+	"json":            FormatterFunc(formatJSON),
+	"shell":           FormatterFunc(formatShell),
+	"docker-compose":  FormatterFunc(formatDockerCompose),
+	// formats_references.go
+	"externalsecret":      FormatterFunc(formatExternalSecret),
+	"secretproviderclass": FormatterFunc(formatSecretProviderClass),
+}
+
+// formatNames lists all registered formats, sorted
+func formatNames() (names []string) {
+	for name := range FormatRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func secretYAMLHeader(input FormatInput) secretYAML {
+	input.Annotations["info/generated-by"] = "github.com/q42/gcp-sema"
+	return secretYAML{
+		Kind:       "Secret",
+		APIVersion: "v1",
+		Type:       "Opaque",
+		Metadata: secretYAMLMetadata{
+			Name:        input.Name,
+			Namespace:   input.Namespace,
+			Annotations: input.Annotations,
+		},
+	}
+}
+
+// formatYAML is a fully specified Kubernetes secret
+func formatYAML(w io.Writer, input FormatInput) error {
+	yml, err := yaml.Marshal(secretYAMLHeader(input))
+	if err != nil {
+		return err
+	}
+	data, err := input.Data()
+	if err != nil {
+		return err
+	}
+	w.Write(yml)
+	// Write 'data' separately to unify writing in the different formats
+	io.WriteString(w, "data:\n")
+	for _, key := range sortedKeys(data) {
+		fmt.Fprintf(w, "  %s: %s\n", key, base64.StdEncoding.EncodeToString(data[key]))
+	}
+	return nil
+}
+
+// formatYAMLStringData is a Kubernetes secret with readable values, for review
+func formatYAMLStringData(w io.Writer, input FormatInput) error {
+	data, err := input.Data()
+	if err != nil {
+		return err
+	}
+	secret := secretYAMLHeader(input)
+	secret.StringData = make(map[string]string)
+	for key, value := range data {
+		secret.StringData[key] = string(value)
+	}
+	yml, err := yaml.Marshal(secret)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(yml)
+	return err
+}
+
+// formatEnv is a *.env file format that can be used for Docker (Compose)
+func formatEnv(w io.Writer, input FormatInput) error {
+	data, err := input.Data()
+	if err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(data) {
+		fmt.Fprintf(w, "%s=%q\n", key, string(data[key]))
+	}
+	return nil
+}
+
+// formatFiles writes files per secret in the secrets folder
+func formatFiles(w io.Writer, input FormatInput) error {
+	for _, file := range sortedKeysB(input.Fields) {
+		log.Printf("Preparing to write %q", file)
+	}
+	log.Println("Downloading from key-value sources (use --verbose to preview which)...")
+	if input.Verbose {
+		for _, v := range input.Annotations {
+			log.Printf("Source %q", v)
+		}
+	}
+	data, err := input.Data()
+	if err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(data) {
+		if err := writeDevSecretFile(input.Dir, key, data[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatJSON is a plain JSON object
+func formatJSON(w io.Writer, input FormatInput) error {
+	data, err := input.Data()
+	if err != nil {
+		return err
+	}
+	object := make(map[string]string)
+	for key, value := range data {
+		object[key] = string(value)
+	}
+	jsonData, err := json.MarshalIndent(object, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(jsonData))
+	return err
+}
+
+var shellIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// formatShell can be sourced safely: eval "$(sema render my-project --format=shell)"
+func formatShell(w io.Writer, input FormatInput) error {
+	data, err := input.Data()
+	if err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(data) {
+		if !shellIdentifier.MatchString(key) {
+			return handlers.ConfigErrorf("Key %q is not a valid shell variable name", key)
+		}
+	}
+	for _, key := range sortedKeys(data) {
+		fmt.Fprintf(w, "export %s=%s\n", key, shellQuote(string(data[key])))
+	}
+	return nil
+}
+
+// shellQuote uses single quotes, in which nothing is interpreted except the closing quote itself
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+type composeSecrets struct {
+	Secrets map[string]composeSecretFile `yaml:"secrets"`
+}
+
+type composeSecretFile struct {
+	File string `yaml:"file"`
+}
+
+// formatDockerCompose refers to the files written by --format=files, so it does not need the values
+func formatDockerCompose(w io.Writer, input FormatInput) error {
+	compose := composeSecrets{Secrets: make(map[string]composeSecretFile)}
+	for key := range input.Fields {
+		file := filepath.ToSlash(filepath.Join(input.Dir, key))
+		if !filepath.IsAbs(file) && !strings.HasPrefix(file, ".") {
+			file = "./" + file
+		}
+		compose.Secrets[key] = composeSecretFile{File: file}
+	}
+	yml, err := yaml.Marshal(compose)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(yml)
+	return err
+}
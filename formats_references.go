@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Q42/gcp-sema/pkg/handlers"
+	"gopkg.in/yaml.v3"
+)
+
+// This file defines the reference-only formats: the manifests refer to Secret Manager
+// and a secret operator in the cluster retrieves the values, so they never pass through sema.
+
+type externalSecretYAML struct {
+	APIVersion string             `yaml:"apiVersion"`
+	Kind       string             `yaml:"kind"`
+	Metadata   secretYAMLMetadata `yaml:"metadata"`
+	Spec       externalSecretSpec `yaml:"spec"`
+}
+
+type externalSecretSpec struct {
+	RefreshInterval string                    `yaml:"refreshInterval"`
+	SecretStoreRef  externalSecretStoreRef    `yaml:"secretStoreRef"`
+	Target          externalSecretTarget      `yaml:"target"`
+	Data            []externalSecretDataEntry `yaml:"data"`
+}
+
+type externalSecretStoreRef struct {
+	Name string `yaml:"name"`
+	Kind string `yaml:"kind"`
+}
+
+type externalSecretTarget struct {
+	Name     string                  `yaml:"name"`
+	Template *externalSecretTemplate `yaml:"template,omitempty"`
+}
+
+type externalSecretTemplate struct {
+	EngineVersion string            `yaml:"engineVersion"`
+	Data          map[string]string `yaml:"data"`
+}
+
+type externalSecretDataEntry struct {
+	SecretKey string                  `yaml:"secretKey"`
+	RemoteRef externalSecretRemoteRef `yaml:"remoteRef"`
+}
+
+type externalSecretRemoteRef struct {
+	Key     string `yaml:"key"`
+	Version string `yaml:"version,omitempty"`
+}
+
+// formatExternalSecret is an External Secrets Operator manifest. Keys that are not a plain
+// Secret Manager value (like sema-schema-to-file) are rendered using the operator's templating.
+func formatExternalSecret(w io.Writer, input FormatInput) error {
+	refs, err := input.References()
+	if err != nil {
+		return err
+	}
+	sources, err := uniqueReferenceSources(refs)
+	if err != nil {
+		return err
+	}
+
+	header := secretYAMLHeader(input)
+	manifest := externalSecretYAML{
+		APIVersion: "external-secrets.io/v1beta1",
+		Kind:       "ExternalSecret",
+		Metadata:   header.Metadata,
+		Spec: externalSecretSpec{
+			RefreshInterval: "1h",
+			SecretStoreRef:  externalSecretStoreRef{Name: valueOrDefault(input.SecretStore, "secret-manager"), Kind: valueOrDefault(input.SecretStoreKind, "ClusterSecretStore")},
+			Target:          externalSecretTarget{Name: input.Name},
+			Data:            []externalSecretDataEntry{},
+		},
+	}
+	for _, source := range sources {
+		manifest.Spec.Data = append(manifest.Spec.Data, externalSecretDataEntry{
+			SecretKey: source.Name,
+			RemoteRef: externalSecretRemoteRef{Key: source.FullName, Version: source.Version},
+		})
+	}
+
+	// As soon as a template is used the operator only writes the templated keys, so then all keys need to be templated
+	for _, ref := range refs {
+		if !isDirectReference(ref) {
+			manifest.Spec.Target.Template = &externalSecretTemplate{EngineVersion: "v2", Data: make(map[string]string)}
+			break
+		}
+	}
+	if manifest.Spec.Target.Template != nil {
+		for _, ref := range refs {
+			if isDirectReference(ref) {
+				manifest.Spec.Target.Template.Data[ref.Key] = handlers.TemplateSourceValue(ref.Sources[0], "")
+			} else {
+				manifest.Spec.Target.Template.Data[ref.Key] = ref.Template
+			}
+		}
+	}
+
+	yml, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(yml)
+	return err
+}
+
+type secretProviderClassYAML struct {
+	APIVersion string                  `yaml:"apiVersion"`
+	Kind       string                  `yaml:"kind"`
+	Metadata   secretYAMLMetadata      `yaml:"metadata"`
+	Spec       secretProviderClassSpec `yaml:"spec"`
+}
+
+type secretProviderClassSpec struct {
+	Provider      string                          `yaml:"provider"`
+	Parameters    map[string]string               `yaml:"parameters"`
+	SecretObjects []secretProviderClassSecretSync `yaml:"secretObjects"`
+}
+
+type secretProviderClassSecretSync struct {
+	SecretName string                          `yaml:"secretName"`
+	Type       string                          `yaml:"type"`
+	Data       []secretProviderClassSecretData `yaml:"data"`
+}
+
+type secretProviderClassSecretData struct {
+	ObjectName string `yaml:"objectName"`
+	Key        string `yaml:"key"`
+}
+
+type secretProviderClassSecret struct {
+	ResourceName string `yaml:"resourceName"`
+	Path         string `yaml:"path"`
+}
+
+// formatSecretProviderClass is a Secrets Store CSI driver manifest for the GCP provider.
+// The driver mounts every key as file and syncs them to a Kubernetes secret. It has no templating,
+// so only handlers that refer to a single Secret Manager value are supported.
+func formatSecretProviderClass(w io.Writer, input FormatInput) error {
+	refs, err := input.References()
+	if err != nil {
+		return err
+	}
+
+	header := secretYAMLHeader(input)
+	manifest := secretProviderClassYAML{
+		APIVersion: "secrets-store.csi.x-k8s.io/v1",
+		Kind:       "SecretProviderClass",
+		Metadata:   header.Metadata,
+		Spec: secretProviderClassSpec{
+			Provider:      "gcp",
+			SecretObjects: []secretProviderClassSecretSync{{SecretName: input.Name, Type: "Opaque", Data: []secretProviderClassSecretData{}}},
+		},
+	}
+	secrets := []secretProviderClassSecret{}
+	sort.SliceStable(refs, func(i, j int) bool { return refs[i].Key < refs[j].Key })
+	for _, ref := range refs {
+		if !isDirectReference(ref) {
+			return fmt.Errorf("Key %q cannot be rendered as SecretProviderClass, because it is not a single Secret Manager value (use --format=externalsecret)", ref.Key)
+		}
+		version := valueOrDefault(ref.Sources[0].Version, "latest")
+		secrets = append(secrets, secretProviderClassSecret{ResourceName: fmt.Sprintf("%s/versions/%s", ref.Sources[0].FullName, version), Path: ref.Key})
+		manifest.Spec.SecretObjects[0].Data = append(manifest.Spec.SecretObjects[0].Data, secretProviderClassSecretData{ObjectName: ref.Key, Key: ref.Key})
+	}
+	// The GCP provider expects the list of secrets as a YAML string
+	secretsYAML, err := yaml.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	manifest.Spec.Parameters = map[string]string{"secrets": string(secretsYAML)}
+
+	yml, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(yml)
+	return err
+}
+
+// isDirectReference is a reference that is the exact value of a single Secret Manager secret
+func isDirectReference(ref handlers.Reference) bool {
+	return ref.Template == "" && len(ref.Sources) == 1
+}
+
+// uniqueReferenceSources lists the sources of all references sorted by name; a name may not refer to different secrets
+func uniqueReferenceSources(refs []handlers.Reference) ([]handlers.ReferenceSource, error) {
+	byName := make(map[string]handlers.ReferenceSource)
+	names := []string{}
+	for _, ref := range refs {
+		for _, source := range ref.Sources {
+			if existing, isDuplicate := byName[source.Name]; isDuplicate {
+				if existing != source {
+					return nil, fmt.Errorf("Name %q refers to both %q and %q", source.Name, existing.FullName, source.FullName)
+				}
+				continue
+			}
+			byName[source.Name] = source
+			names = append(names, source.Name)
+		}
+	}
+	sort.Strings(names)
+	result := make([]handlers.ReferenceSource, 0, len(names))
+	for _, name := range names {
+		result = append(result, byName[name])
+	}
+	return result, nil
+}
+
+func valueOrDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
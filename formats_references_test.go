@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Q42/gcp-sema/pkg/handlers"
+	"github.com/stretchr/testify/assert"
+)
+
+func referencesTestInput(refs ...handlers.Reference) FormatInput {
+	input := formatTestInput(nil)
+	input.Data = func() (map[string][]byte, error) { panic("reference formats should not retrieve values") }
+	input.References = func() ([]handlers.Reference, error) { return refs, nil }
+	return input
+}
+
+var testSource = handlers.ReferenceSource{Name: "DB_PASSWORD", FullName: "projects/p/secrets/db-password", Version: "3"}
+
+func TestFormatExternalSecret(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	err := FormatRegistry["externalsecret"].Format(out, referencesTestInput(handlers.Reference{Key: "DB_PASSWORD", Sources: []handlers.ReferenceSource{testSource}}))
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "kind: ExternalSecret")
+	assert.Contains(t, out.String(), "key: projects/p/secrets/db-password\n")
+	assert.Contains(t, out.String(), "version: \"3\"\n")
+	assert.NotContains(t, out.String(), "template:", "direct references do not need templating")
+}
+
+func TestFormatExternalSecretTemplate(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	err := FormatRegistry["externalsecret"].Format(out, referencesTestInput(
+		handlers.Reference{Key: "DB_PASSWORD", Sources: []handlers.ReferenceSource{testSource}},
+		handlers.Reference{Key: "static.txt", Template: handlers.TemplateLiteral("{{ not a template }}")},
+	))
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "DB_PASSWORD: '{{ .DB_PASSWORD }}'")
+	assert.Contains(t, out.String(), `static.txt: '{{"{{"}} not a template }}'`)
+}
+
+func TestFormatExternalSecretConflictingSources(t *testing.T) {
+	other := testSource
+	other.FullName = "projects/p/secrets/other"
+	err := FormatRegistry["externalsecret"].Format(bytes.NewBuffer(nil), referencesTestInput(
+		handlers.Reference{Key: "a", Sources: []handlers.ReferenceSource{testSource}},
+		handlers.Reference{Key: "b", Sources: []handlers.ReferenceSource{other}},
+	))
+	assert.Error(t, err)
+}
+
+func TestFormatSecretProviderClass(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	err := FormatRegistry["secretproviderclass"].Format(out, referencesTestInput(handlers.Reference{Key: "DB_PASSWORD", Sources: []handlers.ReferenceSource{testSource}}))
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "resourceName: projects/p/secrets/db-password/versions/3")
+
+	err = FormatRegistry["secretproviderclass"].Format(out, referencesTestInput(handlers.Reference{Key: "static.txt", Template: "value"}))
+	assert.Error(t, err, "templates are not supported by the CSI driver")
+}
+
+func TestTemplateSourceValue(t *testing.T) {
+	assert.Equal(t, "{{ .DB_PASSWORD | toJson }}", handlers.TemplateSourceValue(testSource, "toJson"))
+	assert.Equal(t, `{{ index . "config-env.json" }}`, handlers.TemplateSourceValue(handlers.ReferenceSource{Name: "config-env.json"}, ""))
+}
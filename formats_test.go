@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func formatTestInput(data map[string][]byte) FormatInput {
+	fields := make(map[string]bool)
+	for key := range data {
+		fields[key] = true
+	}
+	return FormatInput{
+		Name:        "my-secret",
+		Dir:         "secrets",
+		Fields:      fields,
+		Annotations: map[string]string{},
+		Data:        func() (map[string][]byte, error) { return data, nil },
+	}
+}
+
+func TestFormatShell(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	err := FormatRegistry["shell"].Format(out, formatTestInput(map[string][]byte{"B": []byte(`it's $HOME`), "A": []byte("x")}))
+	assert.NoError(t, err)
+	assert.Equal(t, "export A='x'\nexport B='it'\\''s $HOME'\n", out.String())
+
+	err = FormatRegistry["shell"].Format(out, formatTestInput(map[string][]byte{"config-env.json": []byte("{}")}))
+	assert.EqualError(t, err, `Key "config-env.json" is not a valid shell variable name`, "should refuse keys that are not shell variables")
+	assert.Equal(t, exitConfig, exitCode(err))
+}
+
+func TestFormatJSON(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	err := FormatRegistry["json"].Format(out, formatTestInput(map[string][]byte{"b": []byte("2"), "a": []byte("1")}))
+	assert.NoError(t, err)
+	assert.Equal(t, "{\n  \"a\": \"1\",\n  \"b\": \"2\"\n}\n", out.String())
+}
+
+func TestFormatYAMLStringData(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	err := FormatRegistry["yaml-stringdata"].Format(out, formatTestInput(map[string][]byte{"a.txt": []byte("line1\nline2")}))
+	assert.NoError(t, err)
+	data, err := parseSecretYAMLData(out.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"a.txt": []byte("line1\nline2")}, data)
+	assert.Contains(t, out.String(), "kind: Secret")
+}
+
+func TestFormatDockerComposeDoesNotNeedValues(t *testing.T) {
+	input := formatTestInput(map[string][]byte{"config-env.json": nil})
+	input.Data = func() (map[string][]byte, error) { panic("should not retrieve values") }
+	out := bytes.NewBuffer(nil)
+	err := FormatRegistry["docker-compose"].Format(out, input)
+	assert.NoError(t, err)
+	assert.Equal(t, "secrets:\n    config-env.json:\n        file: ./secrets/config-env.json\n", out.String())
+}
@@ -3,21 +3,78 @@ package main
 import (
 	// Secret Manager API from Google
 
+	"context"
+	"fmt"
+	"io/ioutil"
 	loglib "log"
 	"os"
+	"time"
 
+	"github.com/Q42/gcp-sema/pkg/handlers"
 	secretmanager "github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/Q42/gcp-sema/pkg/secretmanager/diskcache"
+	"github.com/Q42/gcp-sema/pkg/secretmanager/retry"
 	flags "github.com/jessevdk/go-flags"
+	"google.golang.org/api/option"
 )
 
 var log *loglib.Logger = loglib.New(os.Stderr, "", 0)
-var parser = flags.NewParser(&struct{}{}, flags.Default)
+var globalOpts = &globalOptions{}
 
-func prepareSemaClient(project string) secretmanager.KVClient {
-	// Get Secret Manager client
-	client, err := secretmanager.NewClient(project)
-	panicIfErr(err)
-	return client
+// Errors are printed by main, so they can be formatted according to --error-format
+var parser = flags.NewParser(globalOpts, flags.HelpFlag|flags.PassDoubleDash)
+
+// globalOptions apply to all commands
+type globalOptions struct {
+	ErrorFormat string  `long:"error-format" default:"text" choice:"text" choice:"json" description:"How to print errors: 'json' prints a single line for machine consumption. The exit codes are listed in the README"`
+	MaxAttempts int     `long:"max-attempts" description:"Retry temporary Secret Manager errors until this many attempts were made. Default: 5"`
+	RateLimit   float64 `long:"rate-limit" description:"Maximum number of Secret Manager requests per second. Default: unlimited"`
+	Endpoint    string  `long:"endpoint" env:"SEMA_ENDPOINT" description:"Connect to this Secret Manager API (host:port) without TLS and credentials, for example 'sema fake-server'"`
+}
+
+func prepareSemaClient(project string) (secretmanager.KVClient, error) {
+	return prepareSemaClientAt(project, globalOpts.Endpoint)
+}
+
+// prepareSemaClientAt connects to the Secret Manager API at endpoint, or to Google Cloud if it is empty
+func prepareSemaClientAt(project string, endpoint string) (secretmanager.KVClient, error) {
+	var opts []option.ClientOption
+	if endpoint != "" {
+		opts = secretmanager.WithEndpoint(endpoint)
+	}
+	client, err := secretmanager.NewClient(context.Background(), project, opts...)
+	if err != nil {
+		return nil, credentialsError{err}
+	}
+	return retry.New(client, retry.Options{MaxAttempts: globalOpts.MaxAttempts, RateLimit: globalOpts.RateLimit}), nil
+}
+
+// loadCacheKey reads the key of the cache in dir from keyFile or SEMA_CACHE_KEY
+func loadCacheKey(dir string, keyFile string) ([]byte, error) {
+	material := os.Getenv("SEMA_CACHE_KEY")
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		material = string(data)
+	}
+	if material == "" {
+		return nil, handlers.ConfigErrorf("The cache in %s is encrypted, set SEMA_CACHE_KEY or --cache-key-file (create one using: openssl rand -base64 32)", dir)
+	}
+	key, err := diskcache.ParseKey(material)
+	if err != nil {
+		return nil, handlers.ConfigError{Err: err}
+	}
+	return key, nil
+}
+
+// prepareDiskCache wraps client with an encrypted cache, warning when stale entries are used
+func prepareDiskCache(client secretmanager.KVClient, project string, opts diskcache.Options) (*diskcache.Client, error) {
+	opts.OnStale = func(name string, age time.Duration, err error) {
+		log.Printf("Warning: using %s cached %s ago, because Secret Manager is unavailable: %s", name, age.Round(time.Second), err)
+	}
+	return diskcache.New(client, project, opts)
 }
 
 func main() {
@@ -26,9 +83,10 @@ func main() {
 	if err != nil {
 		flagsErr, ok := err.(*flags.Error)
 		if ok && flagsErr.Type == flags.ErrHelp {
-			os.Exit(0)
-		} else {
-			os.Exit(1)
+			fmt.Println(err)
+			os.Exit(exitOK)
 		}
+		printError(os.Stderr, err, globalOpts.ErrorFormat)
+		os.Exit(exitCode(err))
 	}
 }
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dirHandler emits a key per file of a directory or glob, like kubectl create secret --from-file=dir/:
+//
+//	--secrets dir=./certs
+//	--secrets dir=./certs/*.pem=prefix:tls-,exclude:*-old.pem,max-size:64Ki
+//
+// Options: include and exclude (file name patterns, can be repeated), recursive:true, naming:base (default, the file name)
+// or naming:path (the path relative to the directory, using _ as separator), prefix, max-size (per file) and max-total.
+type dirHandler struct {
+	path      string // directory or glob
+	include   []string
+	exclude   []string
+	recursive bool
+	naming    string
+	prefix    string
+	maxSize   int64
+	maxTotal  int64
+	//private
+	files map[string]string // file path by key
+	data  map[string][]byte
+}
+
+const (
+	dirNamingBase = "base"
+	dirNamingPath = "path"
+	// Kubernetes secrets are limited to 1MiB
+	dirDefaultMaxSize = 1 << 20
+)
+
+var dirOptions = map[string]bool{"include": true, "exclude": true, "recursive": true, "naming": true, "prefix": true, "max-size": true, "max-total": true}
+
+// parseDirOptions parses "include:*.pem,include:*.crt,max-size:64Ki" into a handler config; repeated patterns are joined by comma
+func parseDirOptions(path string, options string) (map[string]string, error) {
+	result := map[string]string{"path": path, "type": "dir"}
+	if options == "" {
+		return result, nil
+	}
+	for _, option := range strings.Split(options, ",") {
+		parts := strings.SplitN(option, ":", 2)
+		if len(parts) != 2 || !dirOptions[parts[0]] {
+			return nil, ConfigErrorf("dir %q: invalid option %q, use include, exclude, recursive, naming, prefix, max-size or max-total like max-size:64Ki", path, option)
+		}
+		if previous, isSet := result[parts[0]]; isSet && (parts[0] == "include" || parts[0] == "exclude") {
+			parts[1] = previous + "," + parts[1]
+		}
+		result[parts[0]] = parts[1]
+	}
+	return result, nil
+}
+
+func makeDirHandler(input map[string]string) (SecretHandler, error) {
+	h := &dirHandler{path: input["path"], naming: input["naming"], prefix: input["prefix"]}
+	if h.naming == "" {
+		h.naming = dirNamingBase
+	}
+	if h.path == "" {
+		return nil, ConfigErrorf("dir needs a directory or glob")
+	}
+	for _, patterns := range []struct {
+		option string
+		target *[]string
+	}{{"include", &h.include}, {"exclude", &h.exclude}} {
+		if input[patterns.option] == "" {
+			continue
+		}
+		for _, pattern := range strings.Split(input[patterns.option], ",") {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, ConfigErrorf("dir %q: %s pattern %q: %s", h.path, patterns.option, pattern, err)
+			}
+			*patterns.target = append(*patterns.target, pattern)
+		}
+	}
+	if input["recursive"] != "" {
+		recursive, err := strconv.ParseBool(input["recursive"])
+		if err != nil {
+			return nil, ConfigErrorf("dir %q: recursive must be true or false", h.path)
+		}
+		h.recursive = recursive
+	}
+	if h.naming != dirNamingBase && h.naming != dirNamingPath {
+		return nil, ConfigErrorf("dir %q: naming must be %s or %s", h.path, dirNamingBase, dirNamingPath)
+	}
+	var err error
+	if h.maxSize, err = parseSize(input["max-size"], dirDefaultMaxSize); err != nil {
+		return nil, ConfigErrorf("dir %q: max-size: %s", h.path, err)
+	}
+	if h.maxTotal, err = parseSize(input["max-total"], dirDefaultMaxSize); err != nil {
+		return nil, ConfigErrorf("dir %q: max-total: %s", h.path, err)
+	}
+	return h, nil
+}
+
+// parseSize parses a size like "512", "64Ki" or "1Mi"
+func parseSize(input string, defaultSize int64) (int64, error) {
+	if input == "" {
+		return defaultSize, nil
+	}
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"Ki": 1 << 10, "Mi": 1 << 20} {
+		if strings.HasSuffix(input, suffix) {
+			input, multiplier = strings.TrimSuffix(input, suffix), m
+		}
+	}
+	size, err := strconv.ParseInt(input, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("%q is not a size like 512, 64Ki or 1Mi", input)
+	}
+	return size * multiplier, nil
+}
+
+func (h *dirHandler) Prepare(ctx context.Context, bucket map[string]bool) error {
+	files, base, err := h.find()
+	if err != nil {
+		return err
+	}
+	h.files = make(map[string]string)
+	h.data = make(map[string][]byte)
+	total := int64(0)
+	for _, file := range files {
+		if !h.matches(filepath.Base(file)) {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if info.Size() > h.maxSize {
+			return ConfigErrorf("dir %q: %s is %d bytes, more than max-size %d", h.path, file, info.Size(), h.maxSize)
+		}
+		if total += info.Size(); total > h.maxTotal {
+			return ConfigErrorf("dir %q: files are more than max-total %d bytes", h.path, h.maxTotal)
+		}
+		key := filepath.Base(file)
+		if h.naming == dirNamingPath {
+			relative, err := filepath.Rel(base, file)
+			if err != nil {
+				return err
+			}
+			key = strings.ReplaceAll(filepath.ToSlash(relative), "/", "_")
+		}
+		key = h.prefix + key
+		if other, isDuplicate := h.files[key]; isDuplicate {
+			return ConfigErrorf("dir %q: %s and %s both are key %q, use naming:path", h.path, other, file, key)
+		}
+		if h.data[key], err = ioutil.ReadFile(file); err != nil {
+			return err
+		}
+		h.files[key] = file
+		bucket[key] = true
+	}
+	if len(h.files) == 0 {
+		return ConfigErrorf("dir %q: no files found", h.path)
+	}
+	return nil
+}
+
+// find lists the candidate files and the directory that naming:path is relative to
+func (h *dirHandler) find() (files []string, base string, err error) {
+	info, err := os.Stat(h.path)
+	if err != nil || !info.IsDir() {
+		// not a directory: a glob, or a single file
+		files, err = filepath.Glob(h.path)
+		if err != nil {
+			return nil, "", ConfigErrorf("dir %q: %s", h.path, err)
+		}
+		if len(files) == 0 {
+			return nil, "", ConfigErrorf("dir %q: no files found", h.path)
+		}
+		return files, filepath.Dir(h.path), nil
+	}
+	if !h.recursive {
+		entries, err := ioutil.ReadDir(h.path)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, entry := range entries {
+			files = append(files, filepath.Join(h.path, entry.Name()))
+		}
+		return files, h.path, nil
+	}
+	err = filepath.Walk(h.path, func(file string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, file)
+		}
+		return err
+	})
+	sort.Strings(files)
+	return files, h.path, err
+}
+
+// matches applies the include and exclude patterns to the file name
+func (h *dirHandler) matches(name string) bool {
+	for _, pattern := range h.exclude {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return false
+		}
+	}
+	for _, pattern := range h.include {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return len(h.include) == 0
+}
+
+func (h *dirHandler) Populate(ctx context.Context, bucket map[string][]byte) error {
+	for key, data := range h.data {
+		bucket[key] = data
+	}
+	return nil
+}
+
+func (h *dirHandler) Annotate(annotate func(key string, value string)) {
+	for key, file := range h.files {
+		annotate(key, fmt.Sprintf("type=dir,file=%s", file))
+	}
+}
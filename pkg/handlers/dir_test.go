@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// makeDir writes files (relative path => content) to a temporary directory
+func makeDir(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for file, content := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), 0700))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0600))
+	}
+	return dir
+}
+
+func TestDir(t *testing.T) {
+	dir := makeDir(t, map[string]string{
+		"tls.crt": "certificate", "tls.key": "key", "ca-old.crt": "old", "README.md": "docs",
+		"nested/tls.crt": "nested certificate",
+	})
+
+	for n, c := range map[string]struct {
+		path    string // relative to dir
+		options string
+		data    map[string]string
+	}{
+		"directory, subdirectories are skipped": {
+			data: map[string]string{"tls.crt": "certificate", "tls.key": "key", "ca-old.crt": "old", "README.md": "docs"},
+		},
+		"glob": {path: "*.crt", options: "exclude:*-old.crt,prefix:tls-", data: map[string]string{"tls-tls.crt": "certificate"}},
+		"recursive": {
+			options: "include:*.crt,include:*.key,exclude:ca-*,recursive:true,naming:path",
+			data:    map[string]string{"tls.crt": "certificate", "tls.key": "key", "nested_tls.crt": "nested certificate"},
+		},
+	} {
+		t.Run(n, func(t *testing.T) {
+			data, _, err := runHandler(t, "dir", filepath.Join(dir, c.path), c.options, nil, SecretHandlerOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, c.data, stringValues(data))
+		})
+	}
+}
+
+func TestDirAnnotations(t *testing.T) {
+	dir := makeDir(t, map[string]string{"tls.crt": "certificate", "tls.key": "key"})
+	_, annotations, err := runHandler(t, "dir", dir, "", nil, SecretHandlerOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"tls.crt": "type=dir,file=" + filepath.Join(dir, "tls.crt"),
+		"tls.key": "type=dir,file=" + filepath.Join(dir, "tls.key"),
+	}, annotations)
+}
+
+func TestDirInvalid(t *testing.T) {
+	dir := makeDir(t, map[string]string{"tls.crt": "certificate", "nested/tls.crt": "nested certificate"})
+
+	// Every problem with the directory or the options is a config error
+	for options, message := range map[string]string{
+		"recursive:true":    "both are key",
+		"max-size:5":        "more than max-size 5",
+		"max-total:10":      "more than max-total 10",
+		"include:*.pem":     "no files found",
+		"max-size:1Gi":      "not a size",
+		"naming:flat":       "naming must be base or path",
+		"size:1Ki":          "invalid option",
+		"include:[":         "syntax error in pattern",
+		"recursive:perhaps": "recursive must be true or false",
+	} {
+		_, _, err := runHandler(t, "dir", dir, options, nil, SecretHandlerOptions{})
+		if assert.Error(t, err, options) {
+			assert.Contains(t, err.Error(), message, options)
+			assert.True(t, isConfigError(err), options)
+		}
+	}
+
+	_, _, err := runHandler(t, "dir", filepath.Join(dir, "missing"), "", nil, SecretHandlerOptions{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no files found")
+		assert.True(t, isConfigError(err))
+	}
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envHandler copies an environment variable, for example a value injected by the CI secret store:
+//
+//	--secrets env=DB_PASSWORD=CI_DB_PASSWORD
+//	--secrets env=SENTRY_DSN=CI_SENTRY_DSN,optional
+//
+// The variable name defaults to the key. Without optional, an unset variable is an error.
+type envHandler struct {
+	key      string
+	variable string
+	optional bool
+	//private
+	value string
+	isSet bool
+}
+
+// parseEnvSource parses "CI_VAR_NAME,optional" into a handler config
+func parseEnvSource(name string, source string) (map[string]string, error) {
+	result := map[string]string{"name": name, "variable": source, "type": "env"}
+	if idx := strings.Index(source, ","); idx >= 0 {
+		if source[idx+1:] != "optional" {
+			return nil, ConfigErrorf("env %q: invalid option %q, only optional is supported", name, source[idx+1:])
+		}
+		result["variable"], result["optional"] = source[:idx], "true"
+	}
+	return result, nil
+}
+
+func (h *envHandler) Prepare(ctx context.Context, bucket map[string]bool) error {
+	if h.variable == "" {
+		h.variable = h.key
+	}
+	h.value, h.isSet = os.LookupEnv(h.variable)
+	if !h.isSet {
+		if h.optional {
+			return nil
+		}
+		return ConfigErrorf("env %q: environment variable %s is not set, use %s,optional to skip it", h.key, h.variable, h.variable)
+	}
+	bucket[h.key] = true
+	return nil
+}
+func (h *envHandler) Populate(ctx context.Context, bucket map[string][]byte) error {
+	if h.isSet {
+		bucket[h.key] = []byte(h.value)
+	}
+	return nil
+}
+func (h *envHandler) Annotate(annotate func(key string, value string)) {
+	if h.isSet || !h.optional {
+		annotate(h.key, fmt.Sprintf("type=env,variable=%s", h.variable))
+	}
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnv(t *testing.T) {
+	setenv(t, "SEMA_TEST_CI_PASSWORD", "from ci")
+	setenv(t, "SEMA_TEST_EMPTY", "")
+	os.Unsetenv("SEMA_TEST_UNSET")
+
+	data, annotations, err := runHandler(t, "env", "DB_PASSWORD", "SEMA_TEST_CI_PASSWORD", nil, SecretHandlerOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"DB_PASSWORD": "from ci"}, stringValues(data))
+	assert.Equal(t, map[string]string{"DB_PASSWORD": "type=env,variable=SEMA_TEST_CI_PASSWORD"}, annotations)
+
+	// The variable defaults to the key, and an empty variable is set
+	data, annotations, err = runHandler(t, "env", "SEMA_TEST_EMPTY", "", nil, SecretHandlerOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"SEMA_TEST_EMPTY": ""}, stringValues(data))
+	assert.Equal(t, map[string]string{"SEMA_TEST_EMPTY": "type=env,variable=SEMA_TEST_EMPTY"}, annotations)
+
+	data, annotations, err = runHandler(t, "env", "SENTRY_DSN", "SEMA_TEST_UNSET,optional", nil, SecretHandlerOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+	assert.Empty(t, annotations, "a skipped variable is not annotated")
+}
+
+func TestEnvErrors(t *testing.T) {
+	os.Unsetenv("SEMA_TEST_UNSET")
+	for source, message := range map[string]string{
+		"SEMA_TEST_UNSET":          `env "SENTRY_DSN": environment variable SEMA_TEST_UNSET is not set, use SEMA_TEST_UNSET,optional to skip it`,
+		"SEMA_TEST_UNSET,required": `env "SENTRY_DSN": invalid option "required", only optional is supported`,
+	} {
+		_, _, err := runHandler(t, "env", "SENTRY_DSN", source, nil, SecretHandlerOptions{})
+		assert.EqualError(t, err, message)
+		assert.True(t, isConfigError(err), source)
+	}
+}
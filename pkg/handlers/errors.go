@@ -0,0 +1,23 @@
+package handlers
+
+import "fmt"
+
+// ConfigError means the configuration (flags, config file, schema) is invalid,
+// as opposed to a failure while retrieving the secrets.
+type ConfigError struct {
+	Err error
+}
+
+func (e ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap -
+func (e ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrorf formats a ConfigError like fmt.Errorf
+func ConfigErrorf(format string, args ...interface{}) error {
+	return ConfigError{Err: fmt.Errorf(format, args...)}
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 )
@@ -11,14 +12,18 @@ type fileHandler struct {
 	data []byte
 }
 
-func (h *fileHandler) Prepare(bucket map[string]bool) {
+func (h *fileHandler) Prepare(ctx context.Context, bucket map[string]bool) error {
 	var err error
 	h.data, err = ioutil.ReadFile(h.file)
-	panicIfErr(err)
+	if err != nil {
+		return err
+	}
 	bucket[h.key] = true
+	return nil
 }
-func (h *fileHandler) Populate(bucket map[string][]byte) {
+func (h *fileHandler) Populate(ctx context.Context, bucket map[string][]byte) error {
 	bucket[h.key] = h.data
+	return nil
 }
 func (h *fileHandler) Annotate(annotate func(key string, value string)) {
 	annotate(h.key, fmt.Sprintf("type=file,file=%s", h.file))
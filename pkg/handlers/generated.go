@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/pkg/errors"
+)
+
+// generatedHandler reads a Secret Manager secret, or creates it with a random value if it does not exist yet:
+//
+//	--secrets generated=SESSION_KEY=length:64,charset:alnum
+//
+// Options: secret (the Secret Manager key, default: the key), length (default 32) and charset.
+type generatedHandler struct {
+	key      string
+	secret   string
+	length   int
+	charset  string
+	client   secretmanager.KVClient
+	readOnly string
+	//private
+	cacheResolved ResolvedSecretSema
+}
+
+// generatedCharsets are the characters a generated value consists of, by charset option
+var generatedCharsets = map[string]string{
+	"alnum":   "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789",
+	"alpha":   "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+	"numeric": "0123456789",
+	"hex":     "0123456789abcdef",
+	"urlsafe": "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_",
+	"symbols": "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789!#%&*+-=?@^_",
+}
+
+const (
+	generatedDefaultLength  = 32
+	generatedDefaultCharset = "alnum"
+	// Secret Manager values are limited to 64KiB
+	generatedMaxLength = 64 << 10
+)
+
+/* Test it conforms to interfaces */
+var _ SecretHandler = &generatedHandler{}
+var _ SecretHandlerWithSema = &generatedHandler{}
+var _ SecretHandlerWithReferences = &generatedHandler{}
+var _ SecretHandlerWithPrefetch = &generatedHandler{}
+
+// parseGeneratedOptions parses "length:64,charset:alnum" into a handler config
+func parseGeneratedOptions(name string, options string) (map[string]string, error) {
+	result := map[string]string{"name": name, "type": "generated"}
+	if options == "" {
+		return result, nil
+	}
+	for _, option := range strings.Split(options, ",") {
+		parts := strings.SplitN(option, ":", 2)
+		if len(parts) != 2 || (parts[0] != "secret" && parts[0] != "length" && parts[0] != "charset") {
+			return nil, ConfigErrorf("generated %q: invalid option %q, use secret, length or charset like length:64", name, option)
+		}
+		result[parts[0]] = parts[1]
+	}
+	return result, nil
+}
+
+func makeGeneratedHandler(input map[string]string) (SecretHandler, error) {
+	h := &generatedHandler{key: input["name"], secret: input["secret"], length: generatedDefaultLength, charset: input["charset"]}
+	if h.secret == "" {
+		h.secret = h.key
+	}
+	if h.charset == "" {
+		h.charset = generatedDefaultCharset
+	}
+	if _, exists := generatedCharsets[h.charset]; !exists {
+		return nil, ConfigErrorf("generated %q: unknown charset %q, use alnum, alpha, numeric, hex, urlsafe or symbols", h.key, h.charset)
+	}
+	if input["length"] != "" {
+		length, err := strconv.Atoi(input["length"])
+		if err != nil || length < 1 || length > generatedMaxLength {
+			return nil, ConfigErrorf("generated %q: length must be a number from 1 to %d", h.key, generatedMaxLength)
+		}
+		h.length = length
+	}
+	return h, nil
+}
+
+/* Implemented methods */
+func (h *generatedHandler) InjectSemaClient(client secretmanager.KVClient, opts SecretHandlerOptions) {
+	if opts.Mock {
+		h.cacheResolved = ResolvedSecretSema{Key: h.secret, Client: h.client, KV: &secretmanager.CatchAllFlexibleKVValue{}}
+		return
+	}
+	h.client = client
+	h.readOnly = opts.ReadOnly
+}
+
+// Prepare creates the secret if it does not exist, so Populate and References can use it like any other secret
+func (h *generatedHandler) Prepare(ctx context.Context, bucket map[string]bool) error {
+	if h.cacheResolved.KV == nil {
+		secret, err := h.resolve(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "generated %q", h.key)
+		}
+		h.cacheResolved = ResolvedSecretSema{Key: h.secret, Client: h.client, KV: secret}
+	}
+	bucket[h.key] = true
+	return nil
+}
+
+// resolve gets the secret, and generates its value if it does not exist yet or has no value.
+// New and SetValue are separate calls, so a concurrent or interrupted render can leave a secret without a value.
+func (h *generatedHandler) resolve(ctx context.Context) (secretmanager.KVValue, error) {
+	secret, err := h.client.Get(ctx, h.secret)
+	if secretmanager.IsNotFound(err) {
+		if h.readOnly != "" {
+			return nil, ConfigErrorf("Secret Manager key %q does not exist and cannot be created with %s, create it using sema render or sema add", h.secret, h.readOnly)
+		}
+		secret, err = h.client.New(ctx, h.secret, map[string]string{"generated-by": "gcp-sema"})
+		if err == nil {
+			return secret, h.generate(ctx, secret)
+		}
+		if secretmanager.IsAlreadyExists(err) {
+			// Created concurrently, by another render: use its value
+			secret, err = h.client.Get(ctx, h.secret)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = secret.GetValue(ctx); !errors.Is(err, secretmanager.ErrNoVersions) {
+		return secret, err
+	}
+	if h.readOnly != "" {
+		return nil, ConfigErrorf("Secret Manager key %q has no value and cannot be generated with %s, set it using sema render or sema add", h.secret, h.readOnly)
+	}
+	return secret, h.generate(ctx, secret)
+}
+
+// generate writes a random value to the secret
+func (h *generatedHandler) generate(ctx context.Context, secret secretmanager.KVValue) error {
+	value, err := generateValue(h.length, generatedCharsets[h.charset])
+	if err != nil {
+		return err
+	}
+	if _, err = secret.SetValue(ctx, value); err != nil {
+		return err
+	}
+	log.Printf("Generated a value of %d characters (%s) for Secret Manager key %q", h.length, h.charset, h.secret)
+	return nil
+}
+
+// generateValue picks length characters from charset using crypto/rand, every character is equally likely
+func generateValue(length int, charset string) ([]byte, error) {
+	value := make([]byte, length)
+	max := big.NewInt(int64(len(charset)))
+	for i := range value {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return nil, err
+		}
+		value[i] = charset[n.Int64()]
+	}
+	return value, nil
+}
+
+func (h *generatedHandler) Populate(ctx context.Context, bucket map[string][]byte) error {
+	val, err := h.cacheResolved.GetSecretValue(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "generated %q", h.key)
+	}
+	if stringVal, ok := val.(*string); ok {
+		bucket[h.key] = []byte(*stringVal)
+	}
+	return nil
+}
+
+func (h *generatedHandler) Annotate(annotate func(key string, value string)) {
+	annotate(h.key, fmt.Sprintf("type=generated,secret=%s,length=%d,charset=%s", h.secret, h.length, h.charset))
+	annotate(fmt.Sprintf("%s.%s", h.key, alfanum(h.secret)), h.cacheResolved.Annotation())
+}
+
+// Prefetchable -
+func (h *generatedHandler) Prefetchable() []ResolvedSecretSema {
+	return []ResolvedSecretSema{h.cacheResolved}
+}
+
+// References refers to the secret, which Prepare created if needed
+func (h *generatedHandler) References() ([]Reference, error) {
+	source, err := h.cacheResolved.ReferenceSource(h.key)
+	if err != nil {
+		return nil, err
+	}
+	return []Reference{{Key: h.key, Sources: []ReferenceSource{source}}}, nil
+}
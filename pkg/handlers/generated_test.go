@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGenerated(t *testing.T) {
+	ctx := context.Background()
+	for n, c := range map[string]struct {
+		name, options string
+		value         string // regular expression
+		created       string // the Secret Manager key that is created
+	}{
+		"length and charset": {name: "SESSION_KEY", options: "length:64,charset:hex", value: "^[0-9a-f]{64}$", created: "SESSION_KEY"},
+		"secret":             {name: "DB_PASSWORD", options: "secret:db-password", value: "^[A-Za-z0-9]{32}$", created: "db-password"},
+	} {
+		t.Run(n, func(t *testing.T) {
+			client := secretmanager.NewInMemoryClient("my-project")
+			data, _, err := runHandler(t, "generated", c.name, c.options, client, SecretHandlerOptions{})
+			assert.NoError(t, err)
+			assert.Regexp(t, c.value, string(data[c.name]))
+
+			k, err := client.Get(ctx, c.created)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]string{"generated-by": "gcp-sema"}, k.GetLabels())
+			again, _, err := runHandler(t, "generated", c.name, c.options, client, SecretHandlerOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, string(data[c.name]), string(again[c.name]), "the generated value is reused")
+		})
+	}
+}
+
+func TestGeneratedDoesNotWrite(t *testing.T) {
+	ctx := context.Background()
+	readOnlyError := `generated "NEW_KEY": Secret Manager key "NEW_KEY" does not exist and cannot be created with %s, create it using sema render or sema add`
+	client := secretmanager.NewInMemoryClient("my-project", "EXISTING", "existing value")
+
+	data, _, err := runHandler(t, "generated", "EXISTING", "", client, SecretHandlerOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "existing value", string(data["EXISTING"]), "existing secrets are not overwritten")
+
+	data, _, err = runHandler(t, "generated", "NEW_KEY", "", client, SecretHandlerOptions{Mock: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(data["NEW_KEY"]))
+
+	for _, readOnly := range []string{"--proxy", "--offline", "'sema diff'"} {
+		_, _, err := runHandler(t, "generated", "NEW_KEY", "", client, SecretHandlerOptions{ReadOnly: readOnly})
+		assert.EqualError(t, err, fmt.Sprintf(readOnlyError, readOnly))
+		assert.True(t, isConfigError(err))
+	}
+
+	keys, err := client.ListKeys(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"EXISTING"}, secretmanager.SecretShortNames(keys), "nothing is written")
+}
+
+func TestGeneratedInvalidOptions(t *testing.T) {
+	for options, message := range map[string]string{
+		"length:0":      "length must be a number",
+		"length:many":   "length must be a number",
+		"charset:emoji": "unknown charset",
+		"size:64":       "invalid option",
+	} {
+		_, _, err := runHandler(t, "generated", "INVALID", options, secretmanager.NewInMemoryClient("my-project"), SecretHandlerOptions{})
+		if assert.Error(t, err, options) {
+			assert.Contains(t, err.Error(), message, options)
+			assert.True(t, isConfigError(err), options)
+		}
+	}
+}
+
+// concurrentCreateClient simulates another render creating the secret just before New, with value if it is not empty
+type concurrentCreateClient struct {
+	secretmanager.KVClient
+	value string
+}
+
+func (c concurrentCreateClient) New(ctx context.Context, name string, labels map[string]string) (secretmanager.KVValue, error) {
+	secret, err := c.KVClient.New(ctx, name, labels)
+	if err == nil && c.value != "" {
+		_, err = secret.SetValue(ctx, []byte(c.value))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, status.Errorf(codes.AlreadyExists, "Secret [%s] already exists.", name)
+}
+
+func TestGeneratedWithoutValue(t *testing.T) {
+	ctx := context.Background()
+	// Created by an interrupted render
+	interrupted := func() secretmanager.KVClient {
+		client := secretmanager.NewInMemoryClient("my-project")
+		_, err := client.New(ctx, "SESSION_KEY", nil)
+		assert.NoError(t, err)
+		return client
+	}
+
+	_, _, err := runHandler(t, "generated", "SESSION_KEY", "length:16", interrupted(), SecretHandlerOptions{ReadOnly: "--offline"})
+	assert.EqualError(t, err, `generated "SESSION_KEY": Secret Manager key "SESSION_KEY" has no value and cannot be generated with --offline, set it using sema render or sema add`)
+
+	for n, c := range map[string]struct {
+		client secretmanager.KVClient
+		value  string // regular expression
+	}{
+		"interrupted": {client: interrupted(), value: "^[A-Za-z0-9]{16}$"},
+		"concurrent render set the value": {
+			client: concurrentCreateClient{KVClient: secretmanager.NewInMemoryClient("my-project"), value: "concurrent"},
+			value:  "^concurrent$",
+		},
+		"concurrent render did not set the value yet": {
+			client: concurrentCreateClient{KVClient: secretmanager.NewInMemoryClient("my-project")},
+			value:  "^[A-Za-z0-9]{16}$",
+		},
+	} {
+		t.Run(n, func(t *testing.T) {
+			data, _, err := runHandler(t, "generated", "SESSION_KEY", "length:16", c.client, SecretHandlerOptions{})
+			assert.NoError(t, err)
+			assert.Regexp(t, c.value, string(data["SESSION_KEY"]))
+		})
+	}
+}
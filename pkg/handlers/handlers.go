@@ -1,8 +1,7 @@
 package handlers
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"strings"
 
 	"github.com/Q42/gcp-sema/pkg/secretmanager"
@@ -12,9 +11,10 @@ import (
 
 // SecretHandler is the shared interface common between all handlers:
 // they can all populate values in a blob of secret data.
+// Prepare and Populate may return an error; the caller continues with the other handlers and reports all errors together.
 type SecretHandler interface {
-	Prepare(bucket map[string]bool)
-	Populate(bucket map[string][]byte)
+	Prepare(ctx context.Context, bucket map[string]bool) error
+	Populate(ctx context.Context, bucket map[string][]byte) error
 	Annotate(func(key string, value string))
 }
 
@@ -34,7 +34,7 @@ func (c *ConcreteSecretHandler) UnmarshalFlag(value string) error {
 	case 3:
 		c.SecretHandler, err = MakeSecretHandler(args[0], args[1], args[2])
 	default:
-		return errors.New("--secrets array options should contain 2 or 3 values")
+		return ConfigErrorf("--secrets array options should contain 2 or 3 values")
 	}
 	return err
 }
@@ -97,11 +97,44 @@ var HandlerRegistry map[string]HandlerFactory = map[string]HandlerFactory{
 		return &fileHandler{key: input["name"], file: input["path"]}, nil
 	}),
 
+	"env": MakeInlineFactory(func(arg []string) (map[string]string, error) {
+		return parseEnvSource(arg[1], arg[2])
+	}, func(input map[string]string) (SecretHandler, error) {
+		return &envHandler{key: input["name"], variable: input["variable"], optional: input["optional"] == "true"}, nil
+	}),
+
+	"stdin": MakeInlineFactory(func(arg []string) (map[string]string, error) {
+		return map[string]string{"name": arg[1], "type": "stdin"}, nil
+	}, func(input map[string]string) (SecretHandler, error) {
+		return &stdinHandler{key: input["name"]}, nil
+	}),
+
 	"sema-literal": MakeInlineFactory(func(arg []string) (map[string]string, error) {
 		return map[string]string{"name": arg[1], "semaKey": arg[2], "type": "sema-literal"}, nil
 	}, func(input map[string]string) (SecretHandler, error) {
 		return &semaHandlerLiteral{key: input["name"], secret: input["semaKey"]}, nil
 	}),
+
+	"sema-json-field": MakeInlineFactory(func(arg []string) (map[string]string, error) {
+		secret, path := parseJSONFieldSource(arg[2])
+		return map[string]string{"name": arg[1], "semaKey": secret, "path": path, "type": "sema-json-field"}, nil
+	}, func(input map[string]string) (SecretHandler, error) {
+		return &semaHandlerJSONField{key: input["name"], secret: input["semaKey"], path: input["path"]}, nil
+	}),
+
+	"dir": MakeInlineFactory(func(arg []string) (map[string]string, error) {
+		return parseDirOptions(arg[1], arg[2])
+	}, makeDirHandler),
+
+	"generated": MakeInlineFactory(func(arg []string) (map[string]string, error) {
+		return parseGeneratedOptions(arg[1], arg[2])
+	}, makeGeneratedHandler),
+
+	"template": MakeInlineFactory(func(arg []string) (map[string]string, error) {
+		return map[string]string{"name": arg[1], "path": arg[2], "type": "template"}, nil
+	}, func(input map[string]string) (SecretHandler, error) {
+		return &templateHandler{key: input["name"], file: input["path"]}, nil
+	}),
 }
 
 // MakeSecretHandler resolves the different kinds of handlers
@@ -111,23 +144,23 @@ func MakeSecretHandler(handler, name, value string) (SecretHandler, error) {
 	}
 	// Else, if factory is not defined
 	if value == "" {
-		return nil, fmt.Errorf("Could not parse --from-%s=%s", handler, name)
+		return nil, ConfigErrorf("Could not parse --from-%s=%s", handler, name)
 	}
-	return nil, fmt.Errorf("Could not parse --from-%s=%s=%s", handler, name, value)
+	return nil, ConfigErrorf("Could not parse --from-%s=%s=%s", handler, name, value)
 }
 
 // ParseSecretHandler parses the different types of secret definitions into correct MakeSecretHandler calls
-func ParseSecretHandler(input map[string]string) (SecretHandler, error) {
+func ParseSecretHandler(input map[string]string) (handler SecretHandler, err error) {
 	defer func() {
 		// Catch any panic errors from MakeSecretHandler
 		if r := recover(); r != nil {
-			panic(fmt.Errorf("Could not read handler from YAML configuration: %q", input))
+			handler, err = nil, ConfigErrorf("Could not read handler from YAML configuration: %q", input)
 		}
 	}()
 	if factory, hasFactory := HandlerRegistry[input["type"]]; hasFactory {
 		return factory.ParseConfig(input)
 	}
-	return nil, fmt.Errorf("Could not parse handler config %v", input)
+	return nil, ConfigErrorf("Could not parse handler config %v", input)
 }
 
 // SecretHandlerWithSema implement this interface to get a SemaClient injected
@@ -140,6 +173,23 @@ type SecretHandlerOptions struct {
 	Prefix  string
 	Mock    bool
 	Verbose bool
+	// Pins maps Secret Manager keys to a version, see ParsePins
+	Pins map[string]string
+	// ReadOnly is the mode in which handlers may not write to Secret Manager, like "--offline". Empty allows writes.
+	ReadOnly string
+}
+
+// ParsePins parses a list like ["MY_KEY@7"] into a map of keys to versions
+func ParsePins(pins []string) (map[string]string, error) {
+	result := make(map[string]string, len(pins))
+	for _, pin := range pins {
+		key, version := ParseSemaKey(pin)
+		if key == "" || version == "" {
+			return nil, ConfigErrorf("Invalid pin %q, use format KEY@VERSION", pin)
+		}
+		result[key] = version
+	}
+	return result, nil
 }
 
 // InjectSemaClient -
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/stretchr/testify/assert"
+)
+
+// runHandler prepares and populates a single handler like render does, and returns its data and annotations
+func runHandler(t *testing.T, kind, name, source string, client secretmanager.KVClient, opts SecretHandlerOptions) (map[string][]byte, map[string]string, error) {
+	t.Helper()
+	ctx := context.Background()
+	h, err := MakeSecretHandler(kind, name, source)
+	if err != nil {
+		return nil, nil, err
+	}
+	InjectSemaClient([]ConcreteSecretHandler{{SecretHandler: h}}, client, opts)
+	fields := map[string]bool{}
+	if err = h.Prepare(ctx, fields); err != nil {
+		return nil, nil, err
+	}
+	data := map[string][]byte{}
+	if err = h.Populate(ctx, data); err != nil {
+		return nil, nil, err
+	}
+	for key := range data {
+		assert.True(t, fields[key], "Prepare should announce %q", key)
+	}
+	annotations := map[string]string{}
+	h.Annotate(func(key, value string) { annotations[key] = value })
+	return data, annotations, nil
+}
+
+func isConfigError(err error) bool {
+	return errors.As(err, &ConfigError{})
+}
+
+func stringValues(data map[string][]byte) map[string]string {
+	values := map[string]string{}
+	for key, value := range data {
+		values[key] = string(value)
+	}
+	return values
+}
+
+func setenv(t *testing.T, key, value string) {
+	previous, exists := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if exists {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
@@ -1,16 +1,27 @@
 package handlers
 
+import "context"
+
+var _ SecretHandlerWithReferences = &literalHandler{}
+
 type literalHandler struct {
 	key   string
 	value string
 }
 
-func (h *literalHandler) Prepare(bucket map[string]bool) {
+func (h *literalHandler) Prepare(ctx context.Context, bucket map[string]bool) error {
 	bucket[h.key] = true
+	return nil
 }
-func (h *literalHandler) Populate(bucket map[string][]byte) {
+func (h *literalHandler) Populate(ctx context.Context, bucket map[string][]byte) error {
 	bucket[h.key] = []byte(h.value)
+	return nil
 }
 func (h *literalHandler) Annotate(annotate func(key string, value string)) {
 	annotate(h.key, "type=literal")
 }
+
+// References includes the literal value in the template: it is not a secret
+func (h *literalHandler) References() ([]Reference, error) {
+	return []Reference{{Key: h.key, Template: TemplateLiteral(h.value)}}, nil
+}
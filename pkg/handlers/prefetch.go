@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Q42/gcp-sema/pkg/multierror"
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+)
+
+// DefaultConcurrency is the number of values Prefetch retrieves at the same time, if not specified
+const DefaultConcurrency = 8
+
+// SecretHandlerWithPrefetch implement this interface to have the Secret Manager values retrieved concurrently before Populate.
+// Prefetchable is called after Prepare and lists the secrets that Populate will retrieve.
+type SecretHandlerWithPrefetch interface {
+	Prefetchable() []ResolvedSecretSema
+}
+
+// Prefetch retrieves the values of all handlers concurrently, with at most concurrency retrievals at a time.
+// The values are only retained when the Secret Manager client remembers them, see memoize.New.
+// Populate then retrieves the values sequentially as usual, so the output stays deterministic.
+// Values of a secretmanager.KVBatchClient are retrieved in a single batch per client instead.
+func Prefetch(ctx context.Context, handlers []ConcreteSecretHandler, concurrency int) error {
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	var secrets []ResolvedSecretSema
+	for _, h := range handlers {
+		if ph, isPrefetchable := h.SecretHandler.(SecretHandlerWithPrefetch); isPrefetchable {
+			secrets = append(secrets, ph.Prefetchable()...)
+		}
+	}
+
+	// Errors are stored by index, so they are reported in a deterministic order
+	errs := make([]error, len(secrets))
+	batches := make(map[secretmanager.KVBatchClient][]int)
+	var single []int
+	for i, s := range secrets {
+		if batchClient, isBatch := s.Client.(secretmanager.KVBatchClient); isBatch && s.KV != nil {
+			batches[batchClient] = append(batches[batchClient], i)
+		} else {
+			single = append(single, i)
+		}
+	}
+	for batchClient, indices := range batches {
+		requests := make([]secretmanager.KVValueRequest, len(indices))
+		for j, i := range indices {
+			requests[j] = secretmanager.KVValueRequest{Secret: secrets[i].KV, Version: secrets[i].Version}
+		}
+		for j, result := range batchClient.GetValues(ctx, requests) {
+			errs[indices[j]] = result.Err
+		}
+	}
+
+	work := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < concurrency && w < len(single); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				_, errs[i] = secrets[i].GetSecretValue(ctx)
+			}
+		}()
+	}
+	for _, i := range single {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	var allErrors error
+	for _, err := range errs {
+		allErrors = multierror.MultiAppend(allErrors, err)
+	}
+	return allErrors
+}
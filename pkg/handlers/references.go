@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Reference describes how a secret operator can retrieve the value of a key, without sema retrieving the value.
+type Reference struct {
+	Key string // the key in the Kubernetes secret
+	// Template is a Go template using the Sources by name, in External Secrets Operator syntax (includes sprig functions like toJson).
+	// If empty, the value of the single source is used as-is.
+	Template string
+	Sources  []ReferenceSource
+}
+
+// ReferenceSource is a single Secret Manager secret
+type ReferenceSource struct {
+	Name     string
+	FullName string // format: "projects/*/secrets/*"
+	Version  string // empty means latest
+}
+
+// SecretHandlerWithReferences implement this interface to support the reference-only formats.
+// References is called after Prepare.
+type SecretHandlerWithReferences interface {
+	References() ([]Reference, error)
+}
+
+// ReferenceSource converts a resolved secret into a source named name
+func (r ResolvedSecretSema) ReferenceSource(name string) (ReferenceSource, error) {
+	if r.KV == nil {
+		return ReferenceSource{}, fmt.Errorf("Secret Manager key %q is not resolved", r.Key)
+	}
+	return ReferenceSource{Name: name, FullName: r.KV.GetFullName(), Version: r.Version}, nil
+}
+
+var templateIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// TemplateSourceValue returns the template action that inserts the value of the source.
+// Pipe is optional, like "toJson".
+func TemplateSourceValue(source ReferenceSource, pipe string) string {
+	value := fmt.Sprintf("index . %q", source.Name)
+	if templateIdentifier.MatchString(source.Name) {
+		value = "." + source.Name
+	}
+	if pipe != "" {
+		return fmt.Sprintf("{{ %s | %s }}", value, pipe)
+	}
+	return fmt.Sprintf("{{ %s }}", value)
+}
+
+// TemplateLiteral escapes a static value so it can be used as template
+func TemplateLiteral(value string) string {
+	return strings.ReplaceAll(value, "{{", `{{"{{"}}`)
+}
@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
 	"github.com/Q42/gcp-sema/pkg/secretmanager"
 )
@@ -10,7 +12,7 @@ import (
 type ResolvedSecret interface {
 	String() string
 	Annotation() string
-	GetSecretValue() (interface{}, error)
+	GetSecretValue(ctx context.Context) (interface{}, error)
 }
 
 // ResolvedSecretSema -
@@ -18,11 +20,16 @@ type ResolvedSecretSema struct {
 	Key    string
 	Client secretmanager.KVClient
 	KV     secretmanager.KVValue
+	// Version pins a specific version; if empty the latest enabled version is used
+	Version string
 }
 
 var _ ResolvedSecret = &ResolvedSecretSema{} // test interface adherence
 
 func (r ResolvedSecretSema) Annotation() string {
+	if r.KV != nil && r.Version != "" {
+		return fmt.Sprintf("secretmanager(fullname: %s, version: %s)", r.KV.GetFullName(), r.Version)
+	}
 	if r.KV != nil {
 		return fmt.Sprintf("secretmanager(fullname: %s)", r.KV.GetFullName())
 	}
@@ -30,22 +37,39 @@ func (r ResolvedSecretSema) Annotation() string {
 }
 
 func (r ResolvedSecretSema) String() string {
+	if r.Version != "" {
+		return fmt.Sprintf("secretmanager(key: %s@%s)", r.Key, r.Version)
+	}
 	return fmt.Sprintf("secretmanager(key: %s)", r.Key)
 }
 
-func (r ResolvedSecretSema) GetSecretValue() (interface{}, error) {
+func (r ResolvedSecretSema) GetSecretValue(ctx context.Context) (interface{}, error) {
 	var err error
 	secret := r.KV
 	if secret == nil {
-		secret, err = r.Client.Get(r.Key)
+		secret, err = r.Client.Get(ctx, r.Key)
 		if err != nil {
 			return nil, err
 		}
 	}
-	val, err := secret.GetValue()
+	var val []byte
+	if r.Version != "" {
+		val, err = secret.GetVersionValue(ctx, r.Version)
+	} else {
+		val, err = secret.GetValue(ctx)
+	}
 	if err != nil {
 		return nil, err
 	}
 	stringValue := string(val)
 	return &stringValue, nil
 }
+
+// ParseSemaKey splits a pinned key like "MY_KEY@7" into its key and version.
+// Secret Manager does not allow '@' in names, so it is safe to use as separator.
+func ParseSemaKey(input string) (key string, version string) {
+	if idx := strings.LastIndex(input, "@"); idx >= 0 {
+		return input[:idx], input[idx+1:]
+	}
+	return input, ""
+}
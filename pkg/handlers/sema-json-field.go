@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/pkg/errors"
+)
+
+// semaHandlerJSONField extracts a single field from a Secret Manager secret containing JSON,
+// using a JSON pointer (RFC 6901): "db-creds#/password" or "service-account@3#/client_email".
+type semaHandlerJSONField struct {
+	key    string
+	secret string // optionally pinned: "MY_KEY@7"
+	path   string // JSON pointer: "/password" or "/hosts/0"
+	client secretmanager.KVClient
+	mock   bool
+	pins   map[string]string
+	//private
+	cacheResolved ResolvedSecretSema
+}
+
+/* Test it conforms to interfaces */
+var _ SecretHandler = &semaHandlerJSONField{}
+var _ SecretHandlerWithSema = &semaHandlerJSONField{}
+var _ SecretHandlerWithPrefetch = &semaHandlerJSONField{}
+
+// parseJSONFieldSource splits "db-creds#/password" into the secret and the JSON pointer
+func parseJSONFieldSource(source string) (secret string, path string) {
+	if idx := strings.Index(source, "#"); idx >= 0 {
+		return source[:idx], source[idx+1:]
+	}
+	return source, ""
+}
+
+/* Implemented methods */
+func (h *semaHandlerJSONField) InjectSemaClient(client secretmanager.KVClient, opts SecretHandlerOptions) {
+	if opts.Mock {
+		h.mock = true
+		h.cacheResolved = ResolvedSecretSema{Key: h.secret, Client: h.client, KV: &secretmanager.CatchAllFlexibleKVValue{}}
+		return
+	}
+	h.client = client
+	h.pins = opts.Pins
+}
+
+func (h *semaHandlerJSONField) Prepare(ctx context.Context, bucket map[string]bool) error {
+	if !strings.HasPrefix(h.path, "/") {
+		return ConfigErrorf("sema-json-field %q: %q needs a JSON pointer to a field, like %s#/password", h.key, h.secret+"#"+h.path, h.secret)
+	}
+	if h.cacheResolved.KV == nil {
+		key, version := ParseSemaKey(h.secret)
+		if version == "" {
+			version = h.pins[key]
+		}
+		secret, err := h.client.Get(ctx, key)
+		if err != nil {
+			return errors.Wrapf(err, "sema-json-field %q", h.key)
+		}
+		h.cacheResolved = ResolvedSecretSema{Key: key, Client: h.client, KV: secret, Version: version}
+	}
+	bucket[h.key] = true
+	return nil
+}
+
+func (h *semaHandlerJSONField) Populate(ctx context.Context, bucket map[string][]byte) error {
+	val, err := h.cacheResolved.GetSecretValue(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "sema-json-field %q", h.key)
+	}
+	stringVal, ok := val.(*string)
+	if !ok {
+		return nil
+	}
+	if h.mock {
+		bucket[h.key] = []byte(*stringVal)
+		return nil
+	}
+	field, err := jsonPointerScalar([]byte(*stringVal), h.path)
+	if err != nil {
+		return errors.Wrapf(err, "sema-json-field %q: %s#%s", h.key, h.secret, h.path)
+	}
+	bucket[h.key] = []byte(field)
+	return nil
+}
+
+func (h *semaHandlerJSONField) Annotate(annotate func(key string, value string)) {
+	annotate(h.key, fmt.Sprintf("type=sema-json-field,secret=%s,path=%s", h.secret, h.path))
+	annotate(fmt.Sprintf("%s.%s", h.key, alfanum(h.secret)), h.cacheResolved.Annotation())
+}
+
+// Prefetchable -
+func (h *semaHandlerJSONField) Prefetchable() []ResolvedSecretSema {
+	return []ResolvedSecretSema{h.cacheResolved}
+}
+
+// jsonPointerScalar returns the string, number or boolean at the JSON pointer path. Strings are returned without quotes.
+func jsonPointerScalar(data []byte, path string) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", errors.Wrap(err, "value is not JSON")
+	}
+
+	location := ""
+	if path != "" {
+		for _, token := range strings.Split(path[1:], "/") {
+			token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+			switch node := value.(type) {
+			case map[string]interface{}:
+				field, exists := node[token]
+				if !exists {
+					return "", fmt.Errorf("no field %q at %q", token, valueOrRoot(location))
+				}
+				value = field
+			case []interface{}:
+				index, err := strconv.Atoi(token)
+				if err != nil || index < 0 || index >= len(node) {
+					return "", fmt.Errorf("no index %q at %q, which has %d items", token, valueOrRoot(location), len(node))
+				}
+				value = node[index]
+			default:
+				return "", fmt.Errorf("no field %q at %q, which is %s", token, valueOrRoot(location), jsonType(value))
+			}
+			location += "/" + token
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("%q is %s, not a string, number or boolean", valueOrRoot(location), jsonType(value))
+}
+
+// jsonType describes the type of a decoded JSON value, for errors
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case json.Number:
+		return "a number"
+	}
+	return "a boolean"
+}
+
+func valueOrRoot(location string) string {
+	if location == "" {
+		return "/"
+	}
+	return location
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONField(t *testing.T) {
+	client := secretmanager.NewInMemoryClient("my-project",
+		"db-creds", `{"password":"hunter2","port":5432,"ssl":true,"hosts":["a","b"],"a/b":"escaped","empty":null}`)
+
+	for source, value := range map[string]string{
+		"db-creds#/password": "hunter2",
+		"db-creds#/port":     "5432",
+		"db-creds#/ssl":      "true",
+		"db-creds#/hosts/1":  "b",
+		"db-creds#/a~1b":     "escaped",
+	} {
+		data, annotations, err := runHandler(t, "sema-json-field", "FIELD", source, client, SecretHandlerOptions{})
+		assert.NoError(t, err, source)
+		assert.Equal(t, value, string(data["FIELD"]), source)
+		assert.Contains(t, annotations, "FIELD", source)
+	}
+}
+
+func TestJSONFieldErrors(t *testing.T) {
+	client := secretmanager.NewInMemoryClient("my-project",
+		"db-creds", `{"password":"hunter2","hosts":["a","b"],"empty":null}`,
+		"plain", "not json")
+
+	// The value does not match the pointer: not a config error, the secret could change
+	for source, message := range map[string]string{
+		"db-creds#/user":           `no field "user" at "/"`,
+		"db-creds#/hosts/2":        `no index "2" at "/hosts", which has 2 items`,
+		"db-creds#/password/first": `no field "first" at "/password", which is a string`,
+		"db-creds#/hosts":          `"/hosts" is an array, not a string, number or boolean`,
+		"db-creds#/empty":          `"/empty" is null, not a string, number or boolean`,
+		"plain#/password":          `value is not JSON: invalid character 'o' in literal null (expecting 'u')`,
+	} {
+		_, _, err := runHandler(t, "sema-json-field", "FIELD", source, client, SecretHandlerOptions{})
+		assert.EqualError(t, err, `sema-json-field "FIELD": `+source+": "+message)
+		assert.False(t, isConfigError(err), source)
+	}
+
+	_, _, err := runHandler(t, "sema-json-field", "FIELD", "db-creds", client, SecretHandlerOptions{})
+	assert.EqualError(t, err, `sema-json-field "FIELD": "db-creds#" needs a JSON pointer to a field, like db-creds#/password`)
+	assert.True(t, isConfigError(err))
+
+	_, _, err = runHandler(t, "sema-json-field", "FIELD", "missing#/password", client, SecretHandlerOptions{})
+	assert.True(t, secretmanager.IsNotFound(err), "%v", err)
+}
@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 
 	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/pkg/errors"
 )
 
 // TODO deduplicate
@@ -15,18 +17,11 @@ func alfanum(inp string) string {
 	return qnameExtCharFmtExcluded.ReplaceAllString(inp, "")
 }
 
-// TODO deduplicate
-// prints stack
-func panicIfErr(err error) {
-	if err != nil {
-		panic(err)
-	}
-}
-
 type semaHandlerLiteral struct {
 	key    string
-	secret string
+	secret string // optionally pinned: "MY_KEY@7"
 	client secretmanager.KVClient
+	pins   map[string]string
 	//private
 	cacheResolved ResolvedSecretSema
 }
@@ -34,6 +29,8 @@ type semaHandlerLiteral struct {
 /* Test it conforms to interfaces */
 var _ SecretHandler = &semaHandlerLiteral{}
 var _ SecretHandlerWithSema = &semaHandlerLiteral{}
+var _ SecretHandlerWithReferences = &semaHandlerLiteral{}
+var _ SecretHandlerWithPrefetch = &semaHandlerLiteral{}
 
 /* Implemented methods */
 func (h *semaHandlerLiteral) InjectSemaClient(client secretmanager.KVClient, opts SecretHandlerOptions) {
@@ -42,24 +39,49 @@ func (h *semaHandlerLiteral) InjectSemaClient(client secretmanager.KVClient, opt
 		return
 	}
 	h.client = client
+	h.pins = opts.Pins
 }
 
-func (h *semaHandlerLiteral) Prepare(bucket map[string]bool) {
+func (h *semaHandlerLiteral) Prepare(ctx context.Context, bucket map[string]bool) error {
 	if h.cacheResolved.KV == nil {
-		secret, err := h.client.Get(h.secret)
-		panicIfErr(err)
-		h.cacheResolved = ResolvedSecretSema{Key: h.secret, Client: h.client, KV: secret}
+		key, version := ParseSemaKey(h.secret)
+		if version == "" {
+			version = h.pins[key]
+		}
+		secret, err := h.client.Get(ctx, key)
+		if err != nil {
+			return errors.Wrapf(err, "sema-literal %q", h.key)
+		}
+		h.cacheResolved = ResolvedSecretSema{Key: key, Client: h.client, KV: secret, Version: version}
 	}
 	bucket[h.key] = true
+	return nil
 }
-func (h *semaHandlerLiteral) Populate(bucket map[string][]byte) {
-	val, err := h.cacheResolved.GetSecretValue()
-	panicIfErr(err)
+func (h *semaHandlerLiteral) Populate(ctx context.Context, bucket map[string][]byte) error {
+	val, err := h.cacheResolved.GetSecretValue(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "sema-literal %q", h.key)
+	}
 	if stringVal, ok := val.(*string); ok {
 		bucket[h.key] = []byte(*stringVal)
 	}
+	return nil
 }
 func (h *semaHandlerLiteral) Annotate(annotate func(key string, value string)) {
 	annotate(h.key, fmt.Sprintf("type=sema-literal,secret=%s", h.secret))
 	annotate(fmt.Sprintf("%s.%s", h.key, alfanum(h.secret)), h.cacheResolved.Annotation())
 }
+
+// Prefetchable -
+func (h *semaHandlerLiteral) Prefetchable() []ResolvedSecretSema {
+	return []ResolvedSecretSema{h.cacheResolved}
+}
+
+// References refers to the resolved Secret Manager secret, using the key as name
+func (h *semaHandlerLiteral) References() ([]Reference, error) {
+	source, err := h.cacheResolved.ReferenceSource(h.key)
+	if err != nil {
+		return nil, err
+	}
+	return []Reference{{Key: h.key, Sources: []ReferenceSource{source}}}, nil
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// stdinHandler uses everything piped to sema as value: printf '%s' "$VALUE" | sema render --secrets stdin=KEY.
+// Stdin can be read once, so all stdin handlers get the same value.
+type stdinHandler struct {
+	key string
+	//private
+	data []byte
+}
+
+var stdin struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// stdinFile is replaced in tests
+var stdinFile = os.Stdin
+
+// readStdin reads stdin once; a terminal is refused, as render would wait for input without a prompt
+func readStdin() ([]byte, error) {
+	stdin.once.Do(func() {
+		if terminal.IsTerminal(int(stdinFile.Fd())) {
+			stdin.err = ConfigErrorf("stdin is a terminal, pipe the value to sema instead")
+			return
+		}
+		stdin.data, stdin.err = ioutil.ReadAll(stdinFile)
+	})
+	return stdin.data, stdin.err
+}
+
+func (h *stdinHandler) Prepare(ctx context.Context, bucket map[string]bool) error {
+	var err error
+	if h.data, err = readStdin(); err != nil {
+		return err
+	}
+	bucket[h.key] = true
+	return nil
+}
+func (h *stdinHandler) Populate(ctx context.Context, bucket map[string][]byte) error {
+	bucket[h.key] = h.data
+	return nil
+}
+func (h *stdinHandler) Annotate(annotate func(key string, value string)) {
+	annotate(h.key, "type=stdin")
+}
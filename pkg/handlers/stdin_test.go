@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withStdin makes readStdin read f as if it were stdin, even when stdin was read before
+func withStdin(t *testing.T, f *os.File) {
+	previous := stdinFile
+	stdinFile = f
+	stdin.once = sync.Once{}
+	t.Cleanup(func() {
+		stdinFile = previous
+		stdin.once = sync.Once{}
+	})
+}
+
+func TestStdinSharedRead(t *testing.T) {
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	defer r.Close()
+	withStdin(t, r)
+	_, err = w.WriteString("piped value")
+	assert.NoError(t, err)
+	w.Close()
+
+	// The second key would get nothing if stdin were read again
+	for _, key := range []string{"FIRST", "SECOND"} {
+		data, annotations, err := runHandler(t, "stdin", key, "", nil, SecretHandlerOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{key: "piped value"}, stringValues(data))
+		assert.Equal(t, map[string]string{key: "type=stdin"}, annotations)
+	}
+}
+
+func TestStdinRefusesTerminal(t *testing.T) {
+	// The master side of a pseudo terminal is a terminal as well
+	tty, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("no pseudo terminal: %v", err)
+	}
+	defer tty.Close()
+	withStdin(t, tty)
+
+	_, _, err = runHandler(t, "stdin", "KEY", "", nil, SecretHandlerOptions{})
+	assert.EqualError(t, err, "stdin is a terminal, pipe the value to sema instead")
+	assert.True(t, isConfigError(err))
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/Q42/gcp-sema/pkg/multierror"
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/pkg/errors"
+)
+
+// templateHandler renders a Go template, which can use Secret Manager values like {{ sema "MY_KEY" }} or {{ sema "MY_KEY@7" }},
+// environment variables like {{ env "HOST" }}, files like {{ file "ca.pem" }} (relative to the template)
+// and the helpers b64enc, b64dec, toJson and fromJson.
+type templateHandler struct {
+	key    string
+	file   string
+	client secretmanager.KVClient
+	mock   bool
+	pins   map[string]string
+	//private
+	template *template.Template
+	resolved map[string]ResolvedSecretSema // by the argument of sema
+	sources  []templateSource              // literal arguments found in the template, for Annotate
+}
+
+// templateSource is a call in the template with a literal argument, like {{ env "HOST" }}
+type templateSource struct {
+	function string
+	arg      string
+}
+
+/* Test it conforms to interfaces */
+var _ SecretHandler = &templateHandler{}
+var _ SecretHandlerWithSema = &templateHandler{}
+var _ SecretHandlerWithPrefetch = &templateHandler{}
+
+func (h *templateHandler) InjectSemaClient(client secretmanager.KVClient, opts SecretHandlerOptions) {
+	h.client = client
+	h.mock = opts.Mock
+	h.pins = opts.Pins
+}
+
+// Prepare parses the template and resolves the Secret Manager keys it uses, in all branches of the template.
+// Keys that are computed while rendering are resolved by Populate.
+func (h *templateHandler) Prepare(ctx context.Context, bucket map[string]bool) error {
+	data, err := ioutil.ReadFile(h.file)
+	if err != nil {
+		return errors.Wrapf(err, "template %q", h.key)
+	}
+	h.template, err = template.New(filepath.Base(h.file)).Option("missingkey=error").Funcs(h.funcs(ctx)).Parse(string(data))
+	if err != nil {
+		return ConfigErrorf("template %q: %s", h.key, err)
+	}
+	h.resolved = make(map[string]ResolvedSecretSema)
+	h.sources = nil
+	seen := make(map[templateSource]bool)
+	for _, t := range h.template.Templates() {
+		findTemplateSources(t.Tree.Root, func(source templateSource) {
+			if !seen[source] {
+				seen[source] = true
+				h.sources = append(h.sources, source)
+			}
+		})
+	}
+	for _, source := range h.sources {
+		if source.function == "sema" {
+			if _, resolveErr := h.resolve(ctx, source.arg); resolveErr != nil {
+				err = multierror.MultiAppend(err, errors.Wrapf(resolveErr, "template %q", h.key))
+			}
+		}
+	}
+	bucket[h.key] = true
+	return err
+}
+
+func (h *templateHandler) Populate(ctx context.Context, bucket map[string][]byte) error {
+	out := &bytes.Buffer{}
+	if err := h.template.Funcs(h.funcs(ctx)).Execute(out, nil); err != nil {
+		return errors.Wrapf(err, "template %q", h.key)
+	}
+	bucket[h.key] = out.Bytes()
+	return nil
+}
+
+func (h *templateHandler) Annotate(annotate func(key string, value string)) {
+	annotate(h.key, fmt.Sprintf("type=template,file=%s", h.file))
+	for _, source := range h.sources {
+		switch source.function {
+		case "sema":
+			annotate(fmt.Sprintf("%s.%s", h.key, alfanum(source.arg)), h.resolved[source.arg].Annotation())
+		case "env", "file":
+			annotate(fmt.Sprintf("%s.%s.%s", h.key, source.function, alfanum(source.arg)), fmt.Sprintf("%s(%s)", source.function, source.arg))
+		}
+	}
+}
+
+// Prefetchable lists the keys found by Prepare
+func (h *templateHandler) Prefetchable() (result []ResolvedSecretSema) {
+	for _, source := range h.sources {
+		if r, isResolved := h.resolved[source.arg]; isResolved && source.function == "sema" {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// resolve finds the secret of a key like "MY_KEY" or "MY_KEY@7", once
+func (h *templateHandler) resolve(ctx context.Context, name string) (ResolvedSecretSema, error) {
+	if r, isResolved := h.resolved[name]; isResolved {
+		return r, nil
+	}
+	if h.mock {
+		h.resolved[name] = ResolvedSecretSema{Key: name, KV: &secretmanager.CatchAllFlexibleKVValue{}}
+		return h.resolved[name], nil
+	}
+	key, version := ParseSemaKey(name)
+	if version == "" {
+		version = h.pins[key]
+	}
+	secret, err := h.client.Get(ctx, key)
+	if err != nil {
+		return ResolvedSecretSema{}, err
+	}
+	h.resolved[name] = ResolvedSecretSema{Key: key, Client: h.client, KV: secret, Version: version}
+	return h.resolved[name], nil
+}
+
+func (h *templateHandler) funcs(ctx context.Context) template.FuncMap {
+	return template.FuncMap{
+		"sema": func(name string) (string, error) {
+			r, err := h.resolve(ctx, name)
+			if err != nil {
+				return "", err
+			}
+			value, err := r.GetSecretValue(ctx)
+			if err != nil {
+				return "", err
+			}
+			if stringValue, ok := value.(*string); ok {
+				return *stringValue, nil
+			}
+			return "", nil
+		},
+		"env": func(name string) (string, error) {
+			value, isSet := os.LookupEnv(name)
+			if !isSet {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			return value, nil
+		},
+		"file": func(path string) (string, error) {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(filepath.Dir(h.file), path)
+			}
+			data, err := ioutil.ReadFile(path)
+			return string(data), err
+		},
+		"b64enc": func(value string) string {
+			return base64.StdEncoding.EncodeToString([]byte(value))
+		},
+		"b64dec": func(value string) (string, error) {
+			data, err := base64.StdEncoding.DecodeString(value)
+			return string(data), err
+		},
+		"toJson": func(value interface{}) (string, error) {
+			data, err := json.Marshal(value)
+			return string(data), err
+		},
+		"fromJson": func(value string) (result interface{}, err error) {
+			err = json.Unmarshal([]byte(value), &result)
+			return result, err
+		},
+	}
+}
+
+// findTemplateSources finds the sema, env and file calls with a literal argument
+func findTemplateSources(node parse.Node, found func(templateSource)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			findTemplateSources(child, found)
+		}
+	case *parse.ActionNode:
+		findTemplateSources(n.Pipe, found)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			findTemplateSources(cmd, found)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) == 2 {
+			ident, isIdent := n.Args[0].(*parse.IdentifierNode)
+			arg, isString := n.Args[1].(*parse.StringNode)
+			if isIdent && isString && (ident.Ident == "sema" || ident.Ident == "env" || ident.Ident == "file") {
+				found(templateSource{function: ident.Ident, arg: arg.Text})
+			}
+		}
+		for _, arg := range n.Args {
+			findTemplateSources(arg, found)
+		}
+	case *parse.ChainNode:
+		findTemplateSources(n.Node, found)
+	case *parse.IfNode:
+		findTemplateBranchSources(&n.BranchNode, found)
+	case *parse.RangeNode:
+		findTemplateBranchSources(&n.BranchNode, found)
+	case *parse.WithNode:
+		findTemplateBranchSources(&n.BranchNode, found)
+	case *parse.TemplateNode:
+		findTemplateSources(n.Pipe, found)
+	}
+}
+
+func findTemplateBranchSources(n *parse.BranchNode, found func(templateSource)) {
+	findTemplateSources(n.Pipe, found)
+	findTemplateSources(n.List, found)
+	findTemplateSources(n.ElseList, found)
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.conf.tmpl")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ca.pem"), []byte("certificate"), 0600))
+	setenv(t, "SEMA_TEST_HOST", "db.internal")
+	client := secretmanager.NewInMemoryClient("my-project", "password", "first", "creds", `{"user":"admin"}`)
+	k, _ := client.Get(ctx, "password")
+	_, err := k.SetValue(ctx, []byte("second"))
+	assert.NoError(t, err)
+
+	for n, c := range map[string]struct {
+		template    string
+		value       string
+		annotations map[string]string
+	}{
+		"sema": {
+			template: `password={{ sema "password" }} old={{ sema "password@1" }} computed={{ printf "pass%s" "word" | sema }}`,
+			value:    "password=second old=first computed=second",
+			annotations: map[string]string{
+				"app.conf":           "type=template,file=" + file,
+				"app.conf.password":  "secretmanager(fullname: project/my-project/secrets/password)",
+				"app.conf.password1": "secretmanager(fullname: project/my-project/secrets/password, version: 1)",
+			},
+		},
+		"env, file and functions": {
+			template: `host={{ env "SEMA_TEST_HOST" }} ca={{ file "ca.pem" | b64enc }} user={{ (sema "creds" | fromJson).user }}`,
+			value:    "host=db.internal ca=Y2VydGlmaWNhdGU= user=admin",
+			annotations: map[string]string{
+				"app.conf":                    "type=template,file=" + file,
+				"app.conf.creds":              "secretmanager(fullname: project/my-project/secrets/creds)",
+				"app.conf.env.SEMA_TEST_HOST": "env(SEMA_TEST_HOST)",
+				"app.conf.file.ca.pem":        "file(ca.pem)",
+			},
+		},
+	} {
+		t.Run(n, func(t *testing.T) {
+			assert.NoError(t, ioutil.WriteFile(file, []byte(c.template), 0600))
+			data, annotations, err := runHandler(t, "template", "app.conf", file, client, SecretHandlerOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, c.value, string(data["app.conf"]))
+			assert.Equal(t, c.annotations, annotations)
+		})
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "app.conf.tmpl")
+	client := secretmanager.NewInMemoryClient("my-project", "password", "secret")
+	run := func(template string) error {
+		assert.NoError(t, ioutil.WriteFile(file, []byte(template), 0600))
+		_, _, err := runHandler(t, "template", "app.conf", file, client, SecretHandlerOptions{})
+		return err
+	}
+
+	err := run(`{{ sema "password" `)
+	assert.True(t, isConfigError(err), "a template that does not parse is a config error: %v", err)
+
+	err = run(`{{ sema "missing" }}`)
+	assert.True(t, secretmanager.IsNotFound(err), "%v", err)
+
+	// The template is valid, the environment is not
+	err = run(`{{ env "SEMA_TEST_UNSET" }}`)
+	assert.EqualError(t, err, `template "app.conf": template: app.conf.tmpl:1:3: executing "app.conf.tmpl" at <env "SEMA_TEST_UNSET">: error calling env: environment variable SEMA_TEST_UNSET is not set`)
+	assert.False(t, isConfigError(err))
+}
@@ -1,6 +1,8 @@
 package schema
 
 import (
+	"context"
+
 	"github.com/Q42/gcp-sema/pkg/handlers"
 	"github.com/Q42/gcp-sema/pkg/secretmanager"
 )
@@ -16,7 +18,7 @@ var (
 
 /* interface implementations */
 
-func (CatchAllResolver) Resolve(schema ConvictConfigSchema) map[string]handlers.ResolvedSecret {
+func (CatchAllResolver) Resolve(ctx context.Context, schema ConvictConfigSchema) (map[string]handlers.ResolvedSecret, error) {
 	allResolved := make(map[string]handlers.ResolvedSecret, 0)
 	for _, conf := range schema.FlatConfigurations {
 		if conf.DefaultValue != nil || conf.Env != "" || conf.Format.IsOptional() {
@@ -27,7 +29,7 @@ func (CatchAllResolver) Resolve(schema ConvictConfigSchema) map[string]handlers.
 			KV:  &secretmanager.CatchAllFlexibleKVValue{},
 		}
 	}
-	return allResolved
+	return allResolved, nil
 }
 func (CatchAllResolver) IsVerbose() bool                   { return false }
 func (CatchAllResolver) GetClient() secretmanager.KVClient { return &secretmanager.CatchAllClient{} }
@@ -1,9 +1,12 @@
 package schema
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 
 	"github.com/Q42/gcp-sema/pkg/handlers"
 	"github.com/Q42/gcp-sema/pkg/multierror"
@@ -48,6 +51,10 @@ var _ handlers.SecretHandler = &semaHandlerSingleKey{}
 var _ handlers.SecretHandlerWithSema = &semaHandlerSingleKey{}
 var _ handlers.SecretHandler = &semaHandlerEnvironmentVariables{}
 var _ handlers.SecretHandlerWithSema = &semaHandlerEnvironmentVariables{}
+var _ handlers.SecretHandlerWithReferences = &semaHandlerSingleKey{}
+var _ handlers.SecretHandlerWithReferences = &semaHandlerEnvironmentVariables{}
+var _ handlers.SecretHandlerWithPrefetch = &semaHandlerSingleKey{}
+var _ handlers.SecretHandlerWithPrefetch = &semaHandlerEnvironmentVariables{}
 
 /* Implement SecretHanderWithSema methods */
 func (h *semaHandlerSingleKey) InjectSemaClient(client secretmanager.KVClient, opts handlers.SecretHandlerOptions) {
@@ -55,27 +62,32 @@ func (h *semaHandlerSingleKey) InjectSemaClient(client secretmanager.KVClient, o
 		h.resolver = &CatchAllResolver{}
 		return
 	}
-	h.resolver = MakeSchemaResolver(client, opts.Prefix, opts.Verbose, DefaultMatcher)
+	h.resolver = MakeSchemaResolver(client, opts.Prefix, opts.Verbose, DefaultMatcher, opts.Pins)
 }
 func (h *semaHandlerEnvironmentVariables) InjectSemaClient(client secretmanager.KVClient, opts handlers.SecretHandlerOptions) {
 	if opts.Mock {
 		h.resolver = &CatchAllResolver{}
 		return
 	}
-	h.resolver = MakeSchemaResolver(client, opts.Prefix, opts.Verbose, DefaultMatcher)
+	h.resolver = MakeSchemaResolver(client, opts.Prefix, opts.Verbose, DefaultMatcher, opts.Pins)
 }
 
 /* Implement SecretHandler methods */
-func (h *semaHandlerSingleKey) Prepare(bucket map[string]bool) {
-	h.cacheSchema = ParseSchemaFile(h.configSchemaFile)
-	h.cacheResolved = h.resolver.Resolve(h.cacheSchema)
+func (h *semaHandlerSingleKey) Prepare(ctx context.Context, bucket map[string]bool) (err error) {
+	if h.cacheSchema, err = ParseSchemaFile(h.configSchemaFile); err != nil {
+		return err
+	}
+	if h.cacheResolved, err = h.resolver.Resolve(ctx, h.cacheSchema); err != nil {
+		return err
+	}
 	bucket[h.key] = true
+	return nil
 }
-func (h *semaHandlerSingleKey) Populate(bucket map[string][]byte) {
+func (h *semaHandlerSingleKey) Populate(ctx context.Context, bucket map[string][]byte) error {
 	// Shove it into a nested JSON structure
-	jsonMap, err := hydrateSecretTree(h.cacheSchema.Tree, h.cacheResolved)
+	jsonMap, err := hydrateSecretTree(ctx, h.cacheSchema.Tree, h.cacheResolved)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	if jsonMap == nil {
 		// if the whole tree is empty, still return an empty JSON object
@@ -83,13 +95,14 @@ func (h *semaHandlerSingleKey) Populate(bucket map[string][]byte) {
 	}
 	jsonData, err := json.MarshalIndent(jsonMap, "", "  ")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if h.resolver.IsVerbose() {
 		log.Println(color.BlueString("Generated value for key '%s':\n%s\n", h.key, string(jsonData)))
 	}
 	bucket[h.key] = jsonData
+	return nil
 }
 func (h *semaHandlerSingleKey) Annotate(annotate func(key string, value string)) {
 	annotate(h.key, fmt.Sprintf("type=sema-schema-to-file,schema=%s", h.configSchemaFile))
@@ -97,28 +110,73 @@ func (h *semaHandlerSingleKey) Annotate(annotate func(key string, value string))
 		annotate(fmt.Sprintf("%s.%s", h.key, secretName), resolved.Annotation())
 	}
 }
+
+// References renders the JSON as template, with a placeholder per Secret Manager secret
+func (h *semaHandlerSingleKey) References() ([]handlers.Reference, error) {
+	sources := make(map[string]handlers.ReferenceSource)
+	tree, err := templateSecretTree(h.cacheSchema.Tree, h.cacheResolved, func(r handlers.ResolvedSecretSema) (interface{}, error) {
+		source, err := r.ReferenceSource(r.KV.GetShortName())
+		if err != nil {
+			return nil, err
+		}
+		sources[source.Name] = source
+		return templatePlaceholder(source.Name), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		tree = make(map[string]interface{}, 0)
+	}
+	jsonData, err := json.MarshalIndent(tree, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	// Replace the placeholders (including JSON quotes) by a template action that JSON-encodes the value
+	template := handlers.TemplateLiteral(string(jsonData))
+	ref := handlers.Reference{Key: h.key}
+	for _, name := range sortedSourceNames(sources) {
+		ref.Sources = append(ref.Sources, sources[name])
+		placeholder, _ := json.Marshal(templatePlaceholder(name))
+		template = strings.ReplaceAll(template, string(placeholder), handlers.TemplateSourceValue(sources[name], "toJson"))
+	}
+	ref.Template = template
+	return []handlers.Reference{ref}, nil
+}
+
+// Prefetchable -
+func (h *semaHandlerSingleKey) Prefetchable() []handlers.ResolvedSecretSema {
+	return prefetchable(h.cacheResolved)
+}
+
 func (h *semaHandlerSingleKey) InjectClient(c secretmanager.KVClient) {
 	// TODO
 }
 
-func (h *semaHandlerEnvironmentVariables) Prepare(bucket map[string]bool) {
-	h.cacheSchema = ParseSchemaFile(h.configSchemaFile)
-	h.cacheResolved = h.resolver.Resolve(h.cacheSchema)
+func (h *semaHandlerEnvironmentVariables) Prepare(ctx context.Context, bucket map[string]bool) (err error) {
+	if h.cacheSchema, err = ParseSchemaFile(h.configSchemaFile); err != nil {
+		return err
+	}
+	if h.cacheResolved, err = h.resolver.Resolve(ctx, h.cacheSchema); err != nil {
+		return err
+	}
 	for _, conf := range h.cacheSchema.FlatConfigurations {
 		key := conf.Key()
 		if _, isSet := h.cacheResolved[key]; isSet && conf.Env != "" {
 			bucket[conf.Env] = true
 		}
 	}
+	return nil
 }
 
-func (h *semaHandlerEnvironmentVariables) Populate(bucket map[string][]byte) {
+func (h *semaHandlerEnvironmentVariables) Populate(ctx context.Context, bucket map[string][]byte) error {
 	var allErrors error
 	// Shove secrets in all possible environment variables
 	for _, conf := range h.cacheSchema.FlatConfigurations {
 		key := conf.Key()
 		if r, isSet := h.cacheResolved[key]; isSet && conf.Env != "" {
-			val, err := r.GetSecretValue()
+			val, err := r.GetSecretValue(ctx)
 			if stringVal, ok := val.(*string); ok {
 				bucket[conf.Env] = []byte(*stringVal)
 				if h.resolver.IsVerbose() {
@@ -128,7 +186,7 @@ func (h *semaHandlerEnvironmentVariables) Populate(bucket map[string][]byte) {
 			allErrors = multierror.MultiAppend(allErrors, err)
 		}
 	}
-	panicIfErr(allErrors)
+	return allErrors
 }
 func (h *semaHandlerEnvironmentVariables) Annotate(annotate func(key string, value string)) {
 	annotate("", fmt.Sprintf("type=sema-schema-to-literals,schema=%s", h.configSchemaFile))
@@ -137,6 +195,58 @@ func (h *semaHandlerEnvironmentVariables) Annotate(annotate func(key string, val
 	}
 }
 
+// References refers to every Secret Manager secret, runtime resolved values are left out
+func (h *semaHandlerEnvironmentVariables) References() (refs []handlers.Reference, err error) {
+	for _, conf := range h.cacheSchema.FlatConfigurations {
+		if r, isSema := h.cacheResolved[conf.Key()].(handlers.ResolvedSecretSema); isSema && conf.Env != "" {
+			source, err := r.ReferenceSource(conf.Env)
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, handlers.Reference{Key: conf.Env, Sources: []handlers.ReferenceSource{source}})
+		}
+	}
+	return refs, nil
+}
+
+// Prefetchable only lists the values that are written to an environment variable
+func (h *semaHandlerEnvironmentVariables) Prefetchable() []handlers.ResolvedSecretSema {
+	used := make(map[string]handlers.ResolvedSecret)
+	for _, conf := range h.cacheSchema.FlatConfigurations {
+		if r, isSet := h.cacheResolved[conf.Key()]; isSet && conf.Env != "" {
+			used[conf.Key()] = r
+		}
+	}
+	return prefetchable(used)
+}
+
 func (h *semaHandlerEnvironmentVariables) InjectClient(c secretmanager.KVClient) {
 	// TODO
 }
+
+func templatePlaceholder(name string) string {
+	return fmt.Sprintf("__sema_reference_%s__", name)
+}
+
+func sortedSourceNames(sources map[string]handlers.ReferenceSource) (names []string) {
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// prefetchable lists the Secret Manager values sorted by configuration key, runtime resolved values are left out
+func prefetchable(resolved map[string]handlers.ResolvedSecret) (result []handlers.ResolvedSecretSema) {
+	keys := make([]string, 0, len(resolved))
+	for key := range resolved {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if r, isSema := resolved[key].(handlers.ResolvedSecretSema); isSema {
+			result = append(result, r)
+		}
+	}
+	return result
+}
@@ -1,11 +1,13 @@
 package schema
 
 import (
+	"context"
+
 	"github.com/Q42/gcp-sema/pkg/handlers"
 	"github.com/Q42/gcp-sema/pkg/multierror"
 )
 
-func hydrateSecretTree(tree *ConvictJSONTree, resolved map[string]handlers.ResolvedSecret) (outerResult interface{}, outerErr error) {
+func hydrateSecretTree(ctx context.Context, tree *ConvictJSONTree, resolved map[string]handlers.ResolvedSecret) (outerResult interface{}, outerErr error) {
 	if tree == nil {
 		return nil, nil
 	}
@@ -14,12 +16,38 @@ func hydrateSecretTree(tree *ConvictJSONTree, resolved map[string]handlers.Resol
 		if resolved == nil {
 			return nil, nil // unresolved, TODO err?
 		}
-		val, err := resolved.GetSecretValue()
+		val, err := resolved.GetSecretValue(ctx)
 		return val, err
 	}
 	result := make(map[string]interface{}, 0)
 	for key, c := range tree.Children {
-		nested, err := hydrateSecretTree(c, resolved)
+		nested, err := hydrateSecretTree(ctx, c, resolved)
+		if nested != nil {
+			result[key] = nested
+		}
+		outerErr = multierror.MultiAppend(outerErr, err)
+	}
+	if len(result) == 0 {
+		return nil, outerErr
+	}
+	return result, outerErr
+}
+
+// templateSecretTree is like hydrateSecretTree, but instead of retrieving values it calls placeholder for every Secret Manager secret.
+// Runtime resolved values are left out, just like hydrateSecretTree does.
+func templateSecretTree(tree *ConvictJSONTree, resolved map[string]handlers.ResolvedSecret, placeholder func(handlers.ResolvedSecretSema) (interface{}, error)) (outerResult interface{}, outerErr error) {
+	if tree == nil {
+		return nil, nil
+	}
+	if tree.Leaf != nil {
+		if sema, isSema := resolved[tree.Leaf.Key()].(handlers.ResolvedSecretSema); isSema {
+			return placeholder(sema)
+		}
+		return nil, nil
+	}
+	result := make(map[string]interface{}, 0)
+	for key, c := range tree.Children {
+		nested, err := templateSecretTree(c, resolved, placeholder)
 		if nested != nil {
 			result[key] = nested
 		}
@@ -1,6 +1,7 @@
 package schema
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
 
@@ -11,7 +12,7 @@ import (
 
 func TestHydrateNil(t *testing.T) {
 	var tree *ConvictJSONTree
-	result, err := hydrateSecretTree(tree, map[string]handlers.ResolvedSecret{})
+	result, err := hydrateSecretTree(context.Background(), tree, map[string]handlers.ResolvedSecret{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, nil, result)
 }
@@ -24,7 +25,7 @@ func TestHydrateFlatTree(t *testing.T) {
     "LOG_FORMAT": { "format": ["json", "text"], "default": "json", "doc": "How to log" },
     "LOG_LEVEL": { "format": ["warn", "error"], "default": "error", "doc": "When to log" },
 }`))
-	result, err := hydrateSecretTree(schema.Tree, map[string]handlers.ResolvedSecret{
+	result, err := hydrateSecretTree(context.Background(), schema.Tree, map[string]handlers.ResolvedSecret{
 		"LOG_FORMAT": resolvedSecretRuntime{*schema.Tree.Children["LOG_FORMAT"].Leaf},
 		"LOG_LEVEL":  handlers.ResolvedSecretSema{Key: "log_level", Client: client},
 	})
@@ -52,18 +53,19 @@ func TestHydrateNestedTree(t *testing.T) {
 	assert.NotNil(t, schema.Tree.Children["LOGGING"].Children["LEVEL"], "LEVEL")
 
 	// One is runtime, other is resolved
-	resolved := schemaResolver{Client: client, Verbose: true}.Resolve(schema)
+	resolved, err := schemaResolver{Client: client, Verbose: true}.Resolve(context.Background(), schema)
+	assert.NoError(t, err)
 	assert.IsType(t, resolvedSecretRuntime{}, resolved["LOGGING.FORMAT"], "LOGGING.FORMAT")
 	assert.IsType(t, handlers.ResolvedSecretSema{}, resolved["LOGGING.LEVEL"], "LOGGING.LEVEL")
 	assert.Equal(t, client, resolved["LOGGING.LEVEL"].(handlers.ResolvedSecretSema).Client, "LOGGING.LEVEL")
 
-	result, err := hydrateSecretTree(schema.Tree.Children["LOGGING"].Children["FORMAT"], resolved)
+	result, err := hydrateSecretTree(context.Background(), schema.Tree.Children["LOGGING"].Children["FORMAT"], resolved)
 	assert.Equal(t, nil, result)
 	assert.NoError(t, err)
 
-	result, err = hydrateSecretTree(schema.Tree, resolved)
+	result, err = hydrateSecretTree(context.Background(), schema.Tree, resolved)
 	assert.NoError(t, err)
-	levelValue, err := resolved["LOGGING.LEVEL"].GetSecretValue()
+	levelValue, err := resolved["LOGGING.LEVEL"].GetSecretValue(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, map[string]interface{}(map[string]interface{}{"LOGGING": map[string]interface{}{"LEVEL": levelValue}}), result)
 	jsonData, _ := json.MarshalIndent(result, "", "  ")
@@ -74,3 +76,28 @@ func TestHydrateNestedTree(t *testing.T) {
   }
 }`, string(jsonData))
 }
+
+func TestTemplateNestedTree(t *testing.T) {
+	client := secretmanager.NewInMemoryClient("my-project", "logging_level", "warn")
+	schema, err := parseSchema([]byte(`{
+    "LOGGING": {
+      "FORMAT": { "format": ["json", "text"], "default": "json", "doc": "How to log" },
+      "LEVEL": { "format": ["warn", "error"], "default": "error", "doc": "When to log" },
+    }
+}`))
+	assert.NoError(t, err)
+	resolved, err := schemaResolver{Client: client}.Resolve(context.Background(), schema)
+	assert.NoError(t, err)
+
+	h := &semaHandlerSingleKey{key: "config-env.json", cacheSchema: schema, cacheResolved: resolved}
+	refs, err := h.References()
+	assert.NoError(t, err)
+	assert.Len(t, refs, 1)
+	assert.Equal(t, "config-env.json", refs[0].Key)
+	assert.Equal(t, []handlers.ReferenceSource{{Name: "logging_level", FullName: "project/my-project/secrets/logging_level"}}, refs[0].Sources)
+	assert.Equal(t, `{
+  "LOGGING": {
+    "LEVEL": {{ .logging_level | toJson }}
+  }
+}`, refs[0].Template)
+}
@@ -6,26 +6,23 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/Q42/gcp-sema/pkg/handlers"
 	"github.com/flynn/json5"
 	"github.com/go-errors/errors"
 )
 
-func panicIfErr(err error) {
-	if err != nil {
-		panic(err)
-	}
-}
-
 // ParseSchemaFile -
-func ParseSchemaFile(schemaFile string) ConvictConfigSchema {
+func ParseSchemaFile(schemaFile string) (ConvictConfigSchema, error) {
 	data, err := ioutil.ReadFile(schemaFile)
-	panicIfErr(err)
+	if err != nil {
+		return ConvictConfigSchema{}, err
+	}
 	var schema ConvictConfigSchema
 	schema, err = parseSchema(data)
 	if err != nil {
-		panic(errors.WrapPrefix(err, fmt.Sprintf("cannot parse schema '%s'", schemaFile), 0))
+		return ConvictConfigSchema{}, handlers.ConfigError{Err: errors.WrapPrefix(err, fmt.Sprintf("cannot parse schema '%s'", schemaFile), 0)}
 	}
-	return schema
+	return schema, nil
 }
 
 func parseSchema(data []byte) (result ConvictConfigSchema, err error) {
@@ -75,7 +72,10 @@ func (tree *ConvictJSONTree) UnmarshalJSON(data []byte) error {
 		if err != nil {
 			return err
 		}
-		_, format := isConvictLeaf(obj)
+		_, format, err := isConvictLeaf(obj)
+		if err != nil {
+			return err
+		}
 		tree.Leaf = &ConvictConfiguration{
 			Format:       format,
 			DefaultValue: convict.Default.Value,
@@ -121,7 +121,7 @@ func (conf *ConvictConfiguration) Key() string {
 }
 
 // Convict supports nested properties. Everything with a "default" property
-func isConvictLeaf(data map[string]interface{}) (hasFormat bool, format convictFormat) {
+func isConvictLeaf(data map[string]interface{}) (hasFormat bool, format convictFormat, err error) {
 	switch v := data["format"].(type) {
 	case string:
 		hasFormat = true
@@ -153,7 +153,7 @@ func isConvictLeaf(data map[string]interface{}) (hasFormat bool, format convictF
 		case "*":
 			format = convictFormatAny{}
 		default:
-			panic(fmt.Errorf("Unknown format %s", v))
+			return false, nil, fmt.Errorf("Unknown format %s", v)
 		}
 	case []interface{}:
 		if strs, isAllString := allStrings(v); isAllString {
@@ -167,7 +167,7 @@ func isConvictLeaf(data map[string]interface{}) (hasFormat bool, format convictF
 		hasFormat = false
 	}
 
-	return hasFormat, format
+	return hasFormat, format, nil
 }
 
 func convictRecursiveResolve(data *ConvictJSONTree) []ConvictConfiguration {
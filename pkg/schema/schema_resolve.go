@@ -1,6 +1,7 @@
 package schema
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,7 +15,7 @@ import (
 
 // SchemaResolver -
 type SchemaResolver interface {
-	Resolve(schema ConvictConfigSchema) map[string]handlers.ResolvedSecret
+	Resolve(ctx context.Context, schema ConvictConfigSchema) (map[string]handlers.ResolvedSecret, error)
 	IsVerbose() bool
 	GetClient() secretmanager.KVClient
 }
@@ -24,13 +25,15 @@ type schemaResolver struct {
 	Prefix  string
 	Verbose bool
 	Matcher Matcher
+	// Pins maps Secret Manager keys to a version
+	Pins map[string]string
 	// private
 	cachedAvailable []secretmanager.KVValue
 }
 
 // MakeSchemaResolver -
-func MakeSchemaResolver(client secretmanager.KVClient, prefix string, verbose bool, matcher Matcher) SchemaResolver {
-	return schemaResolver{Client: client, Prefix: prefix, Verbose: verbose, Matcher: matcher}
+func MakeSchemaResolver(client secretmanager.KVClient, prefix string, verbose bool, matcher Matcher, pins map[string]string) SchemaResolver {
+	return schemaResolver{Client: client, Prefix: prefix, Verbose: verbose, Matcher: matcher, Pins: pins}
 }
 
 // IsVerbose -
@@ -85,7 +88,7 @@ func (r schemaResolver) resolveConf(conf ConvictConfiguration, availableSecrets
 		for _, available := range availableSecrets {
 			// if it matches, return it
 			if r.Matcher(conf, available, suggestedKey) {
-				return handlers.ResolvedSecretSema{Key: suggestedKey, Client: r.Client, KV: available}, options, nil
+				return handlers.ResolvedSecretSema{Key: suggestedKey, Client: r.Client, KV: available, Version: r.pinnedVersion(suggestedKey, available)}, options, nil
 			}
 		}
 	}
@@ -96,6 +99,13 @@ func (r schemaResolver) resolveConf(conf ConvictConfiguration, availableSecrets
 	return nil, options, semaNotFoundError{conf, suggestedKeys}
 }
 
+func (r schemaResolver) pinnedVersion(suggestedKey string, available secretmanager.KVValue) string {
+	if version, isPinned := r.Pins[suggestedKey]; isPinned {
+		return version
+	}
+	return r.Pins[available.GetShortName()]
+}
+
 // quick and dirty equality
 func resolvedSecretEqual(a, b handlers.ResolvedSecret) bool {
 	if a == nil && b == nil {
@@ -132,7 +142,7 @@ func (r resolvedSecretRuntime) String() string {
 	return fmt.Sprintf("runtime(%s)", strings.Join(opts, " or "))
 }
 
-func (r resolvedSecretRuntime) GetSecretValue() (interface{}, error) {
+func (r resolvedSecretRuntime) GetSecretValue(ctx context.Context) (interface{}, error) {
 	return nil, nil // injected runtime
 }
 
@@ -151,7 +161,7 @@ func (e semaNotFoundError) Error() string {
 }
 
 // private function to ease testing with mock data
-func (r schemaResolver) Resolve(schema ConvictConfigSchema) map[string]handlers.ResolvedSecret {
+func (r schemaResolver) Resolve(ctx context.Context, schema ConvictConfigSchema) (map[string]handlers.ResolvedSecret, error) {
 	if r.Verbose {
 		log.Println(color.BlueString("SecretManager verbose output"))
 	}
@@ -159,8 +169,10 @@ func (r schemaResolver) Resolve(schema ConvictConfigSchema) map[string]handlers.
 	// Get/cache available secrets: reused by multiple invocations
 	if r.cachedAvailable == nil {
 		var err error
-		r.cachedAvailable, err = r.Client.ListKeys()
-		panicIfErr(err)
+		r.cachedAvailable, err = r.Client.ListKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Resolve all configuration options
@@ -193,8 +205,8 @@ func (r schemaResolver) Resolve(schema ConvictConfigSchema) map[string]handlers.
 		log.Println(color.RedString("No secret value resolved for:"))
 		for _, err := range allErrors {
 			log.Println(color.RedString("- %s", err.Error()))
-			if errors.As(semaNotFoundError{}, &err) {
-				nf := err.(semaNotFoundError)
+			var nf semaNotFoundError
+			if errors.As(err, &nf) {
 				if nf.conf.Format != nil {
 					log.Println(color.RedString("  format: %s", nf.conf.Format.String()))
 				}
@@ -205,5 +217,5 @@ func (r schemaResolver) Resolve(schema ConvictConfigSchema) map[string]handlers.
 		}
 		log.Println()
 	}
-	return allResolved
+	return allResolved, nil
 }
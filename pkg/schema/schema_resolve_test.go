@@ -1,6 +1,7 @@
 package schema
 
 import (
+	"context"
 	"testing"
 
 	. "github.com/Q42/gcp-sema/pkg/handlers"
@@ -28,7 +29,8 @@ func TestSchemaResolving(t *testing.T) {
 	secretManagerNonprefixed := secretmanager.NewInMemoryClient("my-project", "redis_shards", "1,2,3,4,5")
 	secretManagerPrefixed := secretmanager.NewInMemoryClient("my-project", "myapp4_redis_shards", "a,b,c,d,e")
 
-	resolved := schemaResolver{Client: secretmanager.NewInMemoryClient("my-project")}.Resolve(config)
+	resolved, err := schemaResolver{Client: secretmanager.NewInMemoryClient("my-project")}.Resolve(context.Background(), config)
+	assert.NoError(t, err)
 	assert.IsType(t, resolvedSecretRuntime{}, resolved["log.level"])
 	assert.IsType(t, resolvedSecretRuntime{}, resolved["redis.shards"])
 
@@ -42,7 +44,7 @@ func TestSchemaResolving(t *testing.T) {
 	////////////////
 
 	// Non prefixed
-	keys, _ := secretManagerNonprefixed.ListKeys()
+	keys, _ := secretManagerNonprefixed.ListKeys(context.Background())
 	result, _, err := schemaResolver{Prefix: ""}.resolveConf(shardConfig, keys)
 	assert.IsType(t, ResolvedSecretSema{}, result)
 	assert.Equal(t, "redis_shards", result.(ResolvedSecretSema).Key)
@@ -50,7 +52,7 @@ func TestSchemaResolving(t *testing.T) {
 	assert.Equal(t, nil, err)
 
 	// Prefixed
-	keys, _ = secretManagerPrefixed.ListKeys()
+	keys, _ = secretManagerPrefixed.ListKeys(context.Background())
 	result, _, err = schemaResolver{Prefix: "myapp4"}.resolveConf(shardConfig, keys)
 	assert.IsType(t, ResolvedSecretSema{}, result)
 	assert.Equal(t, "myapp4_redis_shards", result.(ResolvedSecretSema).Key)
@@ -62,7 +64,8 @@ func TestSchemaResolving(t *testing.T) {
 	//////////////////////
 
 	// Non prefixed
-	resolved = schemaResolver{Client: secretManagerNonprefixed, Prefix: ""}.Resolve(config)
+	resolved, err = schemaResolver{Client: secretManagerNonprefixed, Prefix: ""}.Resolve(context.Background(), config)
+	assert.NoError(t, err)
 	assert.IsType(t, resolvedSecretRuntime{}, resolved["log.level"])
 	assert.IsType(t, resolvedSecretRuntime{}, resolved["encryption.ssh_key"])
 	assert.IsType(t, resolvedSecretRuntime{}, resolved["encryption.opt_int"])
@@ -75,8 +78,32 @@ func TestSchemaResolving(t *testing.T) {
 	assert.EqualValues(t, secretManagerNonprefixed, resolved["redis.shards"].(ResolvedSecretSema).Client)
 
 	// Prefixed
-	resolved = schemaResolver{Client: secretManagerPrefixed, Prefix: "myapp4"}.Resolve(config)
+	resolved, err = schemaResolver{Client: secretManagerPrefixed, Prefix: "myapp4"}.Resolve(context.Background(), config)
+	assert.NoError(t, err)
 	assert.IsType(t, ResolvedSecretSema{}, resolved["redis.shards"])
 	assert.EqualValues(t, "myapp4_redis_shards", resolved["redis.shards"].(ResolvedSecretSema).Key)
 	assert.EqualValues(t, secretManagerPrefixed, resolved["redis.shards"].(ResolvedSecretSema).Client)
 }
+
+func TestSchemaResolvingPinned(t *testing.T) {
+	ctx := context.Background()
+	config, err := parseSchema([]byte(exampleSchema2))
+	assert.Equal(t, nil, err)
+
+	client := secretmanager.NewInMemoryClient("my-project", "redis_shards", "1,2")
+	secret, _ := client.Get(ctx, "redis_shards")
+	secret.SetValue(ctx, []byte("1,2,3"))
+
+	resolved, err := schemaResolver{Client: client, Pins: map[string]string{"redis_shards": "1"}}.Resolve(ctx, config)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "1", resolved["redis.shards"].(ResolvedSecretSema).Version)
+	value, err := resolved["redis.shards"].GetSecretValue(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "1,2", *value.(*string))
+
+	resolved, err = schemaResolver{Client: client}.Resolve(ctx, config)
+	assert.NoError(t, err)
+	value, err = resolved["redis.shards"].GetSecretValue(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "1,2,3", *value.(*string))
+}
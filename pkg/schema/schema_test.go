@@ -1,8 +1,12 @@
 package schema
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/Q42/gcp-sema/pkg/handlers"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -34,3 +38,18 @@ func TestSchemaParsing(t *testing.T) {
 		{Path: []string{"redis", "shards"}, Format: arr, DefaultValue: nil, Doc: "bla", Env: "REDIS_SHARDS"},
 	}, config.FlatConfigurations, "")
 }
+
+func TestSchemaParsingUnknownFormat(t *testing.T) {
+	_, err := parseSchema([]byte(`{ "log": { "level": { "format": "loglevel", "default": "info" } } }`))
+	assert.EqualError(t, err, "Unknown format loglevel")
+}
+
+func TestSchemaFileErrors(t *testing.T) {
+	_, err := ParseSchemaFile("does-not-exist.json")
+	assert.True(t, os.IsNotExist(err))
+
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "config-schema.json"), []byte(`{ "log": { "level": { "format": "loglevel", "default": "info" } } }`), 0644)
+	_, err = ParseSchemaFile(filepath.Join(dir, "config-schema.json"))
+	assert.ErrorAs(t, err, &handlers.ConfigError{})
+}
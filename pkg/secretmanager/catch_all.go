@@ -1,6 +1,8 @@
 package secretmanager
 
 import (
+	"context"
+
 	"github.com/pkg/errors"
 )
 
@@ -19,23 +21,29 @@ var (
 
 /* interface implementations */
 
-func (*CatchAllClient) ListKeys() ([]KVValue, error) {
+func (*CatchAllClient) ListKeys(ctx context.Context) ([]KVValue, error) {
 	return []KVValue{&CatchAllFlexibleKVValue{}}, nil
 }
-func (*CatchAllClient) Get(name string) (KVValue, error) {
+func (*CatchAllClient) Get(ctx context.Context, name string) (KVValue, error) {
 	return &CatchAllFlexibleKVValue{}, nil
 }
-func (*CatchAllClient) New(name string, labels map[string]string) (KVValue, error) {
+func (*CatchAllClient) New(ctx context.Context, name string, labels map[string]string) (KVValue, error) {
 	return nil, errors.New("Not implemented")
 }
 
-func (*CatchAllFlexibleKVValue) GetFullName() string          { return "fullname-fake" }
-func (*CatchAllFlexibleKVValue) GetShortName() string         { return "short-fake" }
-func (*CatchAllFlexibleKVValue) GetValue() ([]byte, error)    { return nil, nil }
-func (*CatchAllFlexibleKVValue) GetLabels() map[string]string { panic(errors.New("Not implemented")) }
-func (*CatchAllFlexibleKVValue) SetLabels(labels map[string]string) error {
+func (*CatchAllFlexibleKVValue) GetFullName() string                          { return "fullname-fake" }
+func (*CatchAllFlexibleKVValue) GetShortName() string                         { return "short-fake" }
+func (*CatchAllFlexibleKVValue) GetValue(ctx context.Context) ([]byte, error) { return nil, nil }
+func (*CatchAllFlexibleKVValue) GetLabels() map[string]string                 { panic(errors.New("Not implemented")) }
+func (*CatchAllFlexibleKVValue) SetLabels(ctx context.Context, labels map[string]string) error {
 	return errors.New("Not implemented")
 }
-func (*CatchAllFlexibleKVValue) SetValue([]byte) (string, error) {
+func (*CatchAllFlexibleKVValue) SetValue(ctx context.Context, data []byte) (string, error) {
 	return "", errors.New("Not implemented")
 }
+func (*CatchAllFlexibleKVValue) ListVersions(ctx context.Context) ([]KVVersion, error) {
+	return nil, nil
+}
+func (*CatchAllFlexibleKVValue) GetVersionValue(ctx context.Context, version string) ([]byte, error) {
+	return nil, nil
+}
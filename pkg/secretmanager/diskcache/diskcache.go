@@ -0,0 +1,459 @@
+// Diskcache is a wrapper around KVClient that persists listings and values in a directory, encrypted with AES-GCM.
+// Fresh entries are used without contacting Secret Manager, so a restarted process starts warm.
+// When an entry is expired but Secret Manager cannot be reached, the stale entry is used for a while (Options.MaxStale),
+// so sema keeps working briefly offline. Errors like not found and permission denied are never masked.
+// File names are hashes, so the directory does not reveal the secret names either.
+// Use Client.Batch to keep retrieving the values that are not cached in a single batch, like memoize does.
+package diskcache
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Options configure New, zero values use the defaults
+type Options struct {
+	Dir      string
+	Key      []byte        // see ParseKey
+	ListTTL  time.Duration // default 5m
+	ValueTTL time.Duration // default 5m
+	MaxStale time.Duration // how long after the TTL an entry is used when Secret Manager is unavailable, default 1h
+	// OnStale is called when a stale entry is used, optional
+	OnStale func(name string, age time.Duration, err error)
+
+	// Testing
+	now func() time.Time
+}
+
+// Client is a KVClient
+type Client struct {
+	secretmanager.KVClient
+	project string
+	opts    Options
+	aead    cipher.AEAD
+	// entries stored before forgottenAt are a miss, see ForgetProject
+	forgottenAt  time.Time
+	forgottenAtM sync.Mutex
+}
+
+var _ secretmanager.KVClient = &Client{}
+
+// ParseKey derives the encryption key from key material, like the output of 'openssl rand -base64 32'
+func ParseKey(material string) ([]byte, error) {
+	material = strings.TrimSpace(material)
+	if len(material) < 32 {
+		return nil, errors.New("cache key is too short, use at least 32 random characters")
+	}
+	key := sha256.Sum256([]byte(material))
+	return key[:], nil
+}
+
+// New wraps c, project namespaces the cache so a directory can be shared
+func New(c secretmanager.KVClient, project string, opts Options) (*Client, error) {
+	if opts.ListTTL <= 0 {
+		opts.ListTTL = 5 * time.Minute
+	}
+	if opts.ValueTTL <= 0 {
+		opts.ValueTTL = 5 * time.Minute
+	}
+	if opts.MaxStale <= 0 {
+		opts.MaxStale = time.Hour
+	}
+	if opts.now == nil {
+		opts.now = time.Now
+	}
+	block, err := aes.NewCipher(opts.Key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+	client := &Client{KVClient: c, project: project, opts: opts, aead: aead}
+	if forgotten, ok := client.read(client.path("forgotten", project), "forgotten/"+project); ok {
+		client.forgottenAt = forgotten.StoredAt
+	}
+	return client, nil
+}
+
+// Batch returns a secretmanager.KVBatchClient if the wrapped client is one, so handlers.Prefetch can still batch
+// the values that are not cached. Otherwise it returns c.
+func (c *Client) Batch() secretmanager.KVClient {
+	if batch, isBatch := c.KVClient.(secretmanager.KVBatchClient); isBatch {
+		return &batchClient{Client: c, batch: batch}
+	}
+	return c
+}
+
+type batchClient struct {
+	*Client
+	batch secretmanager.KVBatchClient
+}
+
+var _ secretmanager.KVBatchClient = &batchClient{}
+
+// GetValues uses the fresh cached values and retrieves the others in a single batch
+func (c *batchClient) GetValues(ctx context.Context, requests []secretmanager.KVValueRequest) []secretmanager.KVValueResult {
+	results := make([]secretmanager.KVValueResult, len(requests))
+	var missing []secretmanager.KVValueRequest
+	var missingIndices []int
+	var lookups []cacheLookup
+	for i, r := range requests {
+		v, isCached := r.Secret.(*cacheKeyValue)
+		if !isCached {
+			missing, missingIndices, lookups = append(missing, r), append(missingIndices, i), append(lookups, cacheLookup{})
+			continue
+		}
+		l := c.lookup("value", v.meta.FullName+"@"+r.Version)
+		if l.isFresh(c.opts.ValueTTL) {
+			results[i].Data = l.cached.Value
+			continue
+		}
+		backend, err := v.getBackend(ctx)
+		if err != nil {
+			e, err := c.store(l, c.opts.ValueTTL, entry{}, err)
+			results[i] = secretmanager.KVValueResult{Data: e.Value, Err: err}
+			continue
+		}
+		r.Secret = backend
+		missing, missingIndices, lookups = append(missing, r), append(missingIndices, i), append(lookups, l)
+	}
+	if len(missing) == 0 {
+		return results
+	}
+	for j, result := range c.batch.GetValues(ctx, missing) {
+		if lookups[j].file != "" {
+			e, err := c.store(lookups[j], c.opts.ValueTTL, entry{Value: result.Data}, result.Err)
+			result = secretmanager.KVValueResult{Data: e.Value, Err: err}
+		}
+		results[missingIndices[j]] = result
+	}
+	return results
+}
+
+// entry is the decrypted content of a cache file
+type entry struct {
+	StoredAt time.Time
+	Secrets  []secretMeta `json:",omitempty"`
+	Value    []byte       `json:",omitempty"`
+}
+
+type secretMeta struct {
+	FullName  string
+	ShortName string
+	Labels    map[string]string
+}
+
+func metaOf(kv secretmanager.KVValue) secretMeta {
+	return secretMeta{FullName: kv.GetFullName(), ShortName: kv.GetShortName(), Labels: kv.GetLabels()}
+}
+
+func (c *Client) ListKeys(ctx context.Context) ([]secretmanager.KVValue, error) {
+	var backend []secretmanager.KVValue
+	e, err := c.fetch("list", c.project, c.opts.ListTTL, func() (e entry, err error) {
+		backend, err = c.KVClient.ListKeys(ctx)
+		for _, kv := range backend {
+			e.Secrets = append(e.Secrets, metaOf(kv))
+		}
+		return e, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]secretmanager.KVValue, len(e.Secrets))
+	for i, meta := range e.Secrets {
+		wrapped := &cacheKeyValue{meta: meta, client: c}
+		if len(backend) == len(e.Secrets) {
+			wrapped.backend = backend[i]
+		}
+		result[i] = wrapped
+	}
+	return result, nil
+}
+
+func (c *Client) Get(ctx context.Context, name string) (secretmanager.KVValue, error) {
+	var backend secretmanager.KVValue
+	e, err := c.fetch("secret", c.project+"/"+name, c.opts.ListTTL, func() (e entry, err error) {
+		if backend, err = c.KVClient.Get(ctx, name); err != nil {
+			return e, err
+		}
+		e.Secrets = []secretMeta{metaOf(backend)}
+		return e, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &cacheKeyValue{meta: e.Secrets[0], client: c, backend: backend}, nil
+}
+
+func (c *Client) New(ctx context.Context, name string, labels map[string]string) (secretmanager.KVValue, error) {
+	v, err := c.KVClient.New(ctx, name, labels)
+	if err != nil {
+		return nil, err
+	}
+	c.forget("list", c.project)
+	c.forget("secret", c.project+"/"+name)
+	return &cacheKeyValue{meta: metaOf(v), client: c, backend: v}, nil
+}
+
+// fetch returns the entry if it is fresh, otherwise it is loaded and stored.
+// When loading fails and the entry is not too old, the stale entry is returned.
+func (c *Client) fetch(kind, key string, ttl time.Duration, load func() (entry, error)) (entry, error) {
+	l := c.lookup(kind, key)
+	if l.isFresh(ttl) {
+		return l.cached, nil
+	}
+	e, err := load()
+	return c.store(l, ttl, e, err)
+}
+
+// cacheLookup is a cache file and its entry, if there is one
+type cacheLookup struct {
+	file, aad, key string
+	cached         entry
+	hasCached      bool
+	age            time.Duration
+}
+
+func (c *Client) lookup(kind, key string) (l cacheLookup) {
+	l.file, l.aad, l.key = c.path(kind, key), kind+"/"+key, key
+	l.cached, l.hasCached = c.read(l.file, l.aad)
+	if l.hasCached && l.cached.StoredAt.Before(c.getForgottenAt()) {
+		l.hasCached = false
+	}
+	l.age = c.opts.now().Sub(l.cached.StoredAt)
+	return l
+}
+
+func (l cacheLookup) isFresh(ttl time.Duration) bool {
+	return l.hasCached && l.age < ttl
+}
+
+// store writes the loaded entry. When loading failed and the cached entry is not too old, the stale entry is returned.
+func (c *Client) store(l cacheLookup, ttl time.Duration, e entry, err error) (entry, error) {
+	if err != nil {
+		if l.hasCached && l.age < ttl+c.opts.MaxStale && !isDefinitive(err) {
+			if c.opts.OnStale != nil {
+				c.opts.OnStale(strings.TrimSuffix(l.key, "@"), l.age, err)
+			}
+			return l.cached, nil
+		}
+		return entry{}, err
+	}
+	e.StoredAt = c.opts.now()
+	c.write(l.file, l.aad, e)
+	return e, nil
+}
+
+// isDefinitive errors are answers of Secret Manager, which a stale entry must not hide
+func isDefinitive(err error) bool {
+	if secretmanager.IsNotFound(err) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		switch grpcErr.GRPCStatus().Code() {
+		case codes.PermissionDenied, codes.Unauthenticated, codes.InvalidArgument, codes.FailedPrecondition:
+			return true
+		}
+	}
+	return false
+}
+
+// path hashes the key, values are grouped per secret so they can be forgotten at once
+func (c *Client) path(kind, key string) string {
+	if kind == "value" {
+		fullName := key[:strings.LastIndex(key, "@")]
+		return filepath.Join(c.opts.Dir, kind, hash(fullName), hash(key))
+	}
+	return filepath.Join(c.opts.Dir, kind, hash(key))
+}
+
+func hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// read decrypts a file. Missing, corrupt or undecryptable files (other key) are a miss.
+func (c *Client) read(file, aad string) (e entry, ok bool) {
+	data, err := ioutil.ReadFile(file)
+	nonceSize := c.aead.NonceSize()
+	if err != nil || len(data) < nonceSize {
+		return entry{}, false
+	}
+	plain, err := c.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(aad))
+	if err != nil || json.Unmarshal(plain, &e) != nil {
+		return entry{}, false
+	}
+	return e, true
+}
+
+// write encrypts and atomically replaces a file. Failures are ignored: the cache is an optimization.
+func (c *Client) write(file, aad string, e entry) {
+	plain, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".tmp-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(c.aead.Seal(nonce, nonce, plain, []byte(aad)))
+	if closeErr := tmp.Close(); err != nil || closeErr != nil {
+		return
+	}
+	os.Rename(tmp.Name(), file)
+}
+
+func (c *Client) forget(kind, key string) {
+	os.Remove(c.path(kind, key))
+}
+
+// Forget removes the cached listing, secret and values of shortName, so they are retrieved from Secret Manager again
+func (c *Client) Forget(shortName string) {
+	fullNames := map[string]bool{}
+	if e, ok := c.read(c.path("secret", c.project+"/"+shortName), "secret/"+c.project+"/"+shortName); ok {
+		fullNames[e.Secrets[0].FullName] = true
+	}
+	if e, ok := c.read(c.path("list", c.project), "list/"+c.project); ok {
+		for _, meta := range e.Secrets {
+			if meta.ShortName == shortName {
+				fullNames[meta.FullName] = true
+			}
+		}
+	}
+	c.forget("list", c.project)
+	c.forget("secret", c.project+"/"+shortName)
+	for fullName := range fullNames {
+		c.forgetValues(fullName)
+	}
+}
+
+// ForgetProject makes everything cached for the project a miss. File names are hashes, so instead of removing the files
+// the time is stored: entries stored earlier are ignored, also by a restarted process.
+func (c *Client) ForgetProject() {
+	now := c.opts.now()
+	c.forgottenAtM.Lock()
+	c.forgottenAt = now
+	c.forgottenAtM.Unlock()
+	c.forget("list", c.project)
+	c.write(c.path("forgotten", c.project), "forgotten/"+c.project, entry{StoredAt: now})
+}
+
+func (c *Client) getForgottenAt() time.Time {
+	c.forgottenAtM.Lock()
+	defer c.forgottenAtM.Unlock()
+	return c.forgottenAt
+}
+
+// forgetValues removes all cached versions of a secret
+func (c *Client) forgetValues(fullName string) {
+	os.RemoveAll(filepath.Dir(c.path("value", fullName+"@")))
+}
+
+// cacheKeyValue is a secret that might come from the cache. The Secret Manager secret is only retrieved when needed.
+type cacheKeyValue struct {
+	meta     secretMeta
+	client   *Client
+	backendM sync.Mutex
+	backend  secretmanager.KVValue
+}
+
+func (v *cacheKeyValue) GetFullName() string          { return v.meta.FullName }
+func (v *cacheKeyValue) GetShortName() string         { return v.meta.ShortName }
+func (v *cacheKeyValue) GetLabels() map[string]string { return v.meta.Labels }
+
+func (v *cacheKeyValue) getBackend(ctx context.Context) (secretmanager.KVValue, error) {
+	v.backendM.Lock()
+	defer v.backendM.Unlock()
+	if v.backend == nil {
+		backend, err := v.client.KVClient.Get(ctx, v.meta.ShortName)
+		if err != nil {
+			return nil, err
+		}
+		v.backend = backend
+	}
+	return v.backend, nil
+}
+
+func (v *cacheKeyValue) GetValue(ctx context.Context) ([]byte, error) {
+	return v.GetVersionValue(ctx, "")
+}
+
+// GetVersionValue gets the latest value if version is empty
+func (v *cacheKeyValue) GetVersionValue(ctx context.Context, version string) ([]byte, error) {
+	e, err := v.client.fetch("value", v.meta.FullName+"@"+version, v.client.opts.ValueTTL, func() (e entry, err error) {
+		backend, err := v.getBackend(ctx)
+		if err != nil {
+			return e, err
+		}
+		if version == "" {
+			e.Value, err = backend.GetValue(ctx)
+		} else {
+			e.Value, err = backend.GetVersionValue(ctx, version)
+		}
+		return e, err
+	})
+	return e.Value, err
+}
+
+// ListVersions is not cached: it is used to pin or inspect versions, which should reflect the current state
+func (v *cacheKeyValue) ListVersions(ctx context.Context) ([]secretmanager.KVVersion, error) {
+	backend, err := v.getBackend(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return backend.ListVersions(ctx)
+}
+
+func (v *cacheKeyValue) SetValue(ctx context.Context, data []byte) (string, error) {
+	backend, err := v.getBackend(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer v.client.forgetValues(v.meta.FullName)
+	return backend.SetValue(ctx, data)
+}
+
+func (v *cacheKeyValue) SetLabels(ctx context.Context, labels map[string]string) error {
+	backend, err := v.getBackend(ctx)
+	if err != nil {
+		return err
+	}
+	defer v.client.forget("list", v.client.project)
+	defer v.client.forget("secret", v.client.project+"/"+v.meta.ShortName)
+	if err = backend.SetLabels(ctx, labels); err != nil {
+		return err
+	}
+	v.meta.Labels = labels
+	return nil
+}
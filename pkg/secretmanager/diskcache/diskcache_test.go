@@ -0,0 +1,230 @@
+package diskcache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// countingClient counts the calls to the in-memory client, and fails all calls with err when set
+type countingClient struct {
+	secretmanager.KVClient
+	calls int32
+	err   error
+}
+
+func (c *countingClient) ListKeys(ctx context.Context) ([]secretmanager.KVValue, error) {
+	atomic.AddInt32(&c.calls, 1)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.KVClient.ListKeys(ctx)
+}
+
+func (c *countingClient) Get(ctx context.Context, name string) (secretmanager.KVValue, error) {
+	atomic.AddInt32(&c.calls, 1)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.KVClient.Get(ctx, name)
+}
+
+type testSetup struct {
+	backend *countingClient
+	dir     string
+	now     time.Time
+	stale   []string
+}
+
+func newTestSetup(t *testing.T) *testSetup {
+	return &testSetup{
+		backend: &countingClient{KVClient: secretmanager.NewInMemoryClient("my-project", "foo", "bar")},
+		dir:     t.TempDir(),
+		now:     time.Unix(1600000000, 0),
+	}
+}
+
+// client simulates a new process using the same cache directory
+func (s *testSetup) client(t *testing.T, key string) *Client {
+	parsed, err := ParseKey(key)
+	assert.NoError(t, err)
+	c, err := New(s.backend, "my-project", Options{
+		Dir:      s.dir,
+		Key:      parsed,
+		ListTTL:  time.Minute,
+		ValueTTL: time.Minute,
+		MaxStale: time.Hour,
+		OnStale:  func(name string, age time.Duration, err error) { s.stale = append(s.stale, name) },
+		now:      func() time.Time { return s.now },
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return c
+}
+
+const testKey = "0123456789abcdef0123456789abcdef"
+
+func getValue(t *testing.T, c *Client, name string) (string, error) {
+	ctx := context.Background()
+	secret, err := c.Get(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	value, err := secret.GetValue(ctx)
+	return string(value), err
+}
+
+func TestDiskCacheWarmStart(t *testing.T) {
+	s := newTestSetup(t)
+	value, err := getValue(t, s.client(t, testKey), "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", value)
+	calls := s.backend.calls
+
+	// A new process does not contact Secret Manager while the entries are fresh
+	s.now = s.now.Add(30 * time.Second)
+	value, err = getValue(t, s.client(t, testKey), "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", value)
+	assert.Equal(t, calls, s.backend.calls)
+
+	keys, err := s.client(t, testKey).ListKeys(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, secretmanager.SecretShortNames(keys))
+	keys, err = s.client(t, testKey).ListKeys(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, secretmanager.SecretShortNames(keys))
+	assert.Equal(t, calls+1, s.backend.calls, "listed once")
+}
+
+func TestDiskCacheTTL(t *testing.T) {
+	s := newTestSetup(t)
+	c := s.client(t, testKey)
+	_, err := getValue(t, c, "foo")
+	assert.NoError(t, err)
+
+	secret, err := s.backend.KVClient.Get(context.Background(), "foo")
+	assert.NoError(t, err)
+	_, err = secret.SetValue(context.Background(), []byte("baz"))
+	assert.NoError(t, err)
+	value, _ := getValue(t, c, "foo")
+	assert.Equal(t, "bar", value, "fresh")
+
+	s.now = s.now.Add(2 * time.Minute)
+	value, err = getValue(t, c, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "baz", value, "expired")
+}
+
+func TestDiskCacheOffline(t *testing.T) {
+	s := newTestSetup(t)
+	_, err := getValue(t, s.client(t, testKey), "foo")
+	assert.NoError(t, err)
+
+	s.backend.err = status.Error(codes.Unavailable, "offline")
+	s.now = s.now.Add(30 * time.Minute)
+	value, err := getValue(t, s.client(t, testKey), "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", value, "stale while offline")
+	assert.Equal(t, []string{"my-project/foo", "project/my-project/secrets/foo"}, s.stale)
+
+	s.now = s.now.Add(2 * time.Hour)
+	_, err = getValue(t, s.client(t, testKey), "foo")
+	assert.Error(t, err, "too old")
+
+	s.backend.err = status.Error(codes.PermissionDenied, "revoked")
+	s.now = s.now.Add(-2 * time.Hour)
+	_, err = getValue(t, s.client(t, testKey), "foo")
+	assert.Error(t, err, "permission denied is not masked")
+}
+
+func TestDiskCacheEncrypted(t *testing.T) {
+	s := newTestSetup(t)
+	_, err := getValue(t, s.client(t, testKey), "foo")
+	assert.NoError(t, err)
+
+	files := 0
+	filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if info.IsDir() {
+			return nil
+		}
+		files++
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		data, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data), "bar")
+		assert.NotContains(t, path, "foo")
+		return nil
+	})
+	assert.Equal(t, 2, files, "secret and value")
+
+	// Another key cannot read the entries
+	calls := s.backend.calls
+	value, err := getValue(t, s.client(t, strings.Repeat("x", 32)), "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", value)
+	assert.Equal(t, calls+1, s.backend.calls)
+
+	_, err = ParseKey("too short")
+	assert.Error(t, err)
+}
+
+func TestDiskCacheSetValueForgets(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSetup(t)
+	c := s.client(t, testKey)
+	secret, err := c.Get(ctx, "foo")
+	assert.NoError(t, err)
+	_, err = secret.GetValue(ctx)
+	assert.NoError(t, err)
+
+	_, err = secret.SetValue(ctx, []byte("baz"))
+	assert.NoError(t, err)
+	value, err := secret.GetValue(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "baz", string(value))
+}
+
+func TestDiskCacheForget(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSetup(t)
+	c := s.client(t, testKey)
+	_, err := getValue(t, c, "foo")
+	assert.NoError(t, err)
+	secret, err := s.backend.KVClient.Get(ctx, "foo")
+	assert.NoError(t, err)
+	_, err = secret.SetValue(ctx, []byte("baz"))
+	assert.NoError(t, err)
+	value, err := getValue(t, c, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", value, "cached")
+
+	c.Forget("foo")
+	value, err = getValue(t, c, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "baz", value, "forgotten secret")
+
+	_, err = secret.SetValue(ctx, []byte("qux"))
+	assert.NoError(t, err)
+	s.now = s.now.Add(time.Second)
+	c.ForgetProject()
+	value, err = getValue(t, s.client(t, testKey), "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "qux", value, "forgotten project, also after a restart")
+	calls := atomic.LoadInt32(&s.backend.calls)
+	value, err = getValue(t, s.client(t, testKey), "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "qux", value)
+	assert.Equal(t, calls, atomic.LoadInt32(&s.backend.calls), "entries stored after ForgetProject are used")
+}
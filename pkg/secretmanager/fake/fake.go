@@ -0,0 +1,346 @@
+// Fake is an in-process Secret Manager gRPC server backed by memory, for end-to-end tests and local development.
+// Point the real client at it using secretmanager.NewClient(ctx, project, secretmanager.WithEndpoint(endpoint)...).
+// It implements the secret and version methods, the IAM methods are unimplemented.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultPageSize is used when the request has no page size, like the Secret Manager API
+const defaultPageSize = 25000
+
+// Server implements secretmanagerpb.SecretManagerServiceServer
+type Server struct {
+	secretmanagerpb.UnimplementedSecretManagerServiceServer
+	m       sync.Mutex
+	secrets map[string]*secret // by "projects/*/secrets/*"
+	// serving
+	grpcServer *grpc.Server
+}
+
+type secret struct {
+	meta     *secretmanagerpb.Secret
+	versions []*version // in creation order, so version N is at index N-1
+}
+
+type version struct {
+	meta *secretmanagerpb.SecretVersion
+	data []byte
+}
+
+var _ secretmanagerpb.SecretManagerServiceServer = &Server{}
+
+func New() *Server {
+	return &Server{secrets: make(map[string]*secret)}
+}
+
+// Seed adds a secret with a version for every value, the last value is the latest version
+func (s *Server) Seed(project, name string, labels map[string]string, values ...string) {
+	ctx := context.Background()
+	parent := fmt.Sprintf("projects/%s/secrets/%s", project, name)
+	if _, err := s.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{Name: parent}); err != nil {
+		_, err = s.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+			Parent:   "projects/" + project,
+			SecretId: name,
+			Secret:   &secretmanagerpb.Secret{Labels: labels},
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	for _, value := range values {
+		if _, err := s.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+			Parent:  parent,
+			Payload: &secretmanagerpb.SecretPayload{Data: []byte(value)},
+		}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Listen starts serving on address in the background; use "127.0.0.1:0" for a random port.
+// The returned endpoint can be passed to secretmanager.WithEndpoint.
+func (s *Server) Listen(address string) (endpoint string, err error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return "", err
+	}
+	s.grpcServer = grpc.NewServer()
+	secretmanagerpb.RegisterSecretManagerServiceServer(s.grpcServer, s)
+	go s.grpcServer.Serve(listener)
+	return listener.Addr().String(), nil
+}
+
+// Stop stops serving, if Listen was called
+func (s *Server) Stop() {
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+}
+
+func (s *Server) ListSecrets(ctx context.Context, req *secretmanagerpb.ListSecretsRequest) (*secretmanagerpb.ListSecretsResponse, error) {
+	if _, err := parseName(req.Parent, "projects"); err != nil {
+		return nil, err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	names := []string{}
+	for name := range s.secrets {
+		if strings.HasPrefix(name, req.Parent+"/secrets/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	start, end, next, err := page(len(names), req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	resp := &secretmanagerpb.ListSecretsResponse{NextPageToken: next, TotalSize: int32(len(names))}
+	for _, name := range names[start:end] {
+		resp.Secrets = append(resp.Secrets, proto.Clone(s.secrets[name].meta).(*secretmanagerpb.Secret))
+	}
+	return resp, nil
+}
+
+func (s *Server) CreateSecret(ctx context.Context, req *secretmanagerpb.CreateSecretRequest) (*secretmanagerpb.Secret, error) {
+	if _, err := parseName(req.Parent, "projects"); err != nil {
+		return nil, err
+	}
+	if req.SecretId == "" || strings.Contains(req.SecretId, "/") {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid secret id %q", req.SecretId)
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	name := req.Parent + "/secrets/" + req.SecretId
+	if _, exists := s.secrets[name]; exists {
+		return nil, status.Errorf(codes.AlreadyExists, "Secret [%s] already exists.", name)
+	}
+	meta := &secretmanagerpb.Secret{}
+	if req.Secret != nil {
+		meta = proto.Clone(req.Secret).(*secretmanagerpb.Secret)
+	}
+	meta.Name = name
+	meta.CreateTime = s.now()
+	s.secrets[name] = &secret{meta: meta}
+	return proto.Clone(meta).(*secretmanagerpb.Secret), nil
+}
+
+func (s *Server) AddSecretVersion(ctx context.Context, req *secretmanagerpb.AddSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	sec, err := s.secret(req.Parent)
+	if err != nil {
+		return nil, err
+	}
+	meta := &secretmanagerpb.SecretVersion{
+		Name:       fmt.Sprintf("%s/versions/%d", req.Parent, len(sec.versions)+1),
+		CreateTime: s.now(),
+		State:      secretmanagerpb.SecretVersion_ENABLED,
+	}
+	sec.versions = append(sec.versions, &version{meta: meta, data: req.GetPayload().GetData()})
+	return proto.Clone(meta).(*secretmanagerpb.SecretVersion), nil
+}
+
+func (s *Server) GetSecret(ctx context.Context, req *secretmanagerpb.GetSecretRequest) (*secretmanagerpb.Secret, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	sec, err := s.secret(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(sec.meta).(*secretmanagerpb.Secret), nil
+}
+
+// UpdateSecret only supports updating labels, like sema uses it
+func (s *Server) UpdateSecret(ctx context.Context, req *secretmanagerpb.UpdateSecretRequest) (*secretmanagerpb.Secret, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	sec, err := s.secret(req.GetSecret().GetName())
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range req.GetUpdateMask().GetPaths() {
+		if path != "labels" {
+			return nil, status.Errorf(codes.InvalidArgument, "the fake cannot update %q", path)
+		}
+		sec.meta.Labels = req.Secret.Labels
+	}
+	return proto.Clone(sec.meta).(*secretmanagerpb.Secret), nil
+}
+
+func (s *Server) DeleteSecret(ctx context.Context, req *secretmanagerpb.DeleteSecretRequest) (*empty.Empty, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, err := s.secret(req.Name); err != nil {
+		return nil, err
+	}
+	delete(s.secrets, req.Name)
+	return &empty.Empty{}, nil
+}
+
+// ListSecretVersions lists the newest version first, like Secret Manager does
+func (s *Server) ListSecretVersions(ctx context.Context, req *secretmanagerpb.ListSecretVersionsRequest) (*secretmanagerpb.ListSecretVersionsResponse, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	sec, err := s.secret(req.Parent)
+	if err != nil {
+		return nil, err
+	}
+	start, end, next, err := page(len(sec.versions), req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	resp := &secretmanagerpb.ListSecretVersionsResponse{NextPageToken: next, TotalSize: int32(len(sec.versions))}
+	for i := start; i < end; i++ {
+		v := sec.versions[len(sec.versions)-1-i]
+		resp.Versions = append(resp.Versions, proto.Clone(v.meta).(*secretmanagerpb.SecretVersion))
+	}
+	return resp, nil
+}
+
+func (s *Server) GetSecretVersion(ctx context.Context, req *secretmanagerpb.GetSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	v, err := s.version(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(v.meta).(*secretmanagerpb.SecretVersion), nil
+}
+
+func (s *Server) AccessSecretVersion(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	v, err := s.version(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if v.meta.State != secretmanagerpb.SecretVersion_ENABLED {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is in %s state.", v.meta.Name, v.meta.State)
+	}
+	return &secretmanagerpb.AccessSecretVersionResponse{
+		Name:    v.meta.Name,
+		Payload: &secretmanagerpb.SecretPayload{Data: append([]byte{}, v.data...)},
+	}, nil
+}
+
+func (s *Server) DisableSecretVersion(ctx context.Context, req *secretmanagerpb.DisableSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	return s.setState(req.Name, secretmanagerpb.SecretVersion_DISABLED)
+}
+
+func (s *Server) EnableSecretVersion(ctx context.Context, req *secretmanagerpb.EnableSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	return s.setState(req.Name, secretmanagerpb.SecretVersion_ENABLED)
+}
+
+func (s *Server) DestroySecretVersion(ctx context.Context, req *secretmanagerpb.DestroySecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	return s.setState(req.Name, secretmanagerpb.SecretVersion_DESTROYED)
+}
+
+func (s *Server) setState(name string, state secretmanagerpb.SecretVersion_State) (*secretmanagerpb.SecretVersion, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	v, err := s.version(name)
+	if err != nil {
+		return nil, err
+	}
+	if v.meta.State == secretmanagerpb.SecretVersion_DESTROYED {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is in DESTROYED state.", v.meta.Name)
+	}
+	v.meta.State = state
+	if state == secretmanagerpb.SecretVersion_DESTROYED {
+		v.meta.DestroyTime = s.now()
+		v.data = nil
+	}
+	return proto.Clone(v.meta).(*secretmanagerpb.SecretVersion), nil
+}
+
+// secret finds a secret by "projects/*/secrets/*", s.m must be locked
+func (s *Server) secret(name string) (*secret, error) {
+	if _, err := parseName(name, "projects", "secrets"); err != nil {
+		return nil, err
+	}
+	sec, exists := s.secrets[name]
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "Secret [%s] not found.", name)
+	}
+	return sec, nil
+}
+
+// version finds a version by "projects/*/secrets/*/versions/*", including the "latest" alias. s.m must be locked
+func (s *Server) version(name string) (*version, error) {
+	parts, err := parseName(name, "projects", "secrets", "versions")
+	if err != nil {
+		return nil, err
+	}
+	sec, err := s.secret(strings.Join(parts[:4], "/"))
+	if err != nil {
+		return nil, err
+	}
+	if parts[5] == "latest" {
+		// The most recently created version, regardless of state
+		if len(sec.versions) == 0 {
+			return nil, status.Errorf(codes.NotFound, "Secret Version [%s] not found.", name)
+		}
+		return sec.versions[len(sec.versions)-1], nil
+	}
+	number, err := strconv.Atoi(parts[5])
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid version %q", parts[5])
+	}
+	if number < 1 || number > len(sec.versions) {
+		return nil, status.Errorf(codes.NotFound, "Secret Version [%s] not found.", name)
+	}
+	return sec.versions[number-1], nil
+}
+
+// now returns the current time with second precision, so versions created in the same second have the same create time
+func (s *Server) now() *timestamp.Timestamp {
+	return &timestamp.Timestamp{Seconds: time.Now().Unix()}
+}
+
+// parseName checks that name has the format "collection/id/collection/id"
+func parseName(name string, collections ...string) ([]string, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 2*len(collections) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid resource name %q", name)
+	}
+	for i, collection := range collections {
+		if parts[2*i] != collection || parts[2*i+1] == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid resource name %q", name)
+		}
+	}
+	return parts, nil
+}
+
+// page returns the range of items for the page, and the token of the next page. Tokens are offsets.
+func page(total int, pageSize int32, pageToken string) (start, end int, next string, err error) {
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageToken != "" {
+		if start, err = strconv.Atoi(pageToken); err != nil || start < 0 || start > total {
+			return 0, 0, "", status.Errorf(codes.InvalidArgument, "invalid page token %q", pageToken)
+		}
+	}
+	end = start + int(pageSize)
+	if end >= total {
+		return start, total, "", nil
+	}
+	return start, end, strconv.Itoa(end), nil
+}
@@ -1,7 +1,12 @@
 package secretmanager
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 type memoryKVClient struct {
@@ -10,11 +15,17 @@ type memoryKVClient struct {
 }
 
 type memoryKVValue struct {
-	client *memoryKVClient
-	key    string
-	path   string
-	values [][]byte
-	labels map[string]string
+	client   *memoryKVClient
+	key      string
+	path     string
+	versions []memoryKVVersion
+	labels   map[string]string
+}
+
+type memoryKVVersion struct {
+	data    []byte
+	state   string
+	created time.Time
 }
 
 var _ KVClient = &memoryKVClient{}
@@ -29,16 +40,19 @@ func NewInMemoryClient(project string, keyValues ...string) KVClient {
 	c := memoryKVClient{prefix: prefix, data: make(map[string]*memoryKVValue, 0)}
 	for i := 0; i < len(keyValues); i += 2 {
 		c.data[keyValues[i]] = &memoryKVValue{
-			client: &c,
-			key:    keyValues[i],
-			path:   fmt.Sprintf("%s/%s", c.prefix, keyValues[i]),
-			values: [][]byte{[]byte(keyValues[i+1])},
-			labels: make(map[string]string)}
+			client:   &c,
+			key:      keyValues[i],
+			path:     fmt.Sprintf("%s/%s", c.prefix, keyValues[i]),
+			versions: []memoryKVVersion{{data: []byte(keyValues[i+1]), state: VersionEnabled, created: time.Now()}},
+			labels:   make(map[string]string)}
 	}
 	return &c
 }
 
-func (c *memoryKVClient) ListKeys() ([]KVValue, error) {
+func (c *memoryKVClient) ListKeys(ctx context.Context) ([]KVValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	list := []KVValue{}
 	for _, v := range c.data {
 		list = append(list, KVValue(v))
@@ -46,21 +60,27 @@ func (c *memoryKVClient) ListKeys() ([]KVValue, error) {
 	return list, nil
 }
 
-func (c *memoryKVClient) Get(name string) (KVValue, error) {
+func (c *memoryKVClient) Get(ctx context.Context, name string) (KVValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	val, ok := c.data[name]
 	if ok {
 		return KVValue(val), nil
 	}
-	return nil, fmt.Errorf("404: %q", name)
+	return nil, errors.Wrap(ErrNotFound, fmt.Sprintf("404: %q", name))
 }
 
-func (c *memoryKVClient) New(name string, labels map[string]string) (KVValue, error) {
+func (c *memoryKVClient) New(ctx context.Context, name string, labels map[string]string) (KVValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	v := memoryKVValue{
-		client: c,
-		key:    name,
-		path:   fmt.Sprintf("%s/%s", c.prefix, name),
-		values: [][]byte{},
-		labels: labels}
+		client:   c,
+		key:      name,
+		path:     fmt.Sprintf("%s/%s", c.prefix, name),
+		versions: []memoryKVVersion{},
+		labels:   labels}
 	c.data[name] = &v
 	return KVValue(&v), nil
 }
@@ -71,18 +91,61 @@ func (v *memoryKVValue) GetFullName() string {
 func (v *memoryKVValue) GetShortName() string {
 	return v.key
 }
-func (v *memoryKVValue) GetValue() ([]byte, error) {
-	return v.values[len(v.values)-1], nil
-
+func (v *memoryKVValue) GetValue(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for i := len(v.versions) - 1; i >= 0; i-- {
+		if v.versions[i].state == VersionEnabled {
+			return v.versions[i].data, nil
+		}
+	}
+	return nil, errors.Wrap(ErrNoVersions, fmt.Sprintf("Secret %q", v.key))
 }
 func (v *memoryKVValue) GetLabels() map[string]string {
 	return v.labels
 }
-func (v *memoryKVValue) SetLabels(l map[string]string) error {
+func (v *memoryKVValue) SetLabels(ctx context.Context, l map[string]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	v.labels = l
 	return nil
 }
-func (v *memoryKVValue) SetValue(data []byte) (string, error) {
-	v.values = append(v.values, data)
-	return fmt.Sprintf("%s/%d", v.GetFullName(), len(v.values)), nil
+func (v *memoryKVValue) SetValue(ctx context.Context, data []byte) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	v.versions = append(v.versions, memoryKVVersion{data: data, state: VersionEnabled, created: time.Now()})
+	return fmt.Sprintf("%s/%d", v.GetFullName(), len(v.versions)), nil
+}
+
+// ListVersions numbers the versions like Secret Manager does: starting at 1
+func (v *memoryKVValue) ListVersions(ctx context.Context) ([]KVVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	list := make([]KVVersion, 0, len(v.versions))
+	for i := len(v.versions) - 1; i >= 0; i-- {
+		list = append(list, KVVersion{
+			Name:       fmt.Sprintf("%s/versions/%d", v.path, i+1),
+			Version:    strconv.Itoa(i + 1),
+			State:      v.versions[i].state,
+			CreateTime: v.versions[i].created,
+		})
+	}
+	return list, nil
+}
+func (v *memoryKVValue) GetVersionValue(ctx context.Context, version string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if version == "latest" {
+		return v.GetValue(ctx)
+	}
+	i, err := strconv.Atoi(version)
+	if err != nil || i < 1 || i > len(v.versions) || v.versions[i-1].state != VersionEnabled {
+		return nil, errors.Wrap(ErrVersionNotFound, fmt.Sprintf("Secret %q version %q", v.key, version))
+	}
+	return v.versions[i-1].data, nil
 }
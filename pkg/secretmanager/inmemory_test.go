@@ -0,0 +1,65 @@
+package secretmanager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestInMemoryClientCancelled(t *testing.T) {
+	client := NewInMemoryClient("my-project", "foo", "bar")
+	secret, err := client.Get(context.Background(), "foo")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.ListKeys(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = client.Get(ctx, "foo")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = secret.GetValue(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = secret.SetValue(ctx, []byte("baz"))
+	assert.ErrorIs(t, err, context.Canceled)
+
+	value, err := secret.GetValue(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", string(value), "cancelled SetValue should not have written")
+}
+
+func TestInMemoryClientVersions(t *testing.T) {
+	ctx := context.Background()
+	client := NewInMemoryClient("my-project", "foo", "v1")
+	secret, _ := client.Get(ctx, "foo")
+	_, err := secret.SetValue(ctx, []byte("v2"))
+	assert.NoError(t, err)
+
+	versions, err := secret.ListVersions(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, "2", versions[0].Version, "newest version should be first")
+	assert.Equal(t, "project/my-project/secrets/foo/versions/1", versions[1].Name)
+	assert.Equal(t, VersionEnabled, versions[1].State)
+
+	value, err := secret.GetVersionValue(ctx, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", string(value))
+	value, err = secret.GetValue(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(value))
+
+	_, err = secret.GetVersionValue(ctx, "3")
+	assert.ErrorIs(t, err, ErrVersionNotFound)
+}
+
+func TestIsNotFound(t *testing.T) {
+	client := NewInMemoryClient("my-project", "foo", "bar")
+	_, err := client.Get(context.Background(), "missing")
+	assert.True(t, IsNotFound(err))
+	assert.True(t, IsNotFound(status.Error(codes.NotFound, "Secret [projects/1/secrets/missing] not found")))
+	assert.False(t, IsNotFound(status.Error(codes.PermissionDenied, "Permission denied")))
+	assert.False(t, IsNotFound(nil))
+}
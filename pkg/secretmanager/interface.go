@@ -1,18 +1,61 @@
 package secretmanager
 
+import (
+	"context"
+	"time"
+)
+
 // KVClient is a generic interface implemented by SecretManager and a mock
 type KVClient interface {
-	ListKeys() ([]KVValue, error)
-	Get(name string) (KVValue, error)
-	New(name string, labels map[string]string) (KVValue, error)
+	ListKeys(ctx context.Context) ([]KVValue, error)
+	Get(ctx context.Context, name string) (KVValue, error)
+	New(ctx context.Context, name string, labels map[string]string) (KVValue, error)
+}
+
+// KVBatchClient is implemented by clients that can retrieve many values in a single request, see handlers.Prefetch
+type KVBatchClient interface {
+	KVClient
+	// GetValues returns a result for every request, in the same order. A failed value does not fail the others.
+	GetValues(ctx context.Context, requests []KVValueRequest) []KVValueResult
+}
+
+// KVValueRequest is a value to retrieve using KVBatchClient
+type KVValueRequest struct {
+	Secret  KVValue
+	Version string // empty means latest
+}
+
+// KVValueResult is a retrieved value, or the reason it could not be retrieved
+type KVValueResult struct {
+	Data []byte
+	Err  error
 }
 
 // KVValue represents a versions secret data storage
 type KVValue interface {
 	GetFullName() string
 	GetShortName() string
-	GetValue() ([]byte, error)
+	GetValue(ctx context.Context) ([]byte, error)
 	GetLabels() map[string]string
-	SetLabels(labels map[string]string) error
-	SetValue([]byte) (string, error)
+	SetLabels(ctx context.Context, labels map[string]string) error
+	SetValue(ctx context.Context, data []byte) (string, error)
+	// ListVersions returns all versions, newest first
+	ListVersions(ctx context.Context) ([]KVVersion, error)
+	// GetVersionValue reads an explicit version, like "7"
+	GetVersionValue(ctx context.Context, version string) ([]byte, error)
+}
+
+// Version states, equal to the Secret Manager names
+const (
+	VersionEnabled   = "ENABLED"
+	VersionDisabled  = "DISABLED"
+	VersionDestroyed = "DESTROYED"
+)
+
+// KVVersion describes a single version of a KVValue
+type KVVersion struct {
+	Name       string // format: "projects/*/secrets/*/versions/*"
+	Version    string // the last part of Name, example: "7"
+	State      string
+	CreateTime time.Time
 }
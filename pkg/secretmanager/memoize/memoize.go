@@ -0,0 +1,156 @@
+// Memoize is a small wrapper around KVClient that remembers the retrieved values, so they can be retrieved ahead of time (see handlers.Prefetch).
+// Only values are remembered, not listings. Failed retrievals are remembered as well, so a failure is not retrieved twice,
+// except when the context was canceled. Setting a value forgets the remembered values of that secret.
+// Combine with singleflight to also deduplicate concurrent retrievals: memoize.New(singleflight.New(client)).
+// If c is a secretmanager.KVBatchClient, so is the result: only the values that are not remembered are requested.
+package memoize
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+)
+
+func New(c secretmanager.KVClient) secretmanager.KVClient {
+	client := &memoizeClient{KVClient: c, values: make(map[string]map[string]memoized)}
+	if batch, isBatch := c.(secretmanager.KVBatchClient); isBatch {
+		return &memoizeBatchClient{memoizeClient: client, batch: batch}
+	}
+	return client
+}
+
+type memoizeClient struct {
+	secretmanager.KVClient
+	valuesM sync.Mutex
+	values  map[string]map[string]memoized // full name => version ("" is latest) => value
+}
+
+type memoized struct {
+	data []byte
+	err  error
+}
+
+var _ secretmanager.KVClient = &memoizeClient{}
+
+func (c *memoizeClient) ListKeys(ctx context.Context) ([]secretmanager.KVValue, error) {
+	list, err := c.KVClient.ListKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Wrap returned kv's
+	result := make([]secretmanager.KVValue, len(list))
+	for i := range list {
+		result[i] = &memoizeKeyValue{KVValue: list[i], client: c}
+	}
+	return result, nil
+}
+
+func (c *memoizeClient) Get(ctx context.Context, name string) (secretmanager.KVValue, error) {
+	v, err := c.KVClient.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	// Wrap returned kv
+	return &memoizeKeyValue{KVValue: v, client: c}, nil
+}
+
+func (c *memoizeClient) New(ctx context.Context, name string, labels map[string]string) (secretmanager.KVValue, error) {
+	v, err := c.KVClient.New(ctx, name, labels)
+	if err != nil {
+		return nil, err
+	}
+	// Wrap returned kv
+	return &memoizeKeyValue{KVValue: v, client: c}, nil
+}
+
+func (c *memoizeClient) load(fullName, version string, retrieve func() ([]byte, error)) ([]byte, error) {
+	if m, hit := c.remembered(fullName, version); hit {
+		return m.data, m.err
+	}
+	data, err := retrieve()
+	c.remember(fullName, version, data, err)
+	return data, err
+}
+
+func (c *memoizeClient) remembered(fullName, version string) (memoized, bool) {
+	c.valuesM.Lock()
+	defer c.valuesM.Unlock()
+	m, hit := c.values[fullName][version]
+	return m, hit
+}
+
+// remember stores the result of a retrieval, unless it was stopped by the context of that particular caller
+func (c *memoizeClient) remember(fullName, version string, data []byte, err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	c.valuesM.Lock()
+	defer c.valuesM.Unlock()
+	if c.values[fullName] == nil {
+		c.values[fullName] = make(map[string]memoized)
+	}
+	c.values[fullName][version] = memoized{data: data, err: err}
+}
+
+func (c *memoizeClient) forget(fullName string) {
+	c.valuesM.Lock()
+	defer c.valuesM.Unlock()
+	delete(c.values, fullName)
+}
+
+type memoizeKeyValue struct {
+	secretmanager.KVValue
+	client *memoizeClient
+}
+
+func (m *memoizeKeyValue) GetValue(ctx context.Context) ([]byte, error) {
+	return m.client.load(m.KVValue.GetFullName(), "", func() ([]byte, error) {
+		return m.KVValue.GetValue(ctx)
+	})
+}
+
+func (m *memoizeKeyValue) GetVersionValue(ctx context.Context, version string) ([]byte, error) {
+	return m.client.load(m.KVValue.GetFullName(), version, func() ([]byte, error) {
+		return m.KVValue.GetVersionValue(ctx, version)
+	})
+}
+
+func (m *memoizeKeyValue) SetValue(ctx context.Context, data []byte) (string, error) {
+	defer m.client.forget(m.KVValue.GetFullName())
+	return m.KVValue.SetValue(ctx, data)
+}
+
+type memoizeBatchClient struct {
+	*memoizeClient
+	batch secretmanager.KVBatchClient
+}
+
+var _ secretmanager.KVBatchClient = &memoizeBatchClient{}
+
+// GetValues only requests the values that are not remembered, and remembers the results
+func (c *memoizeBatchClient) GetValues(ctx context.Context, requests []secretmanager.KVValueRequest) []secretmanager.KVValueResult {
+	results := make([]secretmanager.KVValueResult, len(requests))
+	var missing []secretmanager.KVValueRequest
+	var missingIndices []int
+	for i, r := range requests {
+		if m, hit := c.remembered(r.Secret.GetFullName(), r.Version); hit {
+			results[i] = secretmanager.KVValueResult{Data: m.data, Err: m.err}
+			continue
+		}
+		if m, isMemoized := r.Secret.(*memoizeKeyValue); isMemoized {
+			r.Secret = m.KVValue
+		}
+		missing = append(missing, r)
+		missingIndices = append(missingIndices, i)
+	}
+	if len(missing) == 0 {
+		return results
+	}
+	for j, result := range c.batch.GetValues(ctx, missing) {
+		c.remember(missing[j].Secret.GetFullName(), missing[j].Version, result.Data, result.Err)
+		results[missingIndices[j]] = result
+	}
+	return results
+}
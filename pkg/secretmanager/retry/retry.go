@@ -0,0 +1,273 @@
+// Retry is a wrapper around KVClient that retries failed reads with exponential backoff and jitter,
+// and limits the request rate client-side. When Secret Manager reports that the quota is exhausted,
+// all requests of the client hold off, not only the failed one.
+// Writes (New, SetValue) are rate limited but never retried, because they might have succeeded.
+// Compose with the other wrappers: singleflight.New(retry.New(client, retry.Options{})).
+package retry
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Options configure New, zero values use the defaults
+type Options struct {
+	MaxAttempts    int              // including the first attempt, default 5
+	InitialBackoff time.Duration    // default 200ms, doubles every attempt
+	MaxBackoff     time.Duration    // default 10s
+	Jitter         float64          // randomizes the backoff by up to this fraction, default 0.2
+	RateLimit      float64          // maximum requests per second, 0 is unlimited
+	Retryable      func(error) bool // default IsRetryable
+
+	// Testing
+	sleep  func(ctx context.Context, d time.Duration) error
+	random func() float64
+}
+
+// Stats counts what the client did, for --verbose output
+type Stats struct {
+	Requests int64 // including retries
+	Retries  int64
+	Failures int64 // requests that failed after all attempts
+}
+
+// Client is a KVClient, which also reports Stats
+type Client struct {
+	secretmanager.KVClient
+	opts     Options
+	requests int64
+	retries  int64
+	failures int64
+	// rate limiting, guarded by limitM
+	limitM      sync.Mutex
+	next        time.Time
+	pausedUntil time.Time
+}
+
+var _ secretmanager.KVClient = &Client{}
+
+func New(c secretmanager.KVClient, opts Options) *Client {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = 200 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 10 * time.Second
+	}
+	if opts.Jitter <= 0 {
+		opts.Jitter = 0.2
+	}
+	if opts.Retryable == nil {
+		opts.Retryable = IsRetryable
+	}
+	if opts.sleep == nil {
+		opts.sleep = sleep
+	}
+	if opts.random == nil {
+		opts.random = rand.Float64
+	}
+	return &Client{KVClient: c, opts: opts}
+}
+
+// IsRetryable reports whether err is a temporary Secret Manager error
+func IsRetryable(err error) bool {
+	switch grpcCode(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// Stats -
+func (c *Client) Stats() Stats {
+	return Stats{
+		Requests: atomic.LoadInt64(&c.requests),
+		Retries:  atomic.LoadInt64(&c.retries),
+		Failures: atomic.LoadInt64(&c.failures),
+	}
+}
+
+func (c *Client) ListKeys(ctx context.Context) (result []secretmanager.KVValue, err error) {
+	err = c.do(ctx, true, func() (err error) {
+		result, err = c.KVClient.ListKeys(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Wrap returned kv's
+	wrapped := make([]secretmanager.KVValue, len(result))
+	for i := range result {
+		wrapped[i] = &retryKeyValue{KVValue: result[i], client: c}
+	}
+	return wrapped, nil
+}
+
+func (c *Client) Get(ctx context.Context, name string) (v secretmanager.KVValue, err error) {
+	err = c.do(ctx, true, func() (err error) {
+		v, err = c.KVClient.Get(ctx, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Wrap returned kv
+	return &retryKeyValue{KVValue: v, client: c}, nil
+}
+
+func (c *Client) New(ctx context.Context, name string, labels map[string]string) (v secretmanager.KVValue, err error) {
+	err = c.do(ctx, false, func() (err error) {
+		v, err = c.KVClient.New(ctx, name, labels)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Wrap returned kv
+	return &retryKeyValue{KVValue: v, client: c}, nil
+}
+
+// do runs call, retrying when allowed and the error is retryable
+func (c *Client) do(ctx context.Context, retry bool, call func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := c.wait(ctx); err != nil {
+			return err
+		}
+		atomic.AddInt64(&c.requests, 1)
+		err := call()
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= c.opts.MaxAttempts || ctx.Err() != nil || !c.opts.Retryable(err) {
+			atomic.AddInt64(&c.failures, 1)
+			return err
+		}
+
+		atomic.AddInt64(&c.retries, 1)
+		backoff := c.backoff(attempt)
+		if grpcCode(err) == codes.ResourceExhausted {
+			// wait holds off this and all other requests until the pause is over
+			c.pause(backoff)
+			continue
+		}
+		if sleepErr := c.opts.sleep(ctx, backoff); sleepErr != nil {
+			atomic.AddInt64(&c.failures, 1)
+			return err
+		}
+	}
+}
+
+// backoff is exponential, randomized by the jitter fraction
+func (c *Client) backoff(attempt int) time.Duration {
+	backoff := float64(c.opts.InitialBackoff) * math.Pow(2, float64(attempt-1))
+	backoff = math.Min(backoff, float64(c.opts.MaxBackoff))
+	backoff *= 1 + c.opts.Jitter*(2*c.opts.random()-1)
+	return time.Duration(backoff)
+}
+
+// wait blocks until the request is allowed by the rate limit and quota pauses
+func (c *Client) wait(ctx context.Context) error {
+	c.limitM.Lock()
+	now := time.Now()
+	at := now
+	if c.pausedUntil.After(at) {
+		at = c.pausedUntil
+	}
+	if c.opts.RateLimit > 0 {
+		if c.next.After(at) {
+			at = c.next
+		}
+		c.next = at.Add(time.Duration(float64(time.Second) / c.opts.RateLimit))
+	}
+	c.limitM.Unlock()
+
+	if at.After(now) {
+		if err := c.opts.sleep(ctx, at.Sub(now)); err != nil {
+			atomic.AddInt64(&c.failures, 1)
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// pause holds off all requests, because the quota is exhausted
+func (c *Client) pause(d time.Duration) {
+	c.limitM.Lock()
+	defer c.limitM.Unlock()
+	if until := time.Now().Add(d); until.After(c.pausedUntil) {
+		c.pausedUntil = until
+	}
+}
+
+type retryKeyValue struct {
+	secretmanager.KVValue
+	client *Client
+}
+
+func (r *retryKeyValue) GetValue(ctx context.Context) (data []byte, err error) {
+	err = r.client.do(ctx, true, func() (err error) {
+		data, err = r.KVValue.GetValue(ctx)
+		return err
+	})
+	return data, err
+}
+
+func (r *retryKeyValue) GetVersionValue(ctx context.Context, version string) (data []byte, err error) {
+	err = r.client.do(ctx, true, func() (err error) {
+		data, err = r.KVValue.GetVersionValue(ctx, version)
+		return err
+	})
+	return data, err
+}
+
+func (r *retryKeyValue) ListVersions(ctx context.Context) (versions []secretmanager.KVVersion, err error) {
+	err = r.client.do(ctx, true, func() (err error) {
+		versions, err = r.KVValue.ListVersions(ctx)
+		return err
+	})
+	return versions, err
+}
+
+func (r *retryKeyValue) SetLabels(ctx context.Context, labels map[string]string) error {
+	return r.client.do(ctx, true, func() error {
+		return r.KVValue.SetLabels(ctx, labels)
+	})
+}
+
+func (r *retryKeyValue) SetValue(ctx context.Context, data []byte) (version string, err error) {
+	err = r.client.do(ctx, false, func() (err error) {
+		version, err = r.KVValue.SetValue(ctx, data)
+		return err
+	})
+	return version, err
+}
+
+func grpcCode(err error) codes.Code {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		return grpcErr.GRPCStatus().Code()
+	}
+	return codes.Unknown
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,172 @@
+package retry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flakyClient injects failures before the in-memory client is called
+type flakyClient struct {
+	secretmanager.KVClient
+	failures []error // returned in order, then the in-memory client is used
+	calls    int
+}
+
+func (c *flakyClient) fail() error {
+	c.calls++
+	if len(c.failures) > 0 {
+		err := c.failures[0]
+		c.failures = c.failures[1:]
+		return err
+	}
+	return nil
+}
+
+func (c *flakyClient) Get(ctx context.Context, name string) (secretmanager.KVValue, error) {
+	if err := c.fail(); err != nil {
+		return nil, err
+	}
+	v, err := c.KVClient.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &flakyValue{KVValue: v, client: c}, nil
+}
+
+type flakyValue struct {
+	secretmanager.KVValue
+	client *flakyClient
+}
+
+func (v *flakyValue) GetValue(ctx context.Context) ([]byte, error) {
+	if err := v.client.fail(); err != nil {
+		return nil, err
+	}
+	return v.KVValue.GetValue(ctx)
+}
+
+func (v *flakyValue) SetValue(ctx context.Context, data []byte) (string, error) {
+	if err := v.client.fail(); err != nil {
+		return "", err
+	}
+	return v.KVValue.SetValue(ctx, data)
+}
+
+// testOptions records the sleeps instead of sleeping
+func testOptions(sleeps *[]time.Duration) Options {
+	return Options{
+		random: func() float64 { return 0.5 }, // no jitter
+		sleep: func(ctx context.Context, d time.Duration) error {
+			*sleeps = append(*sleeps, d)
+			return ctx.Err()
+		},
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	ctx := context.Background()
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	flaky := &flakyClient{KVClient: secretmanager.NewInMemoryClient("my-project", "foo", "bar")}
+	var sleeps []time.Duration
+	client := New(flaky, testOptions(&sleeps))
+
+	secret, err := client.Get(ctx, "foo")
+	assert.NoError(t, err)
+	flaky.failures = []error{unavailable, unavailable, unavailable}
+	value, err := secret.GetValue(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", string(value))
+	assert.Equal(t, []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond}, sleeps)
+	assert.Equal(t, Stats{Requests: 5, Retries: 3, Failures: 0}, client.Stats())
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	flaky := &flakyClient{KVClient: secretmanager.NewInMemoryClient("my-project", "foo", "bar")}
+	var sleeps []time.Duration
+	opts := testOptions(&sleeps)
+	opts.MaxAttempts = 3
+	client := New(flaky, opts)
+
+	flaky.failures = []error{unavailable, unavailable, unavailable, unavailable}
+	_, err := client.Get(context.Background(), "foo")
+	assert.Equal(t, unavailable, err)
+	assert.Equal(t, 3, flaky.calls)
+	assert.Equal(t, Stats{Requests: 3, Retries: 2, Failures: 1}, client.Stats())
+}
+
+func TestRetryOnlyTemporaryErrors(t *testing.T) {
+	flaky := &flakyClient{KVClient: secretmanager.NewInMemoryClient("my-project", "foo", "bar")}
+	var sleeps []time.Duration
+	client := New(flaky, testOptions(&sleeps))
+
+	_, err := client.Get(context.Background(), "missing")
+	assert.True(t, secretmanager.IsNotFound(err))
+	flaky.failures = []error{status.Error(codes.PermissionDenied, "denied")}
+	_, err = client.Get(context.Background(), "foo")
+	assert.Error(t, err)
+	assert.Equal(t, 2, flaky.calls)
+	assert.Empty(t, sleeps)
+}
+
+func TestRetryNoWrites(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyClient{KVClient: secretmanager.NewInMemoryClient("my-project", "foo", "bar")}
+	var sleeps []time.Duration
+	client := New(flaky, testOptions(&sleeps))
+
+	secret, err := client.Get(ctx, "foo")
+	assert.NoError(t, err)
+	flaky.failures = []error{status.Error(codes.Unavailable, "unavailable")}
+	_, err = secret.SetValue(ctx, []byte("baz"))
+	assert.Error(t, err, "writes might have succeeded, so they are not retried")
+	assert.Equal(t, int64(0), client.Stats().Retries)
+}
+
+func TestRetryQuotaPausesAllRequests(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyClient{KVClient: secretmanager.NewInMemoryClient("my-project", "foo", "bar")}
+	var sleeps []time.Duration
+	client := New(flaky, testOptions(&sleeps))
+
+	flaky.failures = []error{status.Error(codes.ResourceExhausted, "quota")}
+	_, err := client.Get(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Len(t, sleeps, 1)
+	assert.True(t, client.pausedUntil.After(time.Now()), "other requests should hold off too")
+}
+
+func TestRetryRateLimit(t *testing.T) {
+	ctx := context.Background()
+	var sleeps []time.Duration
+	opts := testOptions(&sleeps)
+	opts.RateLimit = 10
+	client := New(secretmanager.NewInMemoryClient("my-project", "foo", "bar"), opts)
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Get(ctx, "foo")
+		assert.NoError(t, err)
+	}
+	// The sleeps are not real, so the requests are scheduled 100ms apart
+	assert.Len(t, sleeps, 2)
+	assert.InDelta(t, float64(100*time.Millisecond), float64(sleeps[0]), float64(10*time.Millisecond))
+	assert.InDelta(t, float64(200*time.Millisecond), float64(sleeps[1]), float64(10*time.Millisecond))
+}
+
+func TestRetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	flaky := &flakyClient{KVClient: secretmanager.NewInMemoryClient("my-project", "foo", "bar")}
+	client := New(flaky, Options{})
+
+	flaky.failures = []error{status.Error(codes.Unavailable, "unavailable")}
+	cancel()
+	_, err := client.Get(ctx, "foo")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, flaky.calls)
+}
@@ -4,32 +4,68 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 
 	sema "cloud.google.com/go/secretmanager/apiv1"
 	"github.com/pkg/errors"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
 	"google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // ErrNoVersions means the secret exists but it has no enabled versions
 var ErrNoVersions = errors.New("no versions")
 
-// NewClient creates a new wrapped Secret Manager client
-func NewClient(project string) (KVClient, error) {
-	ctx := context.Background()
-	client, err := sema.NewClient(ctx)
+// ErrVersionNotFound means the requested version does not exist or is not enabled
+var ErrVersionNotFound = errors.New("version not found")
+
+// ErrNotFound means the secret does not exist. Secret Manager itself returns a gRPC NotFound status instead, use IsNotFound.
+var ErrNotFound = errors.New("not found")
+
+// IsNotFound reports whether err means that a secret or version does not exist, for all KVClient implementations
+func IsNotFound(err error) bool {
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrNoVersions) || errors.Is(err, ErrVersionNotFound) {
+		return true
+	}
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	return errors.As(err, &grpcErr) && grpcErr.GRPCStatus().Code() == codes.NotFound
+}
+
+// IsAlreadyExists reports whether err means that the secret to create exists already, for example created concurrently
+func IsAlreadyExists(err error) bool {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	return errors.As(err, &grpcErr) && grpcErr.GRPCStatus().Code() == codes.AlreadyExists
+}
+
+// NewClient creates a new wrapped Secret Manager client.
+// The context is only used for dialing, every call accepts its own context.
+// The options are passed to the Google client, use WithEndpoint to connect to a local server.
+func NewClient(ctx context.Context, project string, opts ...option.ClientOption) (KVClient, error) {
+	client, err := sema.NewClient(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
-	return semaWrapper{client, project, ctx}, nil
+	return semaWrapper{client, project}, nil
+}
+
+// WithEndpoint connects to a Secret Manager API on endpoint ("host:port") without TLS and credentials,
+// like the fake package or an emulator
+func WithEndpoint(endpoint string) []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(endpoint),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	}
 }
 
 type semaWrapper struct {
 	client  *sema.Client
 	project string
-	ctx     context.Context
 }
 type semaSecretWrapper struct {
 	client *semaWrapper
@@ -40,8 +76,8 @@ type semaSecretWrapper struct {
 var _ KVClient = semaWrapper{}
 var _ KVValue = semaSecretWrapper{}
 
-func (s semaWrapper) ListKeys() ([]KVValue, error) {
-	it := s.client.ListSecrets(s.ctx, &secretmanagerpb.ListSecretsRequest{
+func (s semaWrapper) ListKeys(ctx context.Context) ([]KVValue, error) {
+	it := s.client.ListSecrets(ctx, &secretmanagerpb.ListSecretsRequest{
 		// The parenet resource in the format `projects/*`.
 		Parent: fmt.Sprintf("projects/%s", s.project),
 	})
@@ -62,8 +98,8 @@ func (s semaWrapper) ListKeys() ([]KVValue, error) {
 	return data, nil
 }
 
-func (s semaWrapper) Get(key string) (KVValue, error) {
-	resp, err := s.client.GetSecret(s.ctx, &secretmanagerpb.GetSecretRequest{
+func (s semaWrapper) Get(ctx context.Context, key string) (KVValue, error) {
+	resp, err := s.client.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{
 		Name: fmt.Sprintf("projects/%s/secrets/%s", s.project, key),
 	})
 	if err != nil {
@@ -72,8 +108,8 @@ func (s semaWrapper) Get(key string) (KVValue, error) {
 	return semaSecretWrapper{client: &s, path: resp.Name, labels: resp.Labels}, nil
 }
 
-func (s semaWrapper) New(key string, labels map[string]string) (KVValue, error) {
-	resp, err := s.client.CreateSecret(s.ctx, &secretmanagerpb.CreateSecretRequest{
+func (s semaWrapper) New(ctx context.Context, key string, labels map[string]string) (KVValue, error) {
+	resp, err := s.client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
 		Parent:   fmt.Sprintf("projects/%s", s.project),
 		SecretId: key,
 		Secret: &secretmanagerpb.Secret{
@@ -94,38 +130,71 @@ func (s semaSecretWrapper) GetLink() string {
 	return fmt.Sprintf("https://console.cloud.google.com/security/secret-manager/secret/%s?project=%s", s.GetShortName(), s.client.project)
 }
 
-func (s semaSecretWrapper) getLastVersion() (string, error) {
+func (s semaSecretWrapper) listVersions(ctx context.Context) ([]*secretmanagerpb.SecretVersion, error) {
 	versions := make([]*secretmanagerpb.SecretVersion, 0)
-	it := s.client.client.ListSecretVersions(s.client.ctx, &secretmanagerpb.ListSecretVersionsRequest{Parent: s.path})
+	it := s.client.client.ListSecretVersions(ctx, &secretmanagerpb.ListSecretVersionsRequest{Parent: s.path})
 	for {
 		resp, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		// *secretmanagerpb.SecretVersion
-		// TODO do something with the other properties than Name: CreateTime, DestroyTime, State
-		if resp.State == secretmanagerpb.SecretVersion_ENABLED {
-			versions = append(versions, resp)
+		versions = append(versions, resp)
+	}
+	return sortVersions(versions), nil
+}
+
+func (s semaSecretWrapper) getLastVersion(ctx context.Context) (string, error) {
+	versions, err := s.listVersions(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, version := range versions {
+		if version.State == secretmanagerpb.SecretVersion_ENABLED {
+			// The resource name in the format `projects/*/secrets/*/versions/*`.
+			return version.Name, nil
 		}
 	}
-	versions = sortVersions(versions)
-	if len(versions) == 0 {
-		return "", errors.Wrap(ErrNoVersions, fmt.Sprintf(`Secret %q (%s)`, s.GetShortName(), s.GetLink()))
+	return "", errors.Wrap(ErrNoVersions, fmt.Sprintf(`Secret %q (%s)`, s.GetShortName(), s.GetLink()))
+}
+
+func (s semaSecretWrapper) ListVersions(ctx context.Context) ([]KVVersion, error) {
+	versions, err := s.listVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]KVVersion, 0, len(versions))
+	for _, version := range versions {
+		kv := KVVersion{
+			Name:    version.Name,
+			Version: version.Name[strings.LastIndex(version.Name, "/")+1:],
+			State:   version.State.String(),
+		}
+		if version.CreateTime != nil {
+			kv.CreateTime = version.CreateTime.AsTime()
+		}
+		result = append(result, kv)
 	}
-	// The resource name in the format `projects/*/secrets/*/versions/*`.
-	return versions[0].Name, nil
+	return result, nil
 }
 
-func (s semaSecretWrapper) GetValue() ([]byte, error) {
-	version, err := s.getLastVersion()
+func (s semaSecretWrapper) GetValue(ctx context.Context) ([]byte, error) {
+	version, err := s.getLastVersion(ctx)
 	if err != nil {
 		return nil, err
 	}
-	req := &secretmanagerpb.AccessSecretVersionRequest{Name: version}
-	resp, err := s.client.client.AccessSecretVersion(s.client.ctx, req)
+	return s.accessVersion(ctx, version)
+}
+
+func (s semaSecretWrapper) GetVersionValue(ctx context.Context, version string) ([]byte, error) {
+	return s.accessVersion(ctx, fmt.Sprintf("%s/versions/%s", s.path, version))
+}
+
+func (s semaSecretWrapper) accessVersion(ctx context.Context, name string) ([]byte, error) {
+	req := &secretmanagerpb.AccessSecretVersionRequest{Name: name}
+	resp, err := s.client.client.AccessSecretVersion(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -134,14 +203,14 @@ func (s semaSecretWrapper) GetValue() ([]byte, error) {
 
 func (s semaSecretWrapper) GetLabels() map[string]string { return s.labels }
 
-func (s semaSecretWrapper) SetValue(value []byte) (string, error) {
+func (s semaSecretWrapper) SetValue(ctx context.Context, value []byte) (string, error) {
 	// writeSecretVersion updates the value to a new version
 	// projectNameVersion is the resource name in the format `projects/*/secrets/*`.
 	req := &secretmanagerpb.AddSecretVersionRequest{
 		Parent:  s.path,
 		Payload: &secretmanagerpb.SecretPayload{Data: value},
 	}
-	resp, err := s.client.client.AddSecretVersion(s.client.ctx, req)
+	resp, err := s.client.client.AddSecretVersion(ctx, req)
 	if err != nil {
 		return "", err
 	}
@@ -149,28 +218,39 @@ func (s semaSecretWrapper) SetValue(value []byte) (string, error) {
 	return resp.Name, err
 }
 
-func (s semaSecretWrapper) SetLabels(value map[string]string) error {
-	secret, err := s.client.client.GetSecret(s.client.ctx, &secretmanagerpb.GetSecretRequest{
+func (s semaSecretWrapper) SetLabels(ctx context.Context, value map[string]string) error {
+	secret, err := s.client.client.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{
 		Name: s.path,
 	})
 	if err != nil {
 		return err
 	}
 	secret.Labels = value
-	secret, err = s.client.client.UpdateSecret(s.client.ctx, &secretmanagerpb.UpdateSecretRequest{
+	secret, err = s.client.client.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
 		Secret:     secret,
 		UpdateMask: &field_mask.FieldMask{Paths: []string{"labels"}},
 	})
 	return err
 }
 
+// sortVersions puts the latest version first. Versions created at the same time are ordered by their number.
 func sortVersions(versions []*secretmanagerpb.SecretVersion) []*secretmanagerpb.SecretVersion {
 	sort.Slice(versions, func(i, j int) bool {
-		return versions[i].CreateTime.Seconds > versions[j].CreateTime.Seconds
+		ti, tj := versions[i].CreateTime.AsTime(), versions[j].CreateTime.AsTime()
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return versionNumber(versions[i].Name) > versionNumber(versions[j].Name)
 	})
 	return versions
 }
 
+// versionNumber parses the number of a version name like "projects/*/secrets/*/versions/7", 0 if it has none
+func versionNumber(name string) int {
+	number, _ := strconv.Atoi(name[strings.LastIndex(name, "/")+1:])
+	return number
+}
+
 // SecretShortNames reduces a list of KVValues to a list of short names
 func SecretShortNames(list []KVValue) []string {
 	var names []string = nil
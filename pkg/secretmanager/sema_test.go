@@ -0,0 +1,105 @@
+package secretmanager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager/fake"
+	"github.com/stretchr/testify/assert"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+)
+
+// newFakeClient runs the real client against an in-process fake Secret Manager
+func newFakeClient(t *testing.T) (*fake.Server, KVClient) {
+	server := fake.New()
+	endpoint, err := server.Listen("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(server.Stop)
+	client, err := NewClient(context.Background(), "my-project", WithEndpoint(endpoint)...)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return server, client
+}
+
+func TestSemaClientReadWrite(t *testing.T) {
+	ctx := context.Background()
+	server, client := newFakeClient(t)
+	server.Seed("my-project", "foo", map[string]string{"team": "a"}, "v1", "v2")
+	server.Seed("other-project", "bar", nil, "other")
+
+	keys, err := client.ListKeys(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, SecretShortNames(keys))
+	assert.Equal(t, map[string]string{"team": "a"}, keys[0].GetLabels())
+
+	secret, err := client.Get(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "projects/my-project/secrets/foo", secret.GetFullName())
+	value, err := secret.GetValue(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(value))
+	value, err = secret.GetVersionValue(ctx, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", string(value))
+
+	version, err := secret.SetValue(ctx, []byte("v3"))
+	assert.NoError(t, err)
+	assert.Equal(t, "projects/my-project/secrets/foo/versions/3", version)
+	value, err = secret.GetValue(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v3", string(value))
+
+	assert.NoError(t, secret.SetLabels(ctx, map[string]string{"team": "b"}))
+	secret, err = client.Get(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"team": "b"}, secret.GetLabels())
+}
+
+func TestSemaClientVersions(t *testing.T) {
+	ctx := context.Background()
+	server, client := newFakeClient(t)
+	server.Seed("my-project", "foo", nil, "v1", "v2", "v3")
+	_, err := server.DisableSecretVersion(ctx, &secretmanagerpb.DisableSecretVersionRequest{Name: "projects/my-project/secrets/foo/versions/3"})
+	assert.NoError(t, err)
+
+	secret, err := client.Get(ctx, "foo")
+	assert.NoError(t, err)
+	versions, err := secret.ListVersions(ctx)
+	assert.NoError(t, err)
+	var names, states []string
+	for _, v := range versions {
+		names = append(names, v.Version)
+		states = append(states, v.State)
+	}
+	assert.Equal(t, []string{"3", "2", "1"}, names)
+	assert.Equal(t, []string{VersionDisabled, VersionEnabled, VersionEnabled}, states)
+	assert.False(t, versions[0].CreateTime.Before(versions[1].CreateTime), "seeded in the same second, ordered by version number")
+
+	value, err := secret.GetValue(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(value), "latest enabled version")
+	_, err = secret.GetVersionValue(ctx, "3")
+	assert.Error(t, err, "disabled version")
+	_, err = secret.GetVersionValue(ctx, "4")
+	assert.True(t, IsNotFound(err))
+}
+
+func TestSemaClientNotFound(t *testing.T) {
+	ctx := context.Background()
+	_, client := newFakeClient(t)
+
+	_, err := client.Get(ctx, "missing")
+	assert.True(t, IsNotFound(err))
+
+	secret, err := client.New(ctx, "empty", map[string]string{"team": "a"})
+	assert.NoError(t, err)
+	_, err = secret.GetValue(ctx)
+	assert.ErrorIs(t, err, ErrNoVersions)
+	assert.True(t, IsNotFound(err))
+
+	_, err = client.New(ctx, "empty", nil)
+	assert.Error(t, err, "already exists")
+}
@@ -1,14 +1,22 @@
 // Singleflight is a small wrapper around KVClient that prevents concurrent requests on the same entities.
 // Both listing, getting secrets and getting the values runs using golang.org/x/sync/singleflight.
+// Note that the context of the first caller is used for the shared request.
+// If the client is a secretmanager.KVBatchClient, so is the result. Batches are passed on as-is.
 package singleflight
 
 import (
+	"context"
+
 	"github.com/Q42/gcp-sema/pkg/secretmanager"
 	"golang.org/x/sync/singleflight"
 )
 
 func New(c secretmanager.KVClient) secretmanager.KVClient {
-	return &semaSingleFlightClient{KVClient: c, sf: &singleflight.Group{}}
+	client := &semaSingleFlightClient{KVClient: c, sf: &singleflight.Group{}}
+	if batch, isBatch := c.(secretmanager.KVBatchClient); isBatch {
+		return &semaSingleFlightBatchClient{semaSingleFlightClient: client, batch: batch}
+	}
+	return client
 }
 
 type semaSingleFlightClient struct {
@@ -18,24 +26,25 @@ type semaSingleFlightClient struct {
 
 var _ secretmanager.KVClient = &semaSingleFlightClient{}
 
-func (c *semaSingleFlightClient) ListKeys() ([]secretmanager.KVValue, error) {
+func (c *semaSingleFlightClient) ListKeys(ctx context.Context) ([]secretmanager.KVValue, error) {
 	result, err, _ := c.sf.Do("list", func() (interface{}, error) {
-		return c.KVClient.ListKeys()
+		return c.KVClient.ListKeys(ctx)
 	})
 	if err != nil {
 		return nil, err
 	}
-	// Wrap returned kv's
+	// Wrap returned kv's, in a copy: the result is shared with the other callers
 	castedResult := result.([]secretmanager.KVValue)
+	wrapped := make([]secretmanager.KVValue, len(castedResult))
 	for i := range castedResult {
-		castedResult[i] = &semaSingleFlightClientKeyValue{client: c, KVValue: castedResult[i]}
+		wrapped[i] = &semaSingleFlightClientKeyValue{client: c, KVValue: castedResult[i]}
 	}
-	return castedResult, nil
+	return wrapped, nil
 }
 
-func (c *semaSingleFlightClient) Get(name string) (secretmanager.KVValue, error) {
+func (c *semaSingleFlightClient) Get(ctx context.Context, name string) (secretmanager.KVValue, error) {
 	result, err, _ := c.sf.Do(name, func() (interface{}, error) {
-		return c.KVClient.Get(name)
+		return c.KVClient.Get(ctx, name)
 	})
 	if err != nil {
 		return nil, err
@@ -44,8 +53,8 @@ func (c *semaSingleFlightClient) Get(name string) (secretmanager.KVValue, error)
 	return &semaSingleFlightClientKeyValue{KVValue: result.(secretmanager.KVValue), client: c}, nil
 }
 
-func (c *semaSingleFlightClient) New(name string, labels map[string]string) (secretmanager.KVValue, error) {
-	v, err := c.KVClient.New(name, labels)
+func (c *semaSingleFlightClient) New(ctx context.Context, name string, labels map[string]string) (secretmanager.KVValue, error) {
+	v, err := c.KVClient.New(ctx, name, labels)
 	if err != nil {
 		return nil, err
 	}
@@ -58,12 +67,40 @@ type semaSingleFlightClientKeyValue struct {
 	client *semaSingleFlightClient
 }
 
-func (sf *semaSingleFlightClientKeyValue) GetValue() ([]byte, error) {
+func (sf *semaSingleFlightClientKeyValue) GetValue(ctx context.Context) ([]byte, error) {
 	dataInterface, err, _ := sf.client.sf.Do(sf.KVValue.GetFullName(), func() (interface{}, error) {
-		return sf.KVValue.GetValue()
+		return sf.KVValue.GetValue(ctx)
 	})
 	if err != nil {
 		return nil, err
 	}
 	return dataInterface.([]byte), nil
 }
+
+func (sf *semaSingleFlightClientKeyValue) GetVersionValue(ctx context.Context, version string) ([]byte, error) {
+	dataInterface, err, _ := sf.client.sf.Do(sf.KVValue.GetFullName()+"@"+version, func() (interface{}, error) {
+		return sf.KVValue.GetVersionValue(ctx, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dataInterface.([]byte), nil
+}
+
+type semaSingleFlightBatchClient struct {
+	*semaSingleFlightClient
+	batch secretmanager.KVBatchClient
+}
+
+var _ secretmanager.KVBatchClient = &semaSingleFlightBatchClient{}
+
+func (c *semaSingleFlightBatchClient) GetValues(ctx context.Context, requests []secretmanager.KVValueRequest) []secretmanager.KVValueResult {
+	unwrapped := make([]secretmanager.KVValueRequest, len(requests))
+	for i, r := range requests {
+		if sf, isWrapped := r.Secret.(*semaSingleFlightClientKeyValue); isWrapped {
+			r.Secret = sf.KVValue
+		}
+		unwrapped[i] = r
+	}
+	return c.batch.GetValues(ctx, unwrapped)
+}
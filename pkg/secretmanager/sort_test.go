@@ -18,3 +18,16 @@ func TestSortPutsLatestVersionFirst(t *testing.T) {
 	versions = sortVersions(versions)
 	assert.Equal(t, int64(42), versions[0].CreateTime.Seconds, "Should put version 42 first")
 }
+
+func TestSortSameCreateTimeUsesVersionNumber(t *testing.T) {
+	var versions = []*secretmanagerpb.SecretVersion{
+		{Name: "projects/p/secrets/s/versions/9", CreateTime: &timestamp.Timestamp{Seconds: 42}},
+		{Name: "projects/p/secrets/s/versions/10", CreateTime: &timestamp.Timestamp{Seconds: 42}},
+		{Name: "projects/p/secrets/s/versions/11", CreateTime: &timestamp.Timestamp{Seconds: 41, Nanos: 999}},
+	}
+
+	versions = sortVersions(versions)
+	assert.Equal(t, "projects/p/secrets/s/versions/10", versions[0].Name, "Should put version 10 before 9 when created in the same second")
+	assert.Equal(t, "projects/p/secrets/s/versions/9", versions[1].Name)
+	assert.Equal(t, "projects/p/secrets/s/versions/11", versions[2].Name)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/Q42/gcp-sema/pkg/handlers"
+	"gopkg.in/yaml.v3"
+)
+
+// proxyAuthConfig is the --auth-config file: who may use the proxy, and for which secrets
+type proxyAuthConfig struct {
+	Principals []*proxyPrincipal `yaml:"principals"`
+}
+
+// proxyPrincipal is a client authenticated by a bearer token or a client certificate
+type proxyPrincipal struct {
+	Name       string   `yaml:"name"`
+	Token      string   `yaml:"token"`      // bearer token
+	CommonName string   `yaml:"commonName"` // subject of the client certificate (mTLS)
+	Projects   []string `yaml:"projects"`   // patterns, like "my-project" or "*"
+	Secrets    []string `yaml:"secrets"`    // patterns of short names, like "MY_APP_*". Default: all
+	Write      bool     `yaml:"write"`      // may also write the secrets it may read, requires --allow-writes
+}
+
+// proxyUnrestricted is used when authentication is disabled, or only done using --client-ca
+var proxyUnrestricted = &proxyPrincipal{Name: "anonymous", Projects: []string{"*"}}
+
+func loadProxyAuthConfig(file string) (*proxyAuthConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &proxyAuthConfig{}
+	if err = yaml.Unmarshal(data, config); err != nil {
+		return nil, handlers.ConfigErrorf("Invalid %s: %s", file, err)
+	}
+	for i, p := range config.Principals {
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("principal %d", i+1)
+		}
+		if (p.Token == "") == (p.CommonName == "") {
+			return nil, handlers.ConfigErrorf("Invalid %s: %s needs either a token or a commonName", file, p.Name)
+		}
+		if len(p.Projects) == 0 {
+			return nil, handlers.ConfigErrorf("Invalid %s: %s has no projects, use \"*\" to allow all", file, p.Name)
+		}
+		for _, pattern := range append(append([]string{}, p.Projects...), p.Secrets...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, handlers.ConfigErrorf("Invalid %s: %s has pattern %q: %s", file, p.Name, pattern, err)
+			}
+		}
+	}
+	return config, nil
+}
+
+// allowsProject reports whether the principal may list the project
+func (p *proxyPrincipal) allowsProject(projectID string) bool {
+	return matchAny(p.Projects, projectID)
+}
+
+// allows reports whether the principal may read the secret
+func (p *proxyPrincipal) allows(projectID, shortName string) bool {
+	return p.allowsProject(projectID) && (len(p.Secrets) == 0 || matchAny(p.Secrets, shortName))
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate finds the principal of the request using the bearer token or the verified client certificate
+func (opts *proxyCommand) authenticate(r *http.Request) *proxyPrincipal {
+	if opts.auth == nil {
+		// Without --auth-config, the TLS layer requires a client certificate if --client-ca is set
+		return proxyUnrestricted
+	}
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token := []byte(strings.TrimPrefix(header, "Bearer "))
+		for _, p := range opts.auth.Principals {
+			if p.Token != "" && subtle.ConstantTimeCompare(token, []byte(p.Token)) == 1 {
+				return p
+			}
+		}
+		return nil
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, p := range opts.auth.Principals {
+			if p.CommonName != "" && p.CommonName == commonName {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// authenticated rejects requests without a known principal
+func (opts *proxyCommand) authenticated(handler func(rw http.ResponseWriter, r *http.Request, principal *proxyPrincipal)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		principal := opts.authenticate(r)
+		if principal == nil {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "Unauthenticated: set SEMA_PROXY_TOKEN or use a client certificate", http.StatusUnauthorized)
+			return
+		}
+		requestInfo(r).principal = principal.Name
+		handler(rw, r, principal)
+	}
+}
+
+// tlsConfig verifies client certificates if --client-ca is set. With --auth-config a client may use a token instead.
+func (opts *proxyCommand) tlsConfig() (*tls.Config, error) {
+	if opts.ClientCAFile == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(opts.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, handlers.ConfigErrorf("No certificates found in --client-ca %s", opts.ClientCAFile)
+	}
+	config := &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	if opts.auth != nil {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
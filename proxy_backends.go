@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/Q42/gcp-sema/pkg/handlers"
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"gopkg.in/yaml.v3"
+)
+
+// proxyBackendConfig is the --backends file: where the proxy reads the secrets of each project
+type proxyBackendConfig struct {
+	Projects []*proxyBackend `yaml:"projects"`
+}
+
+// proxyBackend serves the secrets of the projects matching Project
+type proxyBackend struct {
+	Project  string            `yaml:"project"`  // pattern, like "my-project" or "*"
+	Type     string            `yaml:"type"`     // secretmanager (default), offline or memory
+	Endpoint string            `yaml:"endpoint"` // secretmanager: API like 'sema fake-server'. Default: --endpoint
+	File     string            `yaml:"file"`     // offline: dot-env file, relative to the --backends file
+	Secrets  map[string]string `yaml:"secrets"`  // memory: values by short name
+}
+
+const (
+	proxyBackendSecretManager = "secretmanager"
+	proxyBackendOffline       = "offline"
+	proxyBackendMemory        = "memory"
+)
+
+func loadProxyBackendConfig(file string) (*proxyBackendConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &proxyBackendConfig{}
+	if err = yaml.Unmarshal(data, config); err != nil {
+		return nil, handlers.ConfigErrorf("Invalid %s: %s", file, err)
+	}
+	for i, b := range config.Projects {
+		if b.Project == "" {
+			return nil, handlers.ConfigErrorf("Invalid %s: entry %d has no project, use \"*\" to match all", file, i+1)
+		}
+		if _, err := path.Match(b.Project, ""); err != nil {
+			return nil, handlers.ConfigErrorf("Invalid %s: project pattern %q: %s", file, b.Project, err)
+		}
+		switch b.Type {
+		case "":
+			b.Type = proxyBackendSecretManager
+		case proxyBackendSecretManager, proxyBackendMemory:
+		case proxyBackendOffline:
+			if b.File == "" {
+				return nil, handlers.ConfigErrorf("Invalid %s: %s needs a file", file, b.Project)
+			}
+			if !filepath.IsAbs(b.File) {
+				b.File = filepath.Join(filepath.Dir(file), b.File)
+			}
+			if _, err := os.Stat(b.File); err != nil {
+				return nil, handlers.ConfigErrorf("Invalid %s: %s", file, err)
+			}
+		default:
+			return nil, handlers.ConfigErrorf("Invalid %s: %s has unknown type %q, use %s, %s or %s", file, b.Project, b.Type,
+				proxyBackendSecretManager, proxyBackendOffline, proxyBackendMemory)
+		}
+	}
+	return config, nil
+}
+
+// client creates the client of the first matching backend. Projects without a backend use Secret Manager.
+func (c *proxyBackendConfig) client(projectID string) (secretmanager.KVClient, error) {
+	for _, b := range c.Projects {
+		if matched, _ := path.Match(b.Project, projectID); !matched {
+			continue
+		}
+		switch b.Type {
+		case proxyBackendOffline:
+			return secretmanager.NewOfflineClient(b.File, projectID)
+		case proxyBackendMemory:
+			var keyValues []string
+			for name, value := range b.Secrets {
+				keyValues = append(keyValues, name, value)
+			}
+			return secretmanager.NewInMemoryClient(projectID, keyValues...), nil
+		}
+		return prepareSemaClientAt(projectID, valueOrDefault(b.Endpoint, globalOpts.Endpoint))
+	}
+	return prepareSemaClient(projectID)
+}
+
+// usesGoogleCloud reports whether some projects may be served by Google Cloud, which requires credentials.
+// Without a --backends file, all projects are.
+func (c *proxyBackendConfig) usesGoogleCloud() bool {
+	if c == nil {
+		return globalOpts.Endpoint == ""
+	}
+	for _, b := range c.Projects {
+		if b.Type == proxyBackendSecretManager && valueOrDefault(b.Endpoint, globalOpts.Endpoint) == "" {
+			return true
+		}
+		if b.Project == "*" {
+			return false
+		}
+	}
+	return globalOpts.Endpoint == ""
+}
+
+func (b *proxyBackend) String() string {
+	switch b.Type {
+	case proxyBackendOffline:
+		return fmt.Sprintf("%s: %s", b.Project, b.File)
+	case proxyBackendMemory:
+		return fmt.Sprintf("%s: %d secrets in memory", b.Project, len(b.Secrets))
+	}
+	if endpoint := valueOrDefault(b.Endpoint, globalOpts.Endpoint); endpoint != "" {
+		return fmt.Sprintf("%s: Secret Manager at %s", b.Project, endpoint)
+	}
+	return fmt.Sprintf("%s: Secret Manager", b.Project)
+}
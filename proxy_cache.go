@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// proxyCache caches the values of the proxy by key. Concurrent requests for the same key share a single load.
+// After the ttl a value is still served for the stale duration, while it is refreshed in the background.
+// Failed loads are not cached, the next request tries again.
+type proxyCache struct {
+	ttl   time.Duration // 0 caches forever
+	stale time.Duration
+	now   func() time.Time
+
+	m       sync.Mutex
+	entries map[string]*proxyCacheEntry
+}
+
+type proxyCacheEntry struct {
+	loaded     chan struct{} // closed when the first load is done
+	value      interface{}
+	err        error
+	loadedAt   time.Time
+	refreshing bool
+}
+
+func newProxyCache(ttl, stale time.Duration, now func() time.Time) *proxyCache {
+	return &proxyCache{ttl: ttl, stale: stale, now: now, entries: make(map[string]*proxyCacheEntry)}
+}
+
+// get returns the cached value, or loads it. Hit is true if the value was loaded (or being loaded) by an earlier request.
+func (c *proxyCache) get(key string, load func() (interface{}, error)) (value interface{}, age time.Duration, hit bool, err error) {
+	c.m.Lock()
+	entry, exists := c.entries[key]
+	if exists && entry.isLoaded() {
+		age = c.now().Sub(entry.loadedAt)
+		if c.ttl == 0 || age < c.ttl {
+			defer c.m.Unlock()
+			return entry.value, age, true, nil
+		}
+		if age < c.ttl+c.stale {
+			if !entry.refreshing {
+				entry.refreshing = true
+				go c.refresh(entry, load)
+			}
+			defer c.m.Unlock()
+			return entry.value, age, true, nil
+		}
+		exists = false // too old to serve
+	}
+	if !exists {
+		entry = &proxyCacheEntry{loaded: make(chan struct{})}
+		c.entries[key] = entry
+		c.m.Unlock()
+
+		value, err := load()
+		c.m.Lock()
+		entry.value, entry.err, entry.loadedAt = value, err, c.now()
+		if err != nil && c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+		close(entry.loaded)
+		c.m.Unlock()
+		return value, 0, false, err
+	}
+	c.m.Unlock()
+
+	<-entry.loaded
+	c.m.Lock()
+	defer c.m.Unlock()
+	return entry.value, c.now().Sub(entry.loadedAt), true, entry.err
+}
+
+// peek returns the value if it is loaded and not too old to serve, without loading or refreshing it
+func (c *proxyCache) peek(key string) (interface{}, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	entry, exists := c.entries[key]
+	if !exists || !entry.isLoaded() || entry.err != nil {
+		return nil, false
+	}
+	if c.ttl != 0 && c.now().Sub(entry.loadedAt) >= c.ttl+c.stale {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// invalidate removes all keys that match, loads that are in progress are not cached
+func (c *proxyCache) invalidate(match func(key string) bool) (count int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for key := range c.entries {
+		if match(key) {
+			delete(c.entries, key)
+			count++
+		}
+	}
+	return count
+}
+
+// count counts the entries by group
+func (c *proxyCache) count(group func(key string) string) map[string]int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	counts := make(map[string]int)
+	for key := range c.entries {
+		counts[group(key)]++
+	}
+	return counts
+}
+
+func (c *proxyCache) refresh(entry *proxyCacheEntry, load func() (interface{}, error)) {
+	value, err := load()
+	c.m.Lock()
+	defer c.m.Unlock()
+	entry.refreshing = false
+	if err != nil {
+		log.Printf("Refreshing cache failed, serving the stale value: %s", err)
+		return
+	}
+	entry.value, entry.loadedAt = value, c.now()
+}
+
+func (e *proxyCacheEntry) isLoaded() bool {
+	select {
+	case <-e.loaded:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+	"google.golang.org/api/transport"
+)
+
+// serve runs the server until SIGTERM or Ctrl-C, then waits at most --shutdown-timeout for the requests in progress
+func (opts *proxyCommand) serve(server *http.Server) error {
+	if opts.signals == nil {
+		opts.signals = make(chan os.Signal, 1)
+		signal.Notify(opts.signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(opts.signals)
+	}
+	served := make(chan error, 1)
+	go func() {
+		if opts.TLSKeyFile != "" {
+			log.Println("Starting gcp-sema proxy server")
+			served <- server.ServeTLS(opts.listener, opts.TLSCertFile, opts.TLSKeyFile)
+			return
+		}
+		log.Println("Starting insecure gcp-sema proxy server")
+		served <- server.Serve(opts.listener)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case sig := <-opts.signals:
+		log.Printf("Received %s, waiting up to %s for requests in progress", sig, opts.ShutdownTimeout)
+		atomic.StoreInt32(&opts.draining, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+			return errors.Wrap(err, "shutdown")
+		}
+		log.Println("Stopped gcp-sema proxy server")
+		return nil
+	}
+}
+
+// healthz reports that the proxy is running
+func (opts *proxyCommand) healthz(rw http.ResponseWriter, r *http.Request) {
+	rw.Write([]byte("ok\n"))
+}
+
+// readyz reports whether the proxy can serve requests: the upstream credentials work and it is not shutting down.
+// Once the credentials worked they are not checked again.
+func (opts *proxyCommand) readyz(rw http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&opts.draining) == 1 {
+		http.Error(rw, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	opts.readyM.Lock()
+	defer opts.readyM.Unlock()
+	if !opts.ready {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		if err := opts.checkCredentials(ctx); err != nil {
+			http.Error(rw, fmt.Sprintf("Not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		opts.ready = true
+	}
+	rw.Write([]byte("ok\n"))
+}
+
+// checkGoogleCredentials gets an access token, if any project may be served by Google Cloud Secret Manager
+func (opts *proxyCommand) checkGoogleCredentials(ctx context.Context) error {
+	if !opts.backends.usesGoogleCloud() {
+		return nil
+	}
+	creds, err := transport.Creds(ctx, option.WithScopes("https://www.googleapis.com/auth/cloud-platform"))
+	if err != nil {
+		return credentialsError{err}
+	}
+	if _, err = creds.TokenSource.Token(); err != nil {
+		return credentialsError{err}
+	}
+	return nil
+}
+
+// proxyAccessEntry is a JSON line of the access log
+type proxyAccessEntry struct {
+	Time      time.Time
+	Method    string
+	Path      string
+	Project   string `json:",omitempty"`
+	Secret    string `json:",omitempty"`
+	Principal string `json:",omitempty"`
+	Status    int
+	Bytes     int
+	Duration  float64 // seconds
+	CacheHit  string  `json:",omitempty"`
+	Error     string  `json:",omitempty"`
+}
+
+// proxyRequestInfo is filled in by the handlers for the access log
+type proxyRequestInfo struct {
+	principal string
+	err       string
+}
+
+type proxyRequestInfoKey struct{}
+
+// requestInfo returns the access log details of the request, which can be updated
+func requestInfo(r *http.Request) *proxyRequestInfo {
+	if info, ok := r.Context().Value(proxyRequestInfoKey{}).(*proxyRequestInfo); ok {
+		return info
+	}
+	return &proxyRequestInfo{}
+}
+
+// accessLogged writes a JSON line for every request to the access log
+func (opts *proxyCommand) accessLogged(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &proxyRequestInfo{}
+		recorder := &accessRecorder{ResponseWriter: rw, status: http.StatusOK}
+		handler(recorder, r.WithContext(context.WithValue(r.Context(), proxyRequestInfoKey{}, info)))
+
+		entry := proxyAccessEntry{
+			Time:      start.UTC(),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Project:   r.URL.Query().Get("project"),
+			Secret:    valueOrDefault(r.URL.Query().Get("shortName"), r.URL.Query().Get("name")),
+			Principal: info.principal,
+			Status:    recorder.status,
+			Bytes:     recorder.bytes,
+			Duration:  time.Since(start).Seconds(),
+			CacheHit:  rw.Header().Get("Cache-Hit"),
+			Error:     valueOrDefault(info.err, recorder.errorMessage()),
+		}
+		opts.accessLog.write(entry)
+	}
+}
+
+// accessRecorder records the status and size of the response, and the message of errors
+type accessRecorder struct {
+	http.ResponseWriter
+	status    int
+	bytes     int
+	errorBody []byte
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(data []byte) (int, error) {
+	if r.status >= 400 && len(r.errorBody) < 512 {
+		r.errorBody = append(r.errorBody, data...)
+	}
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += n
+	return n, err
+}
+
+func (r *accessRecorder) errorMessage() string {
+	if len(r.errorBody) > 512 {
+		return strings.TrimSpace(string(r.errorBody[:512]))
+	}
+	return strings.TrimSpace(string(r.errorBody))
+}
+
+// jsonLines appends values as JSON lines, like the access and audit logs
+type jsonLines struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+func (l *jsonLines) write(value interface{}) {
+	data, err := json.Marshal(value)
+	if err == nil {
+		l.m.Lock()
+		_, err = l.w.Write(append(data, '\n'))
+		l.m.Unlock()
+	}
+	if err != nil {
+		log.Printf("Writing log failed: %s %s", err, data)
+	}
+}
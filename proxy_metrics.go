@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Q42/gcp-sema/pkg/secretmanager"
+	"google.golang.org/grpc/status"
+)
+
+// proxyMetrics are exposed on /metrics in the Prometheus text format
+type proxyMetrics struct {
+	m                sync.Mutex
+	requests         map[[2]string]int64 // endpoint, code
+	cacheResults     map[[2]string]int64 // cache, hit or miss
+	upstreamDuration map[string]*histogram
+	upstreamErrors   map[[2]string]int64 // operation, gRPC code
+}
+
+// histogramBuckets are the Prometheus default buckets, in seconds
+var histogramBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []int64 // per bucket, not cumulative
+	sum    float64
+	count  int64
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		requests:         make(map[[2]string]int64),
+		cacheResults:     make(map[[2]string]int64),
+		upstreamDuration: make(map[string]*histogram),
+		upstreamErrors:   make(map[[2]string]int64),
+	}
+}
+
+// instrument counts the requests of endpoint by status code
+func (p *proxyMetrics) instrument(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		handler(recorder, r)
+		p.m.Lock()
+		defer p.m.Unlock()
+		p.requests[[2]string{endpoint, strconv.Itoa(recorder.status)}]++
+	}
+}
+
+func (p *proxyMetrics) cacheResult(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.cacheResults[[2]string{cache, result}]++
+}
+
+func (p *proxyMetrics) upstream(operation string, start time.Time, err error) {
+	seconds := time.Since(start).Seconds()
+	p.m.Lock()
+	defer p.m.Unlock()
+	h, exists := p.upstreamDuration[operation]
+	if !exists {
+		h = &histogram{counts: make([]int64, len(histogramBuckets))}
+		p.upstreamDuration[operation] = h
+	}
+	for i, bound := range histogramBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+	if err != nil {
+		p.upstreamErrors[[2]string{operation, errorCode(err)}]++
+	}
+}
+
+// errorCode is the gRPC code of err, also for the errors of the other KVClient implementations
+func errorCode(err error) string {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	switch {
+	case errors.As(err, &grpcErr):
+		return grpcErr.GRPCStatus().Code().String()
+	case secretmanager.IsNotFound(err):
+		return "NotFound"
+	case errors.Is(err, context.Canceled):
+		return "Canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "DeadlineExceeded"
+	}
+	return "Unknown"
+}
+
+// write outputs all metrics, cachedEntries are counted when scraped
+func (p *proxyMetrics) write(w io.Writer, cachedEntries map[[2]string]int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	writeHeader(w, "sema_proxy_requests_total", "counter", "Requests by endpoint and status code.")
+	for _, labels := range sortedLabels(p.requests) {
+		fmt.Fprintf(w, "sema_proxy_requests_total{endpoint=%q,code=%q} %d\n", escapeLabel(labels[0]), labels[1], p.requests[labels])
+	}
+	writeHeader(w, "sema_proxy_cache_requests_total", "counter", "Cache lookups by cache (list, secret, value) and result (hit, miss).")
+	for _, labels := range sortedLabels(p.cacheResults) {
+		fmt.Fprintf(w, "sema_proxy_cache_requests_total{cache=%q,result=%q} %d\n", labels[0], labels[1], p.cacheResults[labels])
+	}
+	writeHeader(w, "sema_proxy_upstream_duration_seconds", "histogram", "Latency of Secret Manager requests by operation.")
+	operations := make([]string, 0, len(p.upstreamDuration))
+	for operation := range p.upstreamDuration {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	for _, operation := range operations {
+		h := p.upstreamDuration[operation]
+		cumulative := int64(0)
+		for i, bound := range histogramBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "sema_proxy_upstream_duration_seconds_bucket{operation=%q,le=%q} %d\n", operation, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "sema_proxy_upstream_duration_seconds_bucket{operation=%q,le=\"+Inf\"} %d\n", operation, h.count)
+		fmt.Fprintf(w, "sema_proxy_upstream_duration_seconds_sum{operation=%q} %g\n", operation, h.sum)
+		fmt.Fprintf(w, "sema_proxy_upstream_duration_seconds_count{operation=%q} %d\n", operation, h.count)
+	}
+	writeHeader(w, "sema_proxy_upstream_errors_total", "counter", "Failed Secret Manager requests by operation and gRPC code.")
+	for _, labels := range sortedLabels(p.upstreamErrors) {
+		fmt.Fprintf(w, "sema_proxy_upstream_errors_total{operation=%q,code=%q} %d\n", labels[0], labels[1], p.upstreamErrors[labels])
+	}
+	writeHeader(w, "sema_proxy_cached_entries", "gauge", "Entries in the cache by project and cache (list, secret, value).")
+	counts := make(map[[2]string]int64, len(cachedEntries))
+	for labels, count := range cachedEntries {
+		counts[labels] = int64(count)
+	}
+	for _, labels := range sortedLabels(counts) {
+		fmt.Fprintf(w, "sema_proxy_cached_entries{project=%q,cache=%q} %d\n", escapeLabel(labels[0]), labels[1], counts[labels])
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedLabels(values map[[2]string]int64) [][2]string {
+	result := make([][2]string, 0, len(values))
+	for labels := range values {
+		result = append(result, labels)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i][0] < result[j][0] || (result[i][0] == result[j][0] && result[i][1] < result[j][1])
+	})
+	return result
+}
+
+// escapeLabel prevents %q from producing Go escapes that Prometheus does not understand
+func escapeLabel(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// metricsClient records the latency and errors of all Secret Manager requests
+type metricsClient struct {
+	secretmanager.KVClient
+	metrics *proxyMetrics
+}
+
+func (c metricsClient) ListKeys(ctx context.Context) ([]secretmanager.KVValue, error) {
+	start := time.Now()
+	list, err := c.KVClient.ListKeys(ctx)
+	c.metrics.upstream("list", start, err)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]secretmanager.KVValue, len(list))
+	for i := range list {
+		wrapped[i] = metricsKeyValue{KVValue: list[i], metrics: c.metrics}
+	}
+	return wrapped, nil
+}
+
+func (c metricsClient) Get(ctx context.Context, name string) (secretmanager.KVValue, error) {
+	start := time.Now()
+	v, err := c.KVClient.Get(ctx, name)
+	c.metrics.upstream("get", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return metricsKeyValue{KVValue: v, metrics: c.metrics}, nil
+}
+
+func (c metricsClient) New(ctx context.Context, name string, labels map[string]string) (secretmanager.KVValue, error) {
+	start := time.Now()
+	v, err := c.KVClient.New(ctx, name, labels)
+	c.metrics.upstream("new", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return metricsKeyValue{KVValue: v, metrics: c.metrics}, nil
+}
+
+type metricsKeyValue struct {
+	secretmanager.KVValue
+	metrics *proxyMetrics
+}
+
+func (v metricsKeyValue) GetValue(ctx context.Context) ([]byte, error) {
+	start := time.Now()
+	data, err := v.KVValue.GetValue(ctx)
+	v.metrics.upstream("value", start, err)
+	return data, err
+}
+
+func (v metricsKeyValue) GetVersionValue(ctx context.Context, version string) ([]byte, error) {
+	start := time.Now()
+	data, err := v.KVValue.GetVersionValue(ctx, version)
+	v.metrics.upstream("value", start, err)
+	return data, err
+}
+
+func (v metricsKeyValue) ListVersions(ctx context.Context) ([]secretmanager.KVVersion, error) {
+	start := time.Now()
+	versions, err := v.KVValue.ListVersions(ctx)
+	v.metrics.upstream("versions", start, err)
+	return versions, err
+}
+
+func (v metricsKeyValue) SetValue(ctx context.Context, data []byte) (string, error) {
+	start := time.Now()
+	version, err := v.KVValue.SetValue(ctx, data)
+	v.metrics.upstream("set_value", start, err)
+	return version, err
+}
+
+func (v metricsKeyValue) SetLabels(ctx context.Context, labels map[string]string) error {
+	start := time.Now()
+	err := v.KVValue.SetLabels(ctx, labels)
+	v.metrics.upstream("set_labels", start, err)
+	return err
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenUnix creates the socket with the mode already applied through the umask, so it is never accessible to others
+func listenUnix(socket string, mode os.FileMode) (net.Listener, error) {
+	previous := syscall.Umask(int(0777 &^ mode))
+	defer syscall.Umask(previous)
+	return net.Listen("unix", socket)
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnix creates the socket and then applies the mode, Windows has no umask
+func listenUnix(socket string, mode os.FileMode) (net.Listener, error) {
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(socket, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// proxyAuditEntry is a JSON line of the --audit-log. Failed writes are recorded as well.
+type proxyAuditEntry struct {
+	Time      time.Time
+	Principal string
+	Action    string // new, set_value or set_labels
+	Project   string
+	ShortName string
+	FullName  string            `json:",omitempty"`
+	Version   string            `json:",omitempty"`
+	SHA256    string            `json:",omitempty"` // of the value
+	Labels    map[string]string `json:",omitempty"`
+	Error     string            `json:",omitempty"`
+}
+
+// allowWrite responds with an error if the request may not write the secret
+func (opts *proxyCommand) allowWrite(rw http.ResponseWriter, r *http.Request, principal *proxyPrincipal) (projectID, shortName string, body proxyWrite, ok bool) {
+	projectID = r.URL.Query().Get("project")
+	shortName = r.URL.Query().Get("shortName")
+	switch {
+	case r.Method != http.MethodPost:
+		http.Error(rw, "Use POST", http.StatusMethodNotAllowed)
+	case !opts.AllowWrites || opts.audit == nil:
+		http.Error(rw, "Writes are disabled, start the proxy with --allow-writes", http.StatusForbidden)
+	case !principal.Write || !principal.allows(projectID, shortName):
+		http.Error(rw, fmt.Sprintf("%s may not write %q of project %q", principal.Name, shortName, projectID), http.StatusForbidden)
+	case shortName == "":
+		http.Error(rw, "Missing shortName", http.StatusBadRequest)
+	default:
+		if err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, 1<<20)).Decode(&body); err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid body: %s", err), http.StatusBadRequest)
+			return
+		}
+		ok = true
+	}
+	return
+}
+
+// written records the write, invalidates the cache and responds with result
+func (opts *proxyCommand) written(rw http.ResponseWriter, entry proxyAuditEntry, result interface{}, err error) {
+	entry.Time = opts.now().UTC()
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	opts.audit.write(entry)
+	opts.invalidateSecret(entry.Project, entry.ShortName)
+	if err != nil {
+		proxyError(rw, err)
+		return
+	}
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		http.Error(rw, err.Error(), 500)
+		return
+	}
+	rw.WriteHeader(200)
+	rw.Write(jsonData)
+}
+
+func (opts *proxyCommand) newSecret(rw http.ResponseWriter, r *http.Request, principal *proxyPrincipal) {
+	projectID, shortName, body, ok := opts.allowWrite(rw, r, principal)
+	if !ok {
+		return
+	}
+	entry := proxyAuditEntry{Principal: principal.Name, Action: "new", Project: projectID, ShortName: shortName, Labels: body.Labels}
+	client, err := opts.getClient(projectID)
+	if err != nil {
+		opts.written(rw, entry, nil, err)
+		return
+	}
+	k, err := client.New(r.Context(), shortName, body.Labels)
+	if err != nil {
+		opts.written(rw, entry, nil, err)
+		return
+	}
+	entry.FullName = k.GetFullName()
+	opts.written(rw, entry, proxySecret{ShortName: k.GetShortName(), FullName: k.GetFullName(), Labels: k.GetLabels()}, nil)
+}
+
+func (opts *proxyCommand) setValue(rw http.ResponseWriter, r *http.Request, principal *proxyPrincipal) {
+	projectID, shortName, body, ok := opts.allowWrite(rw, r, principal)
+	if !ok {
+		return
+	}
+	data, err := base64.RawStdEncoding.DecodeString(body.Data)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid data: %s", err), http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(data)
+	entry := proxyAuditEntry{Principal: principal.Name, Action: "set_value", Project: projectID, ShortName: shortName, SHA256: hex.EncodeToString(sum[:])}
+	k, err := opts.getSecretSafe(projectID, shortName)
+	if err != nil {
+		opts.written(rw, entry, nil, err)
+		return
+	}
+	entry.FullName = k.GetFullName()
+	entry.Version, err = k.SetValue(r.Context(), data)
+	opts.written(rw, entry, proxyWriteResult{Version: entry.Version}, err)
+}
+
+func (opts *proxyCommand) setLabels(rw http.ResponseWriter, r *http.Request, principal *proxyPrincipal) {
+	projectID, shortName, body, ok := opts.allowWrite(rw, r, principal)
+	if !ok {
+		return
+	}
+	entry := proxyAuditEntry{Principal: principal.Name, Action: "set_labels", Project: projectID, ShortName: shortName, Labels: body.Labels}
+	k, err := opts.getSecretSafe(projectID, shortName)
+	if err != nil {
+		opts.written(rw, entry, nil, err)
+		return
+	}
+	entry.FullName = k.GetFullName()
+	err = k.SetLabels(r.Context(), body.Labels)
+	opts.written(rw, entry, proxySecret{ShortName: k.GetShortName(), FullName: k.GetFullName(), Labels: body.Labels}, err)
+}
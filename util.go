@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 // prints stack
@@ -12,12 +19,46 @@ func panicIfErr(err error) {
 	}
 }
 
+// commandContext returns a context that is cancelled on Ctrl-C / SIGTERM,
+// or when the (optional, if > 0) timeout expires.
+func commandContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if timeout <= 0 {
+		return ctx, stop
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// abortedError replaces err with a short explanation if the command was cancelled or timed out
+func abortedError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return errors.Wrap(ctx.Err(), "aborted")
+	}
+	return err
+}
+
+// recoverAborted must be deferred: it converts panics caused by a cancelled context into an error.
+// Other panics are left untouched.
+func recoverAborted(ctx context.Context, err *error) {
+	if ctx.Err() == nil {
+		return
+	}
+	if r := recover(); r != nil {
+		*err = errors.Wrap(ctx.Err(), "aborted")
+	}
+}
+
+// askForConfirmation defaults to no, also when stdin is closed
 func askForConfirmation() bool {
 	var response string
 
 	_, err := fmt.Scanln(&response)
 	if err != nil {
-		log.Fatal(err)
+		return false
 	}
 
 	switch strings.ToLower(response) {